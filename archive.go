@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	"github.com/satori/go.uuid"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+const (
+	archivesKeyPrefix = "archives/"
+	// s3 multipart parts must be at least 5MB (but the last) and there can be at most 10000 of them
+	minArchivePartSize = 8 << 20
+	maxArchiveParts    = 10000
+	archiveReadChunk   = 1 << 20
+	// stop and hand over to a new invocation when less than this is left of the lambda time limit
+	archiveTimeMargin = 90 * time.Second
+	archiveURLExpiry  = time.Hour
+)
+
+// archiveKey - the s3 key of the zip archive of a job: archives/{sessionId}/{jobId}.zip
+func archiveKey(sessionID, jobID string) string {
+	return archivesKeyPrefix + sessionID + "/" + jobID + ".zip"
+}
+
+// archiveStateKey - the s3 key the progress of an unfinished job is saved under between invocations
+func archiveStateKey(sessionID, jobID string) string {
+	return archivesKeyPrefix + sessionID + "/" + jobID + ".state.json"
+}
+
+// uniqueArchiveName - the name of a file inside the archive; repeated names get a ` (n)` suffix so no file is shadowed
+func uniqueArchiveName(name string, used map[string]bool) string {
+	candidate := name
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; used[candidate]; n++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+// archiveObject - an s3 object to add to the archive
+type archiveObject struct {
+	Key      string    `json:"key"`
+	Name     string    `json:"name"`
+	Size     uint64    `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// archiveState - the progress of an archive job, saved to s3 whenever an invocation runs out of time.
+//	* Tail holds the archive bytes written but not yet uploaded as a part; it is always smaller than a part
+//	* Read and Current describe the object being streamed, so the next invocation resumes inside it with a ranged GET
+type archiveState struct {
+	UploadID string             `json:"uploadId"`
+	PartSize int                `json:"partSize"`
+	Parts    []s3.CompletedPart `json:"parts"`
+	Written  uint64             `json:"written"`
+	Tail     []byte             `json:"tail"`
+	Objects  []archiveObject    `json:"objects"`
+	Next     int                `json:"next"`
+	Read     uint64             `json:"read"`
+	Current  *zipEntry          `json:"current,omitempty"`
+	Entries  []zipEntry         `json:"entries"`
+}
+
+// errArchiveYield - the invocation is out of time and the job was handed over to a new one
+var errArchiveYield = fmt.Errorf("archive job handed over to a new invocation")
+
+// archiver - runs an archive job within one invocation
+type archiver struct {
+	ctx        context.Context
+	job        *archiveJob
+	state      *archiveState
+	bucketName string
+	s3API      s3iface.S3API
+	logger     *LOGGER.Entry
+}
+
+// requestSessionArchive - create an archive job for the session and start it in the archive worker.
+//	* the caller must have authorized the user on the session
+func requestSessionArchive(sess *session, email, functionName, jobsTableName string, dbAPI dynamodbiface.DynamoDBAPI, lambdaAPI lambdaiface.LambdaAPI, logger *LOGGER.Entry) (*archiveJob, error) {
+	logger.WithFields(LOGGER.Fields{
+		"session_id": *sess.ID,
+	}).Info("requestSessionArchive() - create an archive job for the session")
+	id, _ := uuid.NewV4()
+	now := time.Now()
+	active := true
+	job := &archiveJob{
+		ID:        id.String(),
+		SessionID: *sess.ID,
+		Email:     email,
+		Status:    jobStatusPending,
+		Key:       archiveKey(*sess.ID, id.String()),
+		Meta: &baseMeta{
+			MetaCreatedAt: &now,
+			MetaUpdatedAt: &now,
+			MetaIsActive:  &active,
+		},
+	}
+	jobMap, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return nil, errInternal("unable to create the archive job", err)
+	}
+	if err := putNewItem(jobMap, "id", jobsTableName, dbAPI, logger); err != nil {
+		return nil, errInternal("unable to create the archive job", err)
+	}
+	if err := startArchiveWorker(job.ID, functionName, lambdaAPI, logger); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// startArchiveWorker - asynchronously invoke the archive worker for the job
+func startArchiveWorker(jobID, functionName string, lambdaAPI lambdaiface.LambdaAPI, logger *LOGGER.Entry) error {
+	payload, err := json.Marshal(archiveEvent{JobID: jobID})
+	if err != nil {
+		return errInternal("unable to start the archive job", err)
+	}
+	_, err = lambdaAPI.InvokeRequest(&lambda.InvokeInput{
+		FunctionName:   aws.String(functionName),
+		InvocationType: lambda.InvocationTypeEvent,
+		Payload:        payload,
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"job_id":   jobID,
+			"function": functionName,
+			"error":    err.Error(),
+		}).Error("startArchiveWorker() - an error occurred while trying to invoke the archive worker")
+		return errInternal("unable to start the archive job", err)
+	}
+	return nil
+}
+
+// findArchiveJob - find an archive job by its id
+func findArchiveJob(id, jobsTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*archiveJob, error) {
+	output, err := dbAPI.GetItemRequest(&dynamodb.GetItemInput{
+		TableName:      aws.String(jobsTableName),
+		Key:            map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		ConsistentRead: aws.Bool(true),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"job_id": id,
+			"error":  err.Error(),
+		}).Error("findArchiveJob() - an error occurred while trying to find the archive job")
+		return nil, errInternal("unable to look up the archive job", err)
+	}
+	if len(output.Item) == 0 {
+		return nil, errNotFound("no archive job exists with the given id")
+	}
+	var job = new(archiveJob)
+	if err = dynamodbattribute.UnmarshalMap(output.Item, &job); err != nil {
+		return nil, errInternal("unable to read the archive job", err)
+	}
+	return job, nil
+}
+
+// updateArchiveJob - save the status and results of an archive job
+func updateArchiveJob(job *archiveJob, jobsTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	now := time.Now()
+	job.Meta.MetaUpdatedAt = &now
+	jobMap, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return errInternal("unable to save the archive job", err)
+	}
+	if err := putItem(jobMap, jobsTableName, dbAPI, logger); err != nil {
+		return errInternal("unable to save the archive job", err)
+	}
+	return nil
+}
+
+// archiveDownloadURL - presign the download of a finished archive
+func archiveDownloadURL(job *archiveJob, bucketName string, s3API s3iface.S3API, logger *LOGGER.Entry) (*string, error) {
+	url, err := s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(job.Key),
+		ResponseContentDisposition: aws.String(`attachment; filename="session-` + job.SessionID + `.zip"`),
+	}).Presign(archiveURLExpiry)
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"job_id": job.ID,
+			"error":  err.Error(),
+		}).Error("archiveDownloadURL() - an error occurred while trying to presign the download")
+		return nil, errInternal("unable to create the download url", err)
+	}
+	return &url, nil
+}
+
+// runArchiveJob - stream every uploaded file of the session into a zip archive written to s3 with a multipart upload.
+//	* nothing is buffered beyond one multipart part: each file is copied through in chunks with ranged GETs
+//	* when the invocation is about to run out of time the progress is saved to s3 and the job is handed over to a new
+//	invocation of the worker, so sessions of any size fit the lambda time limit
+//	* a job that already finished is left alone, so duplicate deliveries of the async event are harmless
+func runArchiveJob(ctx context.Context, jobID, bucketName, jobsTableName, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, lambdaAPI lambdaiface.LambdaAPI, logger *LOGGER.Entry) error {
+	logger = logger.WithField("job_id", jobID)
+	job, err := findArchiveJob(jobID, jobsTableName, dbAPI, logger)
+	if err != nil {
+		return err
+	}
+	if job.Status == jobStatusComplete || job.Status == jobStatusFailed {
+		logger.Info("runArchiveJob() - the job already finished")
+		return nil
+	}
+	a := &archiver{ctx: ctx, job: job, bucketName: bucketName, s3API: s3API, logger: logger}
+	if err := a.loadState(); err != nil {
+		return err
+	}
+	if a.state == nil {
+		if err := a.start(filesTableName, dbAPI); err != nil {
+			return a.fail(err, jobsTableName, dbAPI)
+		}
+		job.Status = jobStatusRunning
+		job.FileCount = int64(len(a.state.Objects))
+		if err := updateArchiveJob(job, jobsTableName, dbAPI, logger); err != nil {
+			return err
+		}
+	}
+	err = a.run()
+	if err == errArchiveYield {
+		if err := a.saveState(); err != nil {
+			return err
+		}
+		logger.WithFields(LOGGER.Fields{
+			"next":    a.state.Next,
+			"objects": len(a.state.Objects),
+			"written": a.state.Written,
+		}).Info("runArchiveJob() - out of time, handing the job over to a new invocation")
+		return startArchiveWorker(jobID, lambdacontext.FunctionName, lambdaAPI, logger)
+	}
+	if err != nil {
+		return a.fail(err, jobsTableName, dbAPI)
+	}
+	job.Status = jobStatusComplete
+	job.Size = int64(a.state.Written)
+	if err := updateArchiveJob(job, jobsTableName, dbAPI, logger); err != nil {
+		return err
+	}
+	a.deleteState()
+	logger.WithFields(LOGGER.Fields{
+		"files": len(a.state.Entries),
+		"size":  a.state.Written,
+	}).Info("runArchiveJob() - the archive is complete")
+	return nil
+}
+
+// fail - mark the job failed and clean up its partial upload; the job is not retried
+func (a *archiver) fail(cause error, jobsTableName string, dbAPI dynamodbiface.DynamoDBAPI) error {
+	a.logger.WithFields(LOGGER.Fields{
+		"error": cause.Error(),
+	}).Error("runArchiveJob() - the archive job failed")
+	if a.state != nil && a.state.UploadID != "" {
+		_, _ = a.s3API.AbortMultipartUploadRequest(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(a.bucketName),
+			Key:      aws.String(a.job.Key),
+			UploadId: aws.String(a.state.UploadID),
+		}).Send()
+	}
+	a.deleteState()
+	msg := cause.Error()
+	a.job.Status = jobStatusFailed
+	a.job.Error = &msg
+	return updateArchiveJob(a.job, jobsTableName, dbAPI, a.logger)
+}
+
+// start - list the files to archive and create the multipart upload.
+//	* only files whose content was uploaded and scanned clean are included; pending records without an object are
+//	skipped
+func (a *archiver) start(filesTableName string, dbAPI dynamodbiface.DynamoDBAPI) error {
+	files, err := findFiles(a.job.SessionID, filesTableName, dbAPI, a.logger)
+	if err != nil {
+		return err
+	}
+	objects := map[string]s3.Object{}
+	var token *string
+	for {
+		page, err := a.s3API.ListObjectsV2Request(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(a.bucketName),
+			Prefix:            aws.String(sessionPrefix(a.job.SessionID)),
+			ContinuationToken: token,
+		}).Send()
+		if err != nil {
+			return errInternal("unable to list the session files", err)
+		}
+		for _, obj := range page.Contents {
+			objects[*obj.Key] = obj
+		}
+		if page.IsTruncated == nil || !*page.IsTruncated {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	// only the current version of every file is archived
+	files = currentFiles(files)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	state := &archiveState{Objects: []archiveObject{}, Entries: []zipEntry{}}
+	used := map[string]bool{}
+	var total uint64
+	for _, f := range files {
+		if checkDownloadable(f) != nil {
+			continue
+		}
+		obj, ok := objects[f.Key]
+		if !ok && f.Status == fileStatusComplete && !strings.HasPrefix(f.Key, sessionPrefix(a.job.SessionID)) {
+			// deduplicated content is stored in a shared blob and sanitized content under sanitized/, outside the
+			// session prefix
+			obj, ok = s3.Object{Key: aws.String(f.Key), Size: aws.Int64(f.Size), LastModified: f.Meta.MetaCreatedAt}, true
+		}
+		if !ok {
+			continue
+		}
+		o := archiveObject{Key: f.Key, Name: uniqueArchiveName(f.Name, used)}
+		if obj.Size != nil {
+			o.Size = uint64(*obj.Size)
+		}
+		if obj.LastModified != nil {
+			o.Modified = *obj.LastModified
+		}
+		total += o.Size
+		state.Objects = append(state.Objects, o)
+	}
+	// grow the part size for large sessions so the archive fits in the part limit, leaving room for the headers
+	state.PartSize = minArchivePartSize
+	if need := int(total/(maxArchiveParts-100)) + 1; need > state.PartSize {
+		state.PartSize = need
+	}
+	output, err := a.s3API.CreateMultipartUploadRequest(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(a.bucketName),
+		Key:         aws.String(a.job.Key),
+		ContentType: aws.String("application/zip"),
+	}).Send()
+	if err != nil {
+		return errInternal("unable to start the archive upload", err)
+	}
+	state.UploadID = *output.UploadId
+	a.state = state
+	return nil
+}
+
+// run - write the remaining files and the central directory, then complete the upload
+func (a *archiver) run() error {
+	st := a.state
+	for st.Next < len(st.Objects) {
+		obj := st.Objects[st.Next]
+		if st.Current == nil {
+			st.Current = &zipEntry{Name: obj.Name, Modified: obj.Modified, Offset: st.Written, Size: obj.Size}
+			if err := a.write(zipLocalHeader(st.Current)); err != nil {
+				return err
+			}
+		}
+		if err := a.copyObject(obj); err != nil {
+			return err
+		}
+		if err := a.write(zipDataDescriptor(st.Current)); err != nil {
+			return err
+		}
+		st.Entries = append(st.Entries, *st.Current)
+		st.Current = nil
+		st.Read = 0
+		st.Next++
+		if a.outOfTime() {
+			return errArchiveYield
+		}
+	}
+	if err := a.write(zipCentralDirectory(st.Entries, st.Written)); err != nil {
+		return err
+	}
+	if err := a.uploadPart(st.Tail); err != nil {
+		return err
+	}
+	st.Tail = nil
+	_, err := a.s3API.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(a.bucketName),
+		Key:             aws.String(a.job.Key),
+		UploadId:        aws.String(st.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: st.Parts},
+	}).Send()
+	if err != nil {
+		return errInternal("unable to complete the archive upload", err)
+	}
+	return nil
+}
+
+// copyObject - stream the rest of the object into the archive, resuming at the offset already read
+func (a *archiver) copyObject(obj archiveObject) error {
+	st := a.state
+	if st.Read >= obj.Size {
+		return nil
+	}
+	output, err := a.s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(obj.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", st.Read, obj.Size-1)),
+	}).Send()
+	if err != nil {
+		return errInternal("unable to read "+obj.Name, err)
+	}
+	defer output.Body.Close()
+	chunk := make([]byte, archiveReadChunk)
+	for st.Read < obj.Size {
+		n, err := io.ReadFull(output.Body, chunk)
+		if n > 0 {
+			st.Current.CRC = crc32.Update(st.Current.CRC, crc32.IEEETable, chunk[:n])
+			st.Read += uint64(n)
+			if werr := a.write(chunk[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return errInternal("unable to read "+obj.Name, err)
+		}
+		if st.Read < obj.Size && a.outOfTime() {
+			return errArchiveYield
+		}
+	}
+	if st.Read != obj.Size {
+		// the object changed since the job started; the sizes already written would be wrong
+		return errInternal(obj.Name+" changed while the archive was being written", nil)
+	}
+	return nil
+}
+
+// write - append bytes to the archive, uploading a part whenever a full part is buffered
+func (a *archiver) write(b []byte) error {
+	st := a.state
+	st.Tail = append(st.Tail, b...)
+	st.Written += uint64(len(b))
+	if len(st.Tail) < st.PartSize {
+		return nil
+	}
+	if err := a.uploadPart(st.Tail); err != nil {
+		return err
+	}
+	st.Tail = st.Tail[:0]
+	return nil
+}
+
+// uploadPart - upload the bytes as the next part of the archive
+func (a *archiver) uploadPart(b []byte) error {
+	st := a.state
+	number := int64(len(st.Parts) + 1)
+	if number > maxArchiveParts {
+		return errInternal("the archive is too large", nil)
+	}
+	output, err := a.s3API.UploadPartRequest(&s3.UploadPartInput{
+		Bucket:        aws.String(a.bucketName),
+		Key:           aws.String(a.job.Key),
+		UploadId:      aws.String(st.UploadID),
+		PartNumber:    aws.Int64(number),
+		ContentLength: aws.Int64(int64(len(b))),
+		Body:          bytes.NewReader(b),
+	}).Send()
+	if err != nil {
+		return errInternal("unable to upload the archive", err)
+	}
+	st.Parts = append(st.Parts, s3.CompletedPart{ETag: output.ETag, PartNumber: aws.Int64(number)})
+	return nil
+}
+
+// outOfTime - whether the invocation should stop and hand the job over
+func (a *archiver) outOfTime() bool {
+	deadline, ok := a.ctx.Deadline()
+	return ok && time.Until(deadline) < archiveTimeMargin
+}
+
+// loadState - load the progress saved by a previous invocation; the state is nil if the job has not started
+func (a *archiver) loadState() error {
+	output, err := a.s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(archiveStateKey(a.job.SessionID, a.job.ID)),
+	}).Send()
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil
+		}
+		return errInternal("unable to load the archive job progress", err)
+	}
+	defer output.Body.Close()
+	b, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return errInternal("unable to load the archive job progress", err)
+	}
+	var state = new(archiveState)
+	if err := json.Unmarshal(b, state); err != nil {
+		return errInternal("unable to load the archive job progress", err)
+	}
+	a.state = state
+	return nil
+}
+
+// saveState - save the progress for the next invocation
+func (a *archiver) saveState() error {
+	b, err := json.Marshal(a.state)
+	if err != nil {
+		return errInternal("unable to save the archive job progress", err)
+	}
+	_, err = a.s3API.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(a.bucketName),
+		Key:           aws.String(archiveStateKey(a.job.SessionID, a.job.ID)),
+		ContentType:   aws.String("application/json"),
+		ContentLength: aws.Int64(int64(len(b))),
+		Body:          bytes.NewReader(b),
+	}).Send()
+	if err != nil {
+		return errInternal("unable to save the archive job progress", err)
+	}
+	return nil
+}
+
+// deleteState - remove the saved progress of a finished job; best effort
+func (a *archiver) deleteState() {
+	_, err := a.s3API.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(archiveStateKey(a.job.SessionID, a.job.ID)),
+	}).Send()
+	if err != nil {
+		a.logger.WithFields(LOGGER.Fields{
+			"error": err.Error(),
+		}).Warn("runArchiveJob() - unable to delete the saved job progress")
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+const blobsKeyPrefix = "blobs/"
+
+// blobID - the id content is stored under for the user the files are charged to: {owner}/{hash}.
+//	* content is only shared between the files of one user, so a checksum declared by someone who never uploaded the
+//	content cannot complete a file with the content of another user
+//	* the owner is the hex sha256 of the lower cased email, so the keys do not expose it
+func blobID(email, hash string) string {
+	owner := sha256.Sum256([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(owner[:]) + "/" + hash
+}
+
+// blobKey - the s3 key of the content with the given blob id: blobs/{owner}/{hash}
+func blobKey(id string) string {
+	return blobsKeyPrefix + id
+}
+
+// isHexSHA256 - whether the value is a hex encoded sha256
+func isHexSHA256(value string) bool {
+	b, err := hex.DecodeString(value)
+	return err == nil && len(b) == 32
+}
+
+// parseBlobKey - the blob id of a blob key.
+//	* blobs stored before content was scoped to its owner have the hex sha256 alone as their id
+func parseBlobKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, blobsKeyPrefix) {
+		return "", false
+	}
+	id := strings.TrimPrefix(key, blobsKeyPrefix)
+	parts := strings.Split(id, "/")
+	for _, part := range parts {
+		if !isHexSHA256(part) {
+			return "", false
+		}
+	}
+	if len(parts) > 2 {
+		return "", false
+	}
+	return id, true
+}
+
+// blobHash - the hex sha256 content is stored under for a declared checksum.
+//	* only SHA256 checksums are collision resistant enough to address content by; other uploads are not deduplicated
+func blobHash(checksum *fileChecksum) string {
+	if checksum == nil || checksum.Algorithm != checksumSHA256 {
+		return ""
+	}
+	digest, err := base64.StdEncoding.DecodeString(checksum.Value)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(digest)
+}
+
+// acquireBlob - reference the blob of the content for a new file, creating a PENDING blob if the content is unknown.
+//	* the reference count is incremented in the same conditional update, so concurrent uploads of the same content
+//	share one blob; a COMPLETE blob means the content is already stored and the transfer can be skipped
+//	* s3 verifies every upload to a blob key against the sha256, so concurrent uploads to a PENDING blob are harmless
+func acquireBlob(hash string, size int64, blobsTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*blob, error) {
+	logger.WithFields(LOGGER.Fields{
+		"hash": hash,
+		"size": size,
+	}).Info("acquireBlob() - reference the stored content of the hash")
+	now := time.Now()
+	active := true
+	update := expression.Set(expression.Name("key"), expression.Name("key").IfNotExists(expression.Value(blobKey(hash)))).
+		Set(expression.Name("size"), expression.Name("size").IfNotExists(expression.Value(size))).
+		Set(expression.Name("status"), expression.Name("status").IfNotExists(expression.Value(fileStatusPending))).
+		Set(expression.Name("meta"), expression.Name("meta").IfNotExists(expression.Value(&baseMeta{
+			MetaCreatedAt: &now,
+			MetaUpdatedAt: &now,
+			MetaIsActive:  &active,
+		}))).
+		Add(expression.Name("ref_count"), expression.Value(1))
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.Or(
+			expression.Name("hash").AttributeNotExists(),
+			expression.Name("size").Equal(expression.Value(size)),
+		)).
+		Build()
+	if err != nil {
+		return nil, errInternal("unable to look up the stored content", err)
+	}
+	output, err := dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(blobsTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"hash": {S: aws.String(hash)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueAllNew,
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, errValidation("the size does not match the content of the checksum")
+		}
+		logger.WithFields(LOGGER.Fields{
+			"hash":  hash,
+			"error": err.Error(),
+		}).Error("acquireBlob() - an error occurred while trying to reference the blob")
+		return nil, errInternal("unable to look up the stored content", err)
+	}
+	var b = new(blob)
+	if err = dynamodbattribute.UnmarshalMap(output.Attributes, &b); err != nil {
+		return nil, errInternal("unable to read the stored content", err)
+	}
+	return b, nil
+}
+
+// releaseBlob - drop a file's reference to a blob; the last reference deletes the blob record and its content.
+//	* the record is only deleted while the count is still 0, so content referenced again in the meantime is kept
+func releaseBlob(hash, bucketName, blobsTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) error {
+	logger.WithFields(LOGGER.Fields{
+		"hash": hash,
+	}).Info("releaseBlob() - drop a reference to the stored content")
+	key := map[string]dynamodb.AttributeValue{"hash": {S: aws.String(hash)}}
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.Add(expression.Name("ref_count"), expression.Value(-1))).
+		WithCondition(expression.Name("hash").AttributeExists()).
+		Build()
+	if err != nil {
+		return errInternal("unable to release the stored content", err)
+	}
+	output, err := dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(blobsTableName),
+		Key:                       key,
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueAllNew,
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil
+		}
+		logger.WithFields(LOGGER.Fields{
+			"hash":  hash,
+			"error": err.Error(),
+		}).Error("releaseBlob() - an error occurred while trying to release the blob")
+		return errInternal("unable to release the stored content", err)
+	}
+	var b = new(blob)
+	if err = dynamodbattribute.UnmarshalMap(output.Attributes, &b); err != nil {
+		return errInternal("unable to release the stored content", err)
+	}
+	if b.RefCount > 0 {
+		return nil
+	}
+	expr, err = expression.NewBuilder().
+		WithCondition(expression.Name("ref_count").LessThanEqual(expression.Value(0))).
+		Build()
+	if err != nil {
+		return errInternal("unable to release the stored content", err)
+	}
+	_, err = dbAPI.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		TableName:                 aws.String(blobsTableName),
+		Key:                       key,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil
+		}
+		logger.WithFields(LOGGER.Fields{
+			"hash":  hash,
+			"error": err.Error(),
+		}).Error("releaseBlob() - an error occurred while trying to delete the blob record")
+		return errInternal("unable to release the stored content", err)
+	}
+	_, err = s3API.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(b.Key),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"hash":  hash,
+			"error": err.Error(),
+		}).Error("releaseBlob() - an error occurred while trying to delete the blob content")
+		return errInternal("unable to delete the stored content", err)
+	}
+	if len(b.Thumbnails) > 0 {
+		if _, err := deleteObjects(thumbnailsPrefix(b.Key), bucketName, s3API, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findBlob - find a blob record by its hash; nil if the content is not known
+func findBlob(hash, blobsTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*blob, error) {
+	output, err := dbAPI.GetItemRequest(&dynamodb.GetItemInput{
+		TableName:      aws.String(blobsTableName),
+		Key:            map[string]dynamodb.AttributeValue{"hash": {S: aws.String(hash)}},
+		ConsistentRead: aws.Bool(true),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"hash":  hash,
+			"error": err.Error(),
+		}).Error("findBlob() - an error occurred while trying to find the blob record")
+		return nil, errInternal("unable to look up the stored content", err)
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	var b = new(blob)
+	if err = dynamodbattribute.UnmarshalMap(output.Item, &b); err != nil {
+		return nil, errInternal("unable to read the stored content", err)
+	}
+	return b, nil
+}
+
+// findFilesByBlob - find the file records referencing a blob through the blob_hash index of the files table
+func findFilesByBlob(hash, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) ([]*file, error) {
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("blob_hash").Equal(expression.Value(hash))).
+		Build()
+	if err != nil {
+		return nil, errInternal("unable to list the files of the content", err)
+	}
+	input := dynamodb.QueryInput{
+		TableName:                 aws.String(filesTableName),
+		IndexName:                 aws.String(filesByBlobIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	files := []*file{}
+	for {
+		output, err := dbAPI.QueryRequest(&input).Send()
+		if err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"hash":  hash,
+				"error": err.Error(),
+			}).Error("findFilesByBlob() - an error occurred while trying to query the file records")
+			return nil, errInternal("unable to list the files of the content", err)
+		}
+		for _, item := range output.Items {
+			var f = new(file)
+			if err := dynamodbattribute.UnmarshalMap(item, &f); err == nil {
+				files = append(files, f)
+			}
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			return files, nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// ingestBlob - confirm the content uploaded to a blob key and complete every file waiting for it.
+//	* s3 checked the content against the sha256 of the key, so only the declared size of each file is compared
+//	* the sniffed content type is saved on the blob for files uploaded with the same content later; files whose
+//	session does not allow the type are rejected, while the blob is kept for the files that are allowed it
+//	* the content is scanned for malware and its thumbnails generated once; the results are saved on the blob and on
+//	each of its completed files
+//	* content nobody asked to upload is quarantined
+func (in *ingestor) ingestBlob(obj *uploadedObject, hash string, logger *LOGGER.Entry) error {
+	b, err := findBlob(hash, in.blobsTableName, in.dbAPI, logger)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return quarantineObject(obj.Key, rejectNoRecord, obj.Bucket, in.s3API, logger)
+	}
+	if obj.SniffedType, err = sniffObject(obj.Key, obj.Bucket, in.s3API, logger); err != nil {
+		return err
+	}
+	if b.Status != fileStatusComplete {
+		now := time.Now()
+		update := expression.Set(expression.Name("status"), expression.Value(fileStatusComplete)).
+			Set(expression.Name("size"), expression.Value(obj.Size)).
+			Set(expression.Name("sniffed_type"), expression.Value(obj.SniffedType)).
+			Set(expression.Name("meta.meta__updated_at"), expression.Value(now))
+		if obj.ETag != "" {
+			update = update.Set(expression.Name("etag"), expression.Value(obj.ETag))
+		}
+		expr, err := expression.NewBuilder().
+			WithUpdate(update).
+			WithCondition(expression.Name("hash").AttributeExists()).
+			Build()
+		if err != nil {
+			return errInternal("unable to update the blob record", err)
+		}
+		_, err = in.dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(in.blobsTableName),
+			Key:                       map[string]dynamodb.AttributeValue{"hash": {S: aws.String(hash)}},
+			UpdateExpression:          expr.Update(),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		}).Send()
+		if err != nil && !isConditionalCheckFailed(err) {
+			logger.WithFields(LOGGER.Fields{
+				"hash":  hash,
+				"error": err.Error(),
+			}).Error("ingestBlob() - an error occurred while trying to complete the blob record")
+			return errInternal("unable to update the blob record", err)
+		}
+	}
+	files, err := findFilesByBlob(hash, in.filesTableName, in.dbAPI, logger)
+	if err != nil {
+		return err
+	}
+	// the files this event completed; their older versions beyond the version limit are deleted
+	completed := []*file{}
+	for _, f := range files {
+		if f.Status != fileStatusPending {
+			continue
+		}
+		reason := checkUpload(obj, f)
+		if reason == "" {
+			if reason, err = in.typeRejection(f, obj.SniffedType, logger); err != nil {
+				return err
+			}
+		}
+		status := fileStatusComplete
+		if reason != "" {
+			status = fileStatusRejected
+		}
+		if err := setFileStatus(f, status, obj, in.filesTableName, in.usageTableName, in.dbAPI, logger); err != nil {
+			return err
+		}
+		if f.Status == fileStatusComplete {
+			completed = append(completed, f)
+		}
+	}
+	scan, thumbs := b.Scan, b.Thumbnails
+	if scan == nil || scan.Status == scanStatusPending || scan.Status == scanStatusError {
+		scan, thumbs = processContent(obj.Key, obj.SniffedType, obj.Size, obj.Bucket, in.scanner, in.s3API, logger)
+		if err := saveProcessing(map[string]dynamodb.AttributeValue{"hash": {S: aws.String(hash)}}, "hash", scan, thumbs, in.blobsTableName, in.dbAPI, logger); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if f.Status != fileStatusComplete || scanOf(f).Status == scan.Status {
+			continue
+		}
+		if err := saveProcessing(map[string]dynamodb.AttributeValue{"id": {S: aws.String(f.ID)}}, "id", scan, thumbs, in.filesTableName, in.dbAPI, logger); err != nil {
+			return err
+		}
+	}
+	for _, f := range completed {
+		if err := pruneVersions(f, in.maxVersions, obj.Bucket, in.filesTableName, in.blobsTableName, in.usageTableName, in.dbAPI, in.s3API, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobKeys(t *testing.T) {
+	sha := &fileChecksum{Algorithm: checksumSHA256, Value: "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek="}
+	hash := blobHash(sha)
+	assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", hash)
+	parsed, ok := parseBlobKey(blobKey(hash))
+	assert.True(t, ok, "blobs stored before content was scoped to its owner")
+	assert.Equal(t, hash, parsed)
+
+	// content is only shared between the files charged to the same user
+	id := blobID("Alice@example.com", hash)
+	assert.Equal(t, id, blobID("alice@example.com", hash))
+	assert.NotEqual(t, id, blobID("mallory@example.com", hash))
+	assert.NotContains(t, blobKey(id), "alice")
+	parsed, ok = parseBlobKey(blobKey(id))
+	assert.True(t, ok)
+	assert.Equal(t, id, parsed)
+
+	// only sha256 addressed content is deduplicated
+	assert.Equal(t, "", blobHash(&fileChecksum{Algorithm: checksumCRC32C, Value: "yZRlqg=="}))
+	assert.Equal(t, "", blobHash(nil))
+
+	for _, key := range []string{"blobs/", "blobs/b94d27b9", "blobs/../sessions/s1/f1/a.txt", "sessions/s1/f1/" + hash, "blobs/" + hash + "/", "blobs/" + id + "/" + hash} {
+		_, ok := parseBlobKey(key)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestDeduplicationScopedToOwner(t *testing.T) {
+	sha := &fileChecksum{Algorithm: checksumSHA256, Value: "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek="}
+	id := blobID("alice@example.com", blobHash(sha))
+	stored, err := dynamodbattribute.MarshalMap(&blob{Hash: id, Key: blobKey(id), Size: 11, Status: fileStatusComplete, RefCount: 2})
+	assert.Nil(t, err)
+	sess := &session{ID: aws.String("s1"), Email: "alice@example.com", Status: aws.String(statusUploading)}
+
+	// the blob looked up is the one of the uploading user
+	for _, email := range []string{"alice@example.com", "mallory@example.com"} {
+		db := &mockDynamo{item: map[string]map[string]dynamodb.AttributeValue{"blobs": stored}}
+		_, _ = requestUploadURL(sess, email, "a.txt", "text/plain", 11, sha, nil, roleEditor, &quotaConfig{}, &typePolicy{}, 10, linkStore, db, &mockS3{}, testLogger())
+		var ids []string
+		for i, table := range db.updates {
+			if table == "blobs" {
+				ids = append(ids, *db.updateKeys[i]["hash"].S)
+			}
+		}
+		assert.Equal(t, []string{blobID(email, blobHash(sha))}, ids, email)
+	}
+
+	// content the user already stored completes the file, but its checksum is not verified since nothing was uploaded
+	db := &mockDynamo{item: map[string]map[string]dynamodb.AttributeValue{"blobs": stored}}
+	ticket, err := requestUploadURL(sess, "alice@example.com", "a.txt", "text/plain", 11, sha, nil, roleOwner, &quotaConfig{}, &typePolicy{}, 10, linkStore, db, &mockS3{}, testLogger())
+	assert.Nil(t, err)
+	assert.True(t, ticket.AlreadyPresent)
+	assert.Equal(t, fileStatusComplete, ticket.File.Status)
+	assert.Nil(t, ticket.File.Checksum.VerifiedAt)
+}
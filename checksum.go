@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+// checksum algorithms a client can declare for an upload; the names match the s3 ChecksumAlgorithm values
+const (
+	checksumSHA256 = "SHA256"
+	checksumCRC32C = "CRC32C"
+)
+
+// maxVerifyBytes - the largest file verifyFile hashes; larger ones cannot be read and hashed within the timeout of a
+// graphql request
+const maxVerifyBytes = 64 << 20
+
+// checksumHeaders - the s3 header that makes s3 verify the uploaded content against the checksum
+var checksumHeaders = map[string]string{
+	checksumSHA256: "x-amz-checksum-sha256",
+	checksumCRC32C: "x-amz-checksum-crc32c",
+}
+
+// newChecksumHash - the hash computing the checksum of the algorithm
+func newChecksumHash(algorithm string) hash.Hash {
+	if algorithm == checksumCRC32C {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return sha256.New()
+}
+
+// newChecksum - validate the checksum a client declared for an upload.
+//	* the value is the base64 encoded digest, the form s3 expects in the checksum headers
+func newChecksum(algorithm, value string) (*fileChecksum, error) {
+	if _, ok := checksumHeaders[algorithm]; !ok {
+		return nil, errValidation("the checksum algorithm must be " + checksumSHA256 + " or " + checksumCRC32C)
+	}
+	digest, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(digest) != newChecksumHash(algorithm).Size() {
+		return nil, errValidation("the checksum must be the base64 encoded " + algorithm + " digest of the file")
+	}
+	return &fileChecksum{Algorithm: algorithm, Value: value}, nil
+}
+
+// computeChecksum - the base64 encoded checksum of the content
+func computeChecksum(r io.Reader, algorithm string) (string, error) {
+	h := newChecksumHash(algorithm)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyFile - recompute the checksum of the stored file content for an audit.
+//	* the content is streamed from s3 and hashed with the declared algorithm; files uploaded without a checksum get
+//	a SHA256 one recorded, so later audits have something to compare against
+//	* a matching checksum has its verified_at refreshed; a mismatch is reported and leaves the record untouched
+//	* files larger than maxVerifyBytes are refused, since they are hashed within the request
+//	* the caller must have authorized the user on the session
+func verifyFile(f *file, bucketName, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) (*fileVerification, error) {
+	logger.WithFields(LOGGER.Fields{
+		"file_id": f.ID,
+	}).Info("verifyFile() - recompute the checksum of the stored file")
+	if f.Status != fileStatusComplete {
+		return nil, errConflict("only completely uploaded files can be verified").withExtension("status", f.Status)
+	}
+	if f.Size > maxVerifyBytes {
+		return nil, errValidation("the file is too large to be verified; files up to 64 MiB can be verified").
+			withExtension("maxSize", maxVerifyBytes)
+	}
+	algorithm := checksumSHA256
+	if f.Checksum != nil {
+		algorithm = f.Checksum.Algorithm
+	}
+	output, err := s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(f.Key),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("verifyFile() - an error occurred while trying to read the stored file")
+		return nil, errInternal("unable to read the stored file", err)
+	}
+	actual, err := computeChecksum(output.Body, algorithm)
+	output.Body.Close()
+	if err != nil {
+		return nil, errInternal("unable to read the stored file", err)
+	}
+	now := time.Now()
+	result := &fileVerification{FileID: f.ID, Algorithm: algorithm, Actual: actual, Match: true, VerifiedAt: now}
+	if f.Checksum != nil {
+		result.Expected = aws.String(f.Checksum.Value)
+		result.Match = f.Checksum.Value == actual
+	}
+	if !result.Match {
+		logger.WithFields(LOGGER.Fields{
+			"file_id":  f.ID,
+			"expected": f.Checksum.Value,
+			"actual":   actual,
+		}).Error("verifyFile() - the stored file does not match its checksum")
+		return result, nil
+	}
+	checksum := &fileChecksum{Algorithm: algorithm, Value: actual, VerifiedAt: &now}
+	if err := saveChecksum(f, checksum, filesTableName, dbAPI, logger); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// saveChecksum - save the verified checksum on the file record
+func saveChecksum(f *file, checksum *fileChecksum, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.Set(expression.Name("checksum"), expression.Value(checksum))).
+		WithCondition(expression.Name("id").AttributeExists()).
+		Build()
+	if err != nil {
+		return errInternal("unable to save the checksum", err)
+	}
+	_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(filesTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(f.ID)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return errNotFound("no file exists with the given id")
+		}
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("saveChecksum() - an error occurred while trying to save the checksum")
+		return errInternal("unable to save the checksum", err)
+	}
+	f.Checksum = checksum
+	return nil
+}
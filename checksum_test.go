@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	// the values s3 reports for the content in its checksum headers
+	sum, err := computeChecksum(strings.NewReader("hello world"), checksumSHA256)
+	assert.Nil(t, err)
+	assert.Equal(t, "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=", sum)
+	sum, err = computeChecksum(strings.NewReader("hello world"), checksumCRC32C)
+	assert.Nil(t, err)
+	assert.Equal(t, "yZRlqg==", sum)
+
+	c, err := newChecksum(checksumCRC32C, "yZRlqg==")
+	assert.Nil(t, err)
+	assert.Equal(t, &fileChecksum{Algorithm: checksumCRC32C, Value: "yZRlqg=="}, c)
+
+	for _, invalid := range [][2]string{
+		{"MD5", "XrY7u+Ae7tCTyyK7j1rNww=="},
+		{checksumSHA256, "yZRlqg=="},
+		{checksumSHA256, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"},
+		{checksumCRC32C, ""},
+	} {
+		_, err := newChecksum(invalid[0], invalid[1])
+		assert.NotNil(t, err, invalid[1])
+	}
+}
+
+func TestVerifyFileSizeBound(t *testing.T) {
+	// refused before anything is read from s3
+	f := &file{ID: "f1", Status: fileStatusComplete, Size: maxVerifyBytes + 1}
+	_, err := verifyFile(f, "bucket", "files", &mockDynamo{}, &mockS3{}, testLogger())
+	assert.Equal(t, codeValidation, codeOf(err))
+	assert.Equal(t, maxVerifyBytes, err.(*serviceError).Extensions()["maxSize"])
+}
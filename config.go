@@ -10,28 +10,49 @@ config - provides interface implementations to initiate and expose configuration
 	- GraphQL Schema Instance: a built graphql schema with
 		- queries:
 			- get a user
-			- get a list of sessions
+			- get a list of sessions, optionally filtered by metadata and tags
 			- get a session by id
+			- get the files of a session, optionally filtered by metadata and tags
+			- get a download url for a file
+			- get the versions of a file
+			- get the collaborators of a session / the sessions shared with the user
+			- get the storage usage and quotas of the user
+			- resolve a share link to the shared files, without an account
 		- mutations
 			- register a new user
 			- authenticate a user
 			- init a new session
-			- upload file(s) to the session
-			- remove files from the session
+			- submit / close a session
+			- archive / delete a session
+			- invite / remove a collaborator of a session
+			- create an upload link for a session / upload a file through it without an account
+			- create a share link for a session or files / revoke a link
+			- request an upload url for a file in the session, optionally bound to a SHA256 or CRC32C checksum; content
+			already stored under the same SHA256 is not transferred again
+			- delete a file of a session
+			- set the file types allowed in a session
+			- strip the metadata of the images uploaded to a session, optionally keeping the originals
+			- verify the stored content of a file against its checksum
+			- scan the stored content of a file for malware again
+			- restore an older version of a file
+			- set the metadata and tags of a session or a file
 */
 package main
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"os"
 	"strconv"
-
-	"github.com/mitchellh/mapstructure"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/lambdaiface"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
 	"github.com/graphql-go/graphql"
@@ -46,26 +67,85 @@ const (
 	usersTableNameKey    = "USERS_TABLE_NAME"
 	tablesMapSessionKey  = "SESSIONS"
 	sessionsTableNameKey = "SESSIONS_TABLE_NAME"
+	tablesMapFileKey     = "FILES"
+	filesTableNameKey    = "FILES_TABLE_NAME"
+	tablesMapMemberKey   = "MEMBERS"
+	membersTableNameKey  = "MEMBERS_TABLE_NAME"
+	tablesMapLinkKey     = "LINKS"
+	linksTableNameKey    = "LINKS_TABLE_NAME"
+	tablesMapJobKey      = "JOBS"
+	jobsTableNameKey     = "JOBS_TABLE_NAME"
+	tablesMapBlobKey     = "BLOBS"
+	blobsTableNameKey    = "BLOBS_TABLE_NAME"
+	tablesMapUsageKey    = "USAGE"
+	usageTableNameKey    = "USAGE_TABLE_NAME"
+	quotasKey            = "QUOTAS"
+	fileTypePolicyKey    = "FILE_TYPE_POLICY"
+	clamdAddressKey      = "CLAMD_ADDRESS"
+	clamdMaxLengthKey    = "CLAMD_STREAM_MAX_LENGTH"
+	maxFileVersionsKey   = "MAX_FILE_VERSIONS"
+	archiveFunctionKey   = "ARCHIVE_FUNCTION_NAME"
+	uploadsBucketNameKey = "UPLOADS_BUCKET_NAME"
+	logLevelKey          = "LOG_LEVEL"
+	logFormatKey         = "LOG_FORMAT"
+	logPrettyKey         = "LOG_PRETTY"
+	logReportCallerKey   = "LOG_REPORT_CALLER"
+	sessionsByEmailIndex = "email-session_start_date-index"
+	filesBySessionIndex  = "session_id-name-index"
+	membersByEmailIndex  = "email-session_id-index"
+	filesByBlobIndex     = "blob_hash-index"
+	filesByPendingIndex  = "status-pending_until-index"
+	defaultPageSize      = 20
+	maxPageSize          = 100
 )
 
+// sessionIndexKeys - the key attributes of an item in the sessions email index (table key + index key)
+var sessionIndexKeys = []string{"id", "email", "session_start_date"}
+
 type config interface {
 	initAwsConfig() error
 	dynamoImpl() dynamodbiface.DynamoDBAPI
 	s3Impl() s3iface.S3API
+	lambdaImpl() lambdaiface.LambdaAPI
 	initLoggerConfig()
 	loggerImpl() *LOGGER.Logger
 	initSchema() error
 	schemaImpl() *graphql.Schema
 	init() (config, error)
 	tableNames() map[string]string
+	uploadsBucket() string
+	stores() storeNames
+	archiveFunction() string
+	quotaLimits() *quotaConfig
+	fileTypePolicy() *typePolicy
+	malwareScanner() scanner
+	fileVersionLimit() int
+}
+
+// storeNames - the bucket and the tables a file upload touches, as configured; passed as one value so the upload
+// functions do not take each name as a separate argument
+type storeNames struct {
+	bucket   string
+	sessions string
+	files    string
+	links    string
+	blobs    string
+	usage    string
 }
 
 type conf struct {
 	dynamo         dynamodbiface.DynamoDBAPI
 	s3             s3iface.S3API
+	lambda         lambdaiface.LambdaAPI
 	log            *LOGGER.Logger
 	schema         *graphql.Schema
 	tableName      map[string]string
+	bucketName     string
+	archiveFnName  string
+	quotas         *quotaConfig
+	typePolicy     *typePolicy
+	scanner        scanner
+	maxVersions    int
 	jwtSecret      []byte
 	tokenExpiryMin int
 }
@@ -74,6 +154,7 @@ type conf struct {
 //	* load the configuration by using the user associated to this lambda
 //	* use the configuration to instantiate a new dynamo service impl
 //	* use the configuration to instantiate a new s3 service impl
+//	* use the configuration to instantiate a new lambda service impl (starts the archive worker)
 func (c *conf) initAwsConfig() error {
 	// establish the aws awsConfig with the env access key and secret
 	cfg, err := external.LoadDefaultAWSConfig()
@@ -84,6 +165,7 @@ func (c *conf) initAwsConfig() error {
 	// instantiate service impl
 	c.dynamo = dynamodb.New(cfg)
 	c.s3 = s3.New(cfg)
+	c.lambda = lambda.New(cfg)
 	return nil
 }
 
@@ -95,16 +177,36 @@ func (c *conf) s3Impl() s3iface.S3API {
 	return c.s3
 }
 
+func (c *conf) lambdaImpl() lambdaiface.LambdaAPI {
+	return c.lambda
+}
+
 // initLoggerConfig() - instantiate a logger instance with given configurations
+//	* LOG_LEVEL: the minimum level to log; defaults to debug
+//	* LOG_FORMAT: `json` (fields nested under the data key) or `compact` (single line, flat fields); defaults to json
+//	* LOG_PRETTY: pretty print the json format; defaults to true
+//	* LOG_REPORT_CALLER: include the calling func and file on each line; defaults to true
+//	* all output passes through the redacting formatter so secrets never reach the logs
 func (c *conf) initLoggerConfig() {
 	log := LOGGER.New()
-	log.SetFormatter(&LOGGER.JSONFormatter{
-		PrettyPrint: true,
-		DataKey:     dataKey,
-	})
+	level, err := LOGGER.ParseLevel(os.Getenv(logLevelKey))
+	if err != nil {
+		level = LOGGER.DebugLevel
+	}
+	var formatter LOGGER.Formatter
+	switch os.Getenv(logFormatKey) {
+	case logFormatCompact:
+		formatter = newCompactFormatter()
+	default:
+		formatter = &LOGGER.JSONFormatter{
+			PrettyPrint: envBool(logPrettyKey, true),
+			DataKey:     dataKey,
+		}
+	}
+	log.SetFormatter(newRedactingFormatter(formatter, redactKeys()))
 	log.SetOutput(os.Stdout)
-	log.SetReportCaller(true)
-	log.SetLevel(LOGGER.DebugLevel)
+	log.SetReportCaller(envBool(logReportCallerKey, true))
+	log.SetLevel(level)
 	c.log = log
 }
 
@@ -112,6 +214,54 @@ func (c *conf) loggerImpl() *LOGGER.Logger {
 	return c.log
 }
 
+// configFromContext() - get the config of the graphql request from the context, for the resolvers of the shared
+// types; nil outside of a request
+func configFromContext(ctx context.Context) config {
+	if ctx != nil {
+		if c, ok := ctx.Value(configKey).(config); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// requestUser() - validate the Authorization token carried on the request context.
+//	* return the authenticated email along with the request logger tagged with that email
+func (c *conf) requestUser(ctx context.Context) (*string, *LOGGER.Entry, error) {
+	logger := loggerFromContext(ctx)
+	email, err := validateToken(ctx.Value(authHeaderKey), c.jwtSecret, logger)
+	if err != nil {
+		return nil, logger, err
+	}
+	return email, logger.WithField(authEmailKey, *email), nil
+}
+
+// pageArgsFrom() - read and validate the relay pagination arguments of a connection field
+func pageArgsFrom(args map[string]interface{}) (pageArgs, error) {
+	page := pageArgs{First: defaultPageSize}
+	if first, ok := args["first"].(int); ok {
+		page.First = first
+	}
+	if page.First < 1 || page.First > maxPageSize {
+		return page, errValidation(fmt.Sprintf("first must be between 1 and %d", maxPageSize))
+	}
+	if after, ok := args["after"].(string); ok && after != "" {
+		page.After = &after
+	}
+	page.Desc = args["orderBy"] != "START_DATE_ASC"
+	return page, nil
+}
+
+// checksumArg() - read the optional checksum declared for an upload; both the algorithm and the value or neither
+func checksumArg(args map[string]interface{}) (*fileChecksum, error) {
+	algorithm, _ := args["checksumAlgorithm"].(string)
+	value, _ := args["checksum"].(string)
+	if algorithm == "" && value == "" {
+		return nil, nil
+	}
+	return newChecksum(algorithm, value)
+}
+
 func (c *conf) buildRootQuery() *graphql.Object {
 	return graphql.NewObject(graphql.ObjectConfig{
 		Name:        "RootQuery",
@@ -131,7 +281,7 @@ func (c *conf) buildRootQuery() *graphql.Object {
 				},
 				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
 					email := p.Args["email"].(string)
-					return findUserByEmail(email, c.tableNames()[tablesMapUserKey], c.dynamoImpl(), c.loggerImpl())
+					return findUserByEmail(email, c.tableNames()[tablesMapUserKey], c.dynamoImpl(), loggerFromContext(p.Context))
 				},
 			},
 			"getAuthUser": &graphql.Field{
@@ -139,11 +289,11 @@ func (c *conf) buildRootQuery() *graphql.Object {
 				Description: "Get the currently authenticated user by getting their info from the Auth header in the request",
 				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
 					// attempt to validate token
-					email, err := validateToken(p.Context.Value(authHeaderKey), c.jwtSecret, c.loggerImpl())
+					email, logger, err := c.requestUser(p.Context)
 					if err != nil {
 						return nil, err
 					}
-					return findUserByEmail(*email, c.tableNames()[tablesMapUserKey], c.dynamoImpl(), c.loggerImpl())
+					return findUserByEmail(*email, c.tableNames()[tablesMapUserKey], c.dynamoImpl(), logger)
 				},
 			},
 			"getSession": &graphql.Field{
@@ -154,22 +304,213 @@ func (c *conf) buildRootQuery() *graphql.Object {
 				},
 				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
 					id := p.Args["id"].(string)
-					email, err := validateToken(p.Context.Value(authHeaderKey), c.jwtSecret, c.loggerImpl())
+					email, logger, err := c.requestUser(p.Context)
 					if err != nil {
 						return nil, err
 					}
-					return findSessionByID(id, *email, c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), c.loggerImpl())
+					sess, _, err := c.authorize(id, *email, roleViewer, logger)
+					return sess, err
 				},
 			},
 			"getSessions": &graphql.Field{
-				Type:        graphql.NewList(sessionType),
-				Description: "Get all sessions associated with the given email",
+				Type:        graphql.NewNonNull(sessionConnectionType),
+				Description: "Get a page of the sessions associated with the authenticated user",
+				Args: graphql.FieldConfigArgument{
+					"first":         &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultPageSize},
+					"after":         &graphql.ArgumentConfig{Type: graphql.String},
+					"status":        &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(sessionStatusType))},
+					"startedAfter":  &graphql.ArgumentConfig{Type: graphql.DateTime},
+					"startedBefore": &graphql.ArgumentConfig{Type: graphql.DateTime},
+					"orderBy":       &graphql.ArgumentConfig{Type: sessionOrderType, DefaultValue: "START_DATE_DESC"},
+					"metadata":      &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(metadataEntryInputType)), Description: "Only sessions with all of the metadata entries"},
+					"tags":          &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), Description: "Only sessions with all of the tags"},
+					"includeArchived": &graphql.ArgumentConfig{
+						Type:         graphql.Boolean,
+						DefaultValue: false,
+						Description:  "Include archived sessions, which are hidden by default",
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					page, err := pageArgsFrom(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					var filter sessionFilter
+					if statuses, ok := p.Args["status"].([]interface{}); ok {
+						for _, status := range statuses {
+							filter.Status = append(filter.Status, status.(string))
+						}
+					}
+					if startedAfter, ok := p.Args["startedAfter"].(time.Time); ok {
+						filter.StartedAfter = &startedAfter
+					}
+					if startedBefore, ok := p.Args["startedBefore"].(time.Time); ok {
+						filter.StartedBefore = &startedBefore
+					}
+					filter.IncludeArchived, _ = p.Args["includeArchived"].(bool)
+					if filter.Labels, err = labelFilterFrom(p.Args); err != nil {
+						return nil, err
+					}
+					return findSessions(*email, filter, page, c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), logger)
+				},
+			},
+			"getFiles": &graphql.Field{
+				Type:        graphql.NewList(fileType),
+				Description: "Get the current version of every file uploaded into the session, along with the uploads still in flight",
+				Args: graphql.FieldConfigArgument{
+					"sessionId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"metadata":  &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(metadataEntryInputType)), Description: "Only files with all of the metadata entries"},
+					"tags":      &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), Description: "Only files with all of the tags"},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					sessionID := p.Args["sessionId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					filter, err := labelFilterFrom(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					if _, _, err := c.authorize(sessionID, *email, roleViewer, logger); err != nil {
+						return nil, err
+					}
+					files, err := findFiles(sessionID, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
+					}
+					return filterFiles(currentFiles(files), filter), nil
+				},
+			},
+			"fileVersions": &graphql.Field{
+				Type:        graphql.NewList(fileType),
+				Description: "Get every version of the file, newest first; the current version is the newest COMPLETE one",
+				Args: graphql.FieldConfigArgument{
+					"fileId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					fileID := p.Args["fileId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					f, err := findFileByID(fileID, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
+					}
+					if _, _, err := c.authorize(f.SessionID, *email, roleViewer, logger); err != nil {
+						return nil, err
+					}
+					return findFileVersions(f, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+				},
+			},
+			"getDownloadUrl": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.String),
+				Description: "Get a short lived presigned url to download the file",
+				Args: graphql.FieldConfigArgument{
+					"fileId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					fileID := p.Args["fileId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					f, err := findFileByID(fileID, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
+					}
+					if _, _, err := c.authorize(f.SessionID, *email, roleViewer, logger); err != nil {
+						return nil, err
+					}
+					if err := checkDownloadable(f); err != nil {
+						return nil, err
+					}
+					return downloadURL(f, c.uploadsBucket(), c.s3Impl(), logger)
+				},
+			},
+			"getCollaborators": &graphql.Field{
+				Type:        graphql.NewList(memberType),
+				Description: "Get the collaborators the session is shared with",
+				Args: graphql.FieldConfigArgument{
+					"sessionId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					sessionID := p.Args["sessionId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					if _, _, err := c.authorize(sessionID, *email, roleViewer, logger); err != nil {
+						return nil, err
+					}
+					return findMembers(sessionID, c.tableNames()[tablesMapMemberKey], c.dynamoImpl(), logger)
+				},
+			},
+			"resolveShareLink": &graphql.Field{
+				Type:        graphql.NewNonNull(sharedContentsType),
+				Description: "List the files shared through a share link with presigned urls to download them; no account required",
+				Args: graphql.FieldConfigArgument{
+					"token":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"password": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					token := p.Args["token"].(string)
+					password, _ := p.Args["password"].(string)
+					return resolveShareLink(token, password, c.uploadsBucket(), c.tableNames()[tablesMapLinkKey], c.tableNames()[tablesMapFileKey], c.dynamoImpl(), c.s3Impl(), loggerFromContext(p.Context))
+				},
+			},
+			"getArchiveJob": &graphql.Field{
+				Type:        graphql.NewNonNull(archiveJobType),
+				Description: "Get a session archive job; the download url is set once the job is COMPLETE",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
 				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
-					email, err := validateToken(p.Context.Value(authHeaderKey), c.jwtSecret, c.loggerImpl())
+					id := p.Args["id"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					job, err := findArchiveJob(id, c.tableNames()[tablesMapJobKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
+					}
+					if _, _, err := c.authorize(job.SessionID, *email, roleViewer, logger); err != nil {
+						return nil, err
+					}
+					if job.Status == jobStatusComplete {
+						if job.URL, err = archiveDownloadURL(job, c.uploadsBucket(), c.s3Impl(), logger); err != nil {
+							return nil, err
+						}
+					}
+					return job, nil
+				},
+			},
+			"sharedWithMe": &graphql.Field{
+				Type:        graphql.NewList(sharedSessionType),
+				Description: "Get the sessions other users have shared with the authenticated user",
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					email, logger, err := c.requestUser(p.Context)
 					if err != nil {
 						return nil, err
 					}
-					return findSessions(*email, c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), c.loggerImpl())
+					return findSharedSessions(*email, c.tableNames()[tablesMapMemberKey], c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), logger)
+				},
+			},
+			"myUsage": &graphql.Field{
+				Type:        graphql.NewNonNull(usageType),
+				Description: "Get the storage used by the authenticated user and the quotas that limit it",
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					return myUsage(*email, c.quotaLimits(), c.tableNames()[tablesMapUsageKey], c.dynamoImpl(), logger)
 				},
 			},
 		},
@@ -196,7 +537,7 @@ func (c *conf) buildRootMutation() *graphql.Object {
 					name := p.Args["name"].(string)
 					role := p.Args["role"].(string)
 					// attempt to register user
-					return registerUser(email, pwd, name, role, c.tableNames()[tablesMapUserKey], c.dynamoImpl(), c.loggerImpl())
+					return registerUser(email, pwd, name, role, c.tableNames()[tablesMapUserKey], c.dynamoImpl(), loggerFromContext(p.Context))
 				},
 			},
 			"authenticate": &graphql.Field{
@@ -211,7 +552,7 @@ func (c *conf) buildRootMutation() *graphql.Object {
 					email := p.Args["email"].(string)
 					pwd := p.Args["pwd"].(string)
 					// attempt to authenticate user
-					return authenticate(email, pwd, c.tableNames()[tablesMapUserKey], c.jwtSecret, c.tokenExpiryMin, c.dynamoImpl(), c.loggerImpl()), nil
+					return authenticate(email, pwd, c.tableNames()[tablesMapUserKey], c.jwtSecret, c.tokenExpiryMin, c.dynamoImpl(), loggerFromContext(p.Context))
 				},
 			},
 			"saveSession": &graphql.Field{
@@ -221,24 +562,544 @@ func (c *conf) buildRootMutation() *graphql.Object {
 					"sess": &graphql.ArgumentConfig{Type: graphql.NewNonNull(sessionInputType)},
 				},
 				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					// the owner of the session is always the authenticated user
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
 					sess := p.Args["sess"]
-					sessMap, ok := sess.(map[string]interface{}) // convert the input type to a User
+					sessMap, ok := sess.(map[string]interface{}) // convert the input type to a session
 					if !ok {
-						e = errors.New("unable to convert input object to session record")
-						return nil, e
+						return nil, errValidation("unable to convert input object to session record")
 					}
 					var s = new(session)
-					e = mapstructure.Decode(sessMap, &s) // decode map into session instance
+					e = decodeInput(sessMap, s) // decode map into session instance
 					if e != nil {
-						return nil, e
+						return nil, errValidation(e.Error())
+					}
+					var version *int64
+					if v, ok := sessMap["version"].(int); ok {
+						v64 := int64(v)
+						version = &v64
+					}
+					return saveSession(*s, version, *email, c.tableNames()[tablesMapMemberKey], c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), logger)
+				},
+			},
+			"setSessionFileTypes": &graphql.Field{
+				Type:        graphql.NewNonNull(sessionType),
+				Description: "Replace the file types allowed in the session; files already uploaded are not checked again",
+				Args: graphql.FieldConfigArgument{
+					"id":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"policy": &graphql.ArgumentConfig{Type: graphql.NewNonNull(typePolicyInputType)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					id := p.Args["id"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					var policy typePolicy
+					if err := decodeInput(p.Args["policy"], &policy); err != nil {
+						return nil, errValidation(err.Error())
+					}
+					sess, _, err := c.authorize(id, *email, roleOwner, logger)
+					if err != nil {
+						return nil, err
+					}
+					return setSessionTypePolicy(sess, policy, c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), logger)
+				},
+			},
+			"setSessionSanitization": &graphql.Field{
+				Type:        graphql.NewNonNull(sessionType),
+				Description: "Strip exif (including gps), xmp, iptc and comments from the jpeg and png images uploaded to the session from now on",
+				Args: graphql.FieldConfigArgument{
+					"id":            &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"stripMetadata": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Boolean)},
+					"keepOriginal": &graphql.ArgumentConfig{
+						Type:         graphql.Boolean,
+						DefaultValue: false,
+						Description:  "Keep the original upload, metadata included, alongside the sanitized content",
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					id := p.Args["id"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					settings := sanitizeSettings{StripMetadata: p.Args["stripMetadata"].(bool)}
+					if keep, ok := p.Args["keepOriginal"].(bool); ok {
+						settings.KeepOriginal = keep
+					}
+					sess, _, err := c.authorize(id, *email, roleOwner, logger)
+					if err != nil {
+						return nil, err
+					}
+					return setSessionSanitization(sess, settings, c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), logger)
+				},
+			},
+			"setSessionMetadata": &graphql.Field{
+				Type:        graphql.NewNonNull(sessionType),
+				Description: "Replace the metadata and/or the tags of the session; an empty list clears them, an omitted one leaves them as they are",
+				Args: graphql.FieldConfigArgument{
+					"id":       &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"metadata": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(metadataEntryInputType))},
+					"tags":     &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					id := p.Args["id"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					labels, err := labelFilterFrom(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					sess, _, err := c.authorize(id, *email, roleEditor, logger)
+					if err != nil {
+						return nil, err
+					}
+					return setSessionMetadata(sess, labels.Metadata, labels.Tags, c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), logger)
+				},
+			},
+			"setFileMetadata": &graphql.Field{
+				Type:        graphql.NewNonNull(fileType),
+				Description: "Replace the metadata and/or the tags of the file; an empty list clears them, an omitted one leaves them as they are",
+				Args: graphql.FieldConfigArgument{
+					"fileId":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"metadata": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(metadataEntryInputType))},
+					"tags":     &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					fileID := p.Args["fileId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					labels, err := labelFilterFrom(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					f, err := findFileByID(fileID, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
 					}
-					return saveSession(*s, c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), c.loggerImpl())
+					sess, _, err := c.authorize(f.SessionID, *email, roleEditor, logger)
+					if err != nil {
+						return nil, err
+					}
+					return setFileMetadata(sess, f, labels.Metadata, labels.Tags, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+				},
+			},
+			"submitSession": &graphql.Field{
+				Type:        graphql.NewNonNull(sessionType),
+				Description: "Submit the session; sets its end date and stops further uploads",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					return c.resolveTransition(p, statusSubmitted, roleEditor)
+				},
+			},
+			"closeSession": &graphql.Field{
+				Type:        graphql.NewNonNull(sessionType),
+				Description: "Close the session; sets its end date and stops further uploads",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					return c.resolveTransition(p, statusClosed, roleOwner)
+				},
+			},
+			"archiveSession": &graphql.Field{
+				Type:        graphql.NewNonNull(sessionType),
+				Description: "Archive the session; it is kept but hidden from getSessions unless includeArchived is set",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					return c.resolveTransition(p, statusArchived, roleOwner)
+				},
+			},
+			"deleteSession": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Permanently delete the session, its file records and all uploaded content",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					id := p.Args["id"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					sess, _, err := c.authorize(id, *email, roleOwner, logger)
+					if err != nil {
+						return nil, err
+					}
+					if err := deleteSession(sess, c.uploadsBucket(), c.tableNames()[tablesMapFileKey], c.tableNames()[tablesMapMemberKey], c.tableNames()[tablesMapSessionKey], c.tableNames()[tablesMapBlobKey], c.tableNames()[tablesMapUsageKey], c.dynamoImpl(), c.s3Impl(), logger); err != nil {
+						return nil, err
+					}
+					return true, nil
+				},
+			},
+			"requestUploadUrl": &graphql.Field{
+				Type:        graphql.NewNonNull(uploadTicketType),
+				Description: "Register a file in the session and get a presigned url to PUT its content to",
+				Args: graphql.FieldConfigArgument{
+					"sessionId":         &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"name":              &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"contentType":       &graphql.ArgumentConfig{Type: graphql.String},
+					"size":              &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Float)},
+					"checksumAlgorithm": &graphql.ArgumentConfig{Type: checksumAlgorithmType},
+					"checksum":          &graphql.ArgumentConfig{Type: graphql.String, Description: "The base64 encoded digest of the file; s3 refuses content that does not match it"},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					sessionID := p.Args["sessionId"].(string)
+					name := p.Args["name"].(string)
+					contentType, _ := p.Args["contentType"].(string)
+					size := int64(p.Args["size"].(float64))
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					checksum, err := checksumArg(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					sess, role, err := c.authorize(sessionID, *email, roleEditor, logger)
+					if err != nil {
+						return nil, err
+					}
+					return requestUploadURL(sess, *email, name, contentType, size, checksum, nil, role, c.quotaLimits(), c.fileTypePolicy(), c.fileVersionLimit(), c.stores(), c.dynamoImpl(), c.s3Impl(), logger)
+				},
+			},
+			"deleteFile": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Delete a file of a session along with its content; content shared with other files is kept until its last file is deleted",
+				Args: graphql.FieldConfigArgument{
+					"fileId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					fileID := p.Args["fileId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					f, err := findFileByID(fileID, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
+					}
+					sess, _, err := c.authorize(f.SessionID, *email, roleEditor, logger)
+					if err != nil {
+						return nil, err
+					}
+					if status := statusOf(sess); !acceptsUploads(status) {
+						return nil, errConflict("the session is "+status+" and its files can no longer be changed").
+							withExtension("status", status)
+					}
+					if err := deleteFile(f, c.uploadsBucket(), c.tableNames()[tablesMapFileKey], c.tableNames()[tablesMapBlobKey], c.tableNames()[tablesMapUsageKey], c.dynamoImpl(), c.s3Impl(), logger); err != nil {
+						return nil, err
+					}
+					return true, nil
+				},
+			},
+			"createUploadLink": &graphql.Field{
+				Type:        graphql.NewNonNull(uploadLinkType),
+				Description: "Create a public link people without an account can upload files into the session with",
+				Args: graphql.FieldConfigArgument{
+					"sessionId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"expiresAt": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.DateTime)},
+					"maxFiles":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"maxBytes":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Float)},
+					"password":  &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					sessionID := p.Args["sessionId"].(string)
+					expiresAt := p.Args["expiresAt"].(time.Time)
+					maxFiles := int64(p.Args["maxFiles"].(int))
+					maxBytes := int64(p.Args["maxBytes"].(float64))
+					password, _ := p.Args["password"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					sess, _, err := c.authorize(sessionID, *email, roleEditor, logger)
+					if err != nil {
+						return nil, err
+					}
+					return createUploadLink(sess, *email, expiresAt, maxFiles, maxBytes, password, c.tableNames()[tablesMapLinkKey], c.dynamoImpl(), logger)
+				},
+			},
+			"uploadViaLink": &graphql.Field{
+				Type:        graphql.NewNonNull(uploadTicketType),
+				Description: "Register a file through an upload link and get a presigned url to PUT its content to; no account required",
+				Args: graphql.FieldConfigArgument{
+					"token":             &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"password":          &graphql.ArgumentConfig{Type: graphql.String},
+					"contributorName":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"contributorEmail":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"name":              &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"contentType":       &graphql.ArgumentConfig{Type: graphql.String},
+					"size":              &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Float)},
+					"checksumAlgorithm": &graphql.ArgumentConfig{Type: checksumAlgorithmType},
+					"checksum":          &graphql.ArgumentConfig{Type: graphql.String, Description: "The base64 encoded digest of the file; s3 refuses content that does not match it"},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					token := p.Args["token"].(string)
+					password, _ := p.Args["password"].(string)
+					contrib := contributor{
+						Name:  strings.TrimSpace(p.Args["contributorName"].(string)),
+						Email: strings.TrimSpace(p.Args["contributorEmail"].(string)),
+					}
+					name := p.Args["name"].(string)
+					contentType, _ := p.Args["contentType"].(string)
+					size := int64(p.Args["size"].(float64))
+					checksum, err := checksumArg(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					return uploadViaLink(token, password, contrib, name, contentType, size, checksum, c.quotaLimits(), c.fileTypePolicy(), c.fileVersionLimit(), c.stores(), c.dynamoImpl(), c.s3Impl(), loggerFromContext(p.Context))
+				},
+			},
+			"verifyFile": &graphql.Field{
+				Type:        graphql.NewNonNull(fileVerificationType),
+				Description: "Recompute the checksum of a stored file and compare it with the recorded one",
+				Args: graphql.FieldConfigArgument{
+					"fileId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					fileID := p.Args["fileId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					f, err := findFileByID(fileID, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
+					}
+					if _, _, err := c.authorize(f.SessionID, *email, roleEditor, logger); err != nil {
+						return nil, err
+					}
+					return verifyFile(f, c.uploadsBucket(), c.tableNames()[tablesMapFileKey], c.dynamoImpl(), c.s3Impl(), logger)
+				},
+			},
+			"scanFile": &graphql.Field{
+				Type:        graphql.NewNonNull(fileType),
+				Description: "Scan the stored content of a file for malware again, typically after a scan ended in an ERROR",
+				Args: graphql.FieldConfigArgument{
+					"fileId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					fileID := p.Args["fileId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					f, err := findFileByID(fileID, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
+					}
+					if _, _, err := c.authorize(f.SessionID, *email, roleEditor, logger); err != nil {
+						return nil, err
+					}
+					return scanFile(f, c.uploadsBucket(), c.tableNames()[tablesMapFileKey], c.tableNames()[tablesMapBlobKey], c.malwareScanner(), c.dynamoImpl(), c.s3Impl(), logger)
+				},
+			},
+			"restoreFileVersion": &graphql.Field{
+				Type:        graphql.NewNonNull(fileType),
+				Description: "Restore an older version of the file by adding its content as the newest version",
+				Args: graphql.FieldConfigArgument{
+					"fileId":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"versionId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String), Description: "The id of the version to restore, as returned by fileVersions"},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					fileID := p.Args["fileId"].(string)
+					versionID := p.Args["versionId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					f, err := findFileByID(fileID, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
+					}
+					sess, role, err := c.authorize(f.SessionID, *email, roleEditor, logger)
+					if err != nil {
+						return nil, err
+					}
+					if status := statusOf(sess); !acceptsUploads(status) {
+						return nil, errConflict("the session is "+status+" and its files can no longer be changed").
+							withExtension("status", status)
+					}
+					version, err := findFileByID(versionID, c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+					if err != nil {
+						return nil, err
+					}
+					if version.SessionID != f.SessionID || version.Name != f.Name {
+						return nil, errNotFound("no version of the file exists with the given id")
+					}
+					return restoreFileVersion(sess, version, *email, role, c.quotaLimits(), c.fileTypePolicy(), c.fileVersionLimit(), c.stores(), c.dynamoImpl(), c.s3Impl(), logger)
+				},
+			},
+			"requestSessionArchive": &graphql.Field{
+				Type:        graphql.NewNonNull(archiveJobType),
+				Description: "Start zipping every uploaded file of the session; poll getArchiveJob for the download url",
+				Args: graphql.FieldConfigArgument{
+					"sessionId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					sessionID := p.Args["sessionId"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					sess, _, err := c.authorize(sessionID, *email, roleViewer, logger)
+					if err != nil {
+						return nil, err
+					}
+					return requestSessionArchive(sess, *email, c.archiveFunction(), c.tableNames()[tablesMapJobKey], c.dynamoImpl(), c.lambdaImpl(), logger)
+				},
+			},
+			"createShareLink": &graphql.Field{
+				Type:        graphql.NewNonNull(shareLinkType),
+				Description: "Create a public link to download the whole session (sessionId) or some of its files (fileIds)",
+				Args: graphql.FieldConfigArgument{
+					"sessionId":    &graphql.ArgumentConfig{Type: graphql.String},
+					"fileIds":      &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"expiresAt":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.DateTime)},
+					"password":     &graphql.ArgumentConfig{Type: graphql.String},
+					"maxDownloads": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					sessionID, _ := p.Args["sessionId"].(string)
+					var fileIDs []string
+					if ids, ok := p.Args["fileIds"].([]interface{}); ok {
+						for _, id := range ids {
+							fileIDs = append(fileIDs, id.(string))
+						}
+					}
+					expiresAt := p.Args["expiresAt"].(time.Time)
+					password, _ := p.Args["password"].(string)
+					maxDownloads := int64(p.Args["maxDownloads"].(int))
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					if (sessionID == "") == (len(fileIDs) == 0) {
+						return nil, errValidation("either sessionId or fileIds is required, but not both")
+					}
+					if sessionID == "" {
+						// the session of the first file; the rest are checked against it
+						f, err := findFileByID(fileIDs[0], c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+						if err != nil {
+							return nil, err
+						}
+						sessionID = f.SessionID
+					}
+					sess, _, err := c.authorize(sessionID, *email, roleEditor, logger)
+					if err != nil {
+						return nil, err
+					}
+					return createShareLink(sess, fileIDs, *email, expiresAt, maxDownloads, password, c.tableNames()[tablesMapLinkKey], c.tableNames()[tablesMapFileKey], c.dynamoImpl(), logger)
+				},
+			},
+			"revokeLink": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Revoke an upload or share link by its id; it stops working immediately",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					id := p.Args["id"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					if err := revokeLink(id, *email, c.tableNames()[tablesMapLinkKey], c.tableNames()[tablesMapMemberKey], c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), logger); err != nil {
+						return nil, err
+					}
+					return true, nil
+				},
+			},
+			"inviteToSession": &graphql.Field{
+				Type:        graphql.NewNonNull(memberType),
+				Description: "Share the session with another registered user; inviting an existing collaborator changes their role",
+				Args: graphql.FieldConfigArgument{
+					"sessionId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"email":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"role":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(sessionRoleType)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					sessionID := p.Args["sessionId"].(string)
+					invitee := p.Args["email"].(string)
+					role := p.Args["role"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					sess, _, err := c.authorize(sessionID, *email, roleOwner, logger)
+					if err != nil {
+						return nil, err
+					}
+					if _, err := findUserByEmail(invitee, c.tableNames()[tablesMapUserKey], c.dynamoImpl(), logger); err != nil {
+						return nil, err
+					}
+					return inviteToSession(sess, invitee, role, *email, c.tableNames()[tablesMapMemberKey], c.dynamoImpl(), logger)
+				},
+			},
+			"removeCollaborator": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Stop sharing the session with a collaborator; collaborators may also remove themselves",
+				Args: graphql.FieldConfigArgument{
+					"sessionId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"email":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					sessionID := p.Args["sessionId"].(string)
+					collaborator := p.Args["email"].(string)
+					email, logger, err := c.requestUser(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					// anyone on the session may leave it, only the owner may remove someone else
+					role := roleOwner
+					if collaborator == *email {
+						role = roleViewer
+					}
+					if _, _, err := c.authorize(sessionID, *email, role, logger); err != nil {
+						return nil, err
+					}
+					if err := removeCollaborator(sessionID, collaborator, c.tableNames()[tablesMapMemberKey], c.dynamoImpl(), logger); err != nil {
+						return nil, err
+					}
+					return true, nil
 				},
 			},
 		},
 	})
 }
 
+// resolveTransition() - move the session in the `id` arg to the given status, if the authenticated user has the given role on it
+func (c *conf) resolveTransition(p graphql.ResolveParams, to, role string) (interface{}, error) {
+	id := p.Args["id"].(string)
+	email, logger, err := c.requestUser(p.Context)
+	if err != nil {
+		return nil, err
+	}
+	sess, _, err := c.authorize(id, *email, role, logger)
+	if err != nil {
+		return nil, err
+	}
+	return transitionSession(sess, to, c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), logger)
+}
+
+// authorize() - load the session and check the user holds at least the given role on it
+func (c *conf) authorize(sessionID, email, role string, logger *LOGGER.Entry) (*session, string, error) {
+	return authorizeSession(sessionID, email, role, c.tableNames()[tablesMapMemberKey], c.tableNames()[tablesMapSessionKey], c.dynamoImpl(), logger)
+}
+
 // schemaImpl() - init a graphql schema instance with the given:
 //	* queries
 //	* mutations
@@ -263,20 +1124,90 @@ func (c *conf) tableNames() map[string]string {
 	return c.tableName
 }
 
+func (c *conf) uploadsBucket() string {
+	return c.bucketName
+}
+
+// stores() - the bucket and the table names uploads are stored and recorded in
+func (c *conf) stores() storeNames {
+	return storeNames{
+		bucket:   c.bucketName,
+		sessions: c.tableName[tablesMapSessionKey],
+		files:    c.tableName[tablesMapFileKey],
+		links:    c.tableName[tablesMapLinkKey],
+		blobs:    c.tableName[tablesMapBlobKey],
+		usage:    c.tableName[tablesMapUsageKey],
+	}
+}
+
+func (c *conf) archiveFunction() string {
+	return c.archiveFnName
+}
+
+func (c *conf) quotaLimits() *quotaConfig {
+	return c.quotas
+}
+
+func (c *conf) fileTypePolicy() *typePolicy {
+	return c.typePolicy
+}
+
+func (c *conf) malwareScanner() scanner {
+	return c.scanner
+}
+
+func (c *conf) fileVersionLimit() int {
+	return c.maxVersions
+}
+
 // init() - initialize all configurations
 func (c *conf) init() (config, error) {
 	// load table names from env variables
 	usersTableName := os.Getenv(usersTableNameKey)
 	sessionsTableName := os.Getenv(sessionsTableNameKey)
+	filesTableName := os.Getenv(filesTableNameKey)
+	membersTableName := os.Getenv(membersTableNameKey)
+	linksTableName := os.Getenv(linksTableNameKey)
+	jobsTableName := os.Getenv(jobsTableNameKey)
+	blobsTableName := os.Getenv(blobsTableNameKey)
+	usageTableName := os.Getenv(usageTableNameKey)
 	c.tableName = map[string]string{
 		tablesMapUserKey:    usersTableName,
 		tablesMapSessionKey: sessionsTableName,
+		tablesMapFileKey:    filesTableName,
+		tablesMapMemberKey:  membersTableName,
+		tablesMapLinkKey:    linksTableName,
+		tablesMapJobKey:     jobsTableName,
+		tablesMapBlobKey:    blobsTableName,
+		tablesMapUsageKey:   usageTableName,
 	}
-	jwtSecret := os.Getenv(jwtSecretKey)           // get the jwt secret key from the env
-	c.jwtSecret = []byte(jwtSecret)                // set as byte array; required by signer
-	tokenExpiryVal := os.Getenv(tokenExpiryMinKey) // get the jwt expiry value from the env
-	tokenExpiry, _ := strconv.Atoi(tokenExpiryVal) // convert to int
+	c.bucketName = os.Getenv(uploadsBucketNameKey)  // the bucket uploaded files are stored in
+	c.archiveFnName = os.Getenv(archiveFunctionKey) // the worker that zips sessions
+	jwtSecret := os.Getenv(jwtSecretKey)            // get the jwt secret key from the env
+	c.jwtSecret = []byte(jwtSecret)                 // set as byte array; required by signer
+	tokenExpiryVal := os.Getenv(tokenExpiryMinKey)  // get the jwt expiry value from the env
+	tokenExpiry, _ := strconv.Atoi(tokenExpiryVal)  // convert to int
 	c.tokenExpiryMin = tokenExpiry
+	quotas, err := parseQuotas(os.Getenv(quotasKey)) // the storage quotas; unlimited when not configured
+	if err != nil {
+		return c, err
+	}
+	c.quotas = quotas
+	policy, err := parseTypePolicy(os.Getenv(fileTypePolicyKey)) // the file types allowed in every session
+	if err != nil {
+		return c, err
+	}
+	c.typePolicy = policy
+	streamMaxLength, err := parseStreamMaxLength(os.Getenv(clamdMaxLengthKey)) // the largest stream clamd accepts
+	if err != nil {
+		return c, err
+	}
+	c.scanner = newScanner(os.Getenv(clamdAddressKey), streamMaxLength)  // the clamd daemon uploads are scanned with
+	maxVersions, err := parseVersionLimit(os.Getenv(maxFileVersionsKey)) // the completed versions kept of a file
+	if err != nil {
+		return c, err
+	}
+	c.maxVersions = maxVersions
 	c.initLoggerConfig() // initialize logger instance
 	// initialize aws config
 	if err := c.initAwsConfig(); err != nil {
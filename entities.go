@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
 	"github.com/graphql-go/graphql"
 )
 
@@ -44,6 +45,7 @@ type baseMeta struct {
 	MetaCreatedAt *time.Time `json:"meta__created_at"`
 	MetaUpdatedAt *time.Time `json:"meta__updated_at"`
 	MetaIsActive  *bool      `json:"meta__is_active"`
+	MetaVersion   *int64     `json:"meta__version,omitempty"`
 }
 
 type user struct {
@@ -63,14 +65,415 @@ type auth struct {
 }
 
 type session struct {
-	ID          *string    `json:"id,omitempty"`
-	Email       string     `json:"email"`
-	Name        string     `json:"name"`
-	Description *string    `json:"description,omitempty"`
-	StartDate   time.Time  `json:"session_start_date"`
-	EndDate     *time.Time `json:"session_end_date,omitempty"`
-	Status      *string    `json:"status"`
-	Meta        *baseMeta  `json:"meta"`
+	ID          *string     `json:"id,omitempty"`
+	Email       string      `json:"email"`
+	Name        string      `json:"name"`
+	Description *string     `json:"description,omitempty"`
+	StartDate   time.Time   `json:"session_start_date"`
+	EndDate     *time.Time  `json:"session_end_date,omitempty"`
+	Status      *string     `json:"status"`
+	TypePolicy  *typePolicy `json:"type_policy,omitempty"`
+	// whether uploaded images get their metadata stripped; nil for sessions that never opted in
+	Sanitize *sanitizeSettings `json:"sanitize,omitempty"`
+	// the key/value metadata and the tags users attach to the session
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Meta     *baseMeta         `json:"meta"`
+}
+
+// sanitizeSettings - the sanitization an owner opted a session into.
+//	* the original upload is deleted once sanitized, unless KeepOriginal is set
+type sanitizeSettings struct {
+	StripMetadata bool `json:"strip_metadata"`
+	KeepOriginal  bool `json:"keep_original"`
+}
+
+// session lifecycle statuses; the status is owned by the server and only changes through sessionTransitions
+const (
+	statusOpen       = "OPEN"
+	statusUploading  = "UPLOADING"
+	statusSubmitted  = "SUBMITTED"
+	statusProcessing = "PROCESSING"
+	statusClosed     = "CLOSED"
+	statusArchived   = "ARCHIVED"
+)
+
+// session membership roles; each role includes the permissions of the roles ranked below it
+const (
+	roleOwner  = "OWNER"
+	roleEditor = "EDITOR"
+	roleViewer = "VIEWER"
+)
+
+// roleRank - the rank of each role; a higher rank includes every permission of a lower one
+var roleRank = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleOwner:  3,
+}
+
+// hasRole - check whether the role grants at least the permissions of the required role
+func hasRole(role, required string) bool {
+	rank, ok := roleRank[role]
+	return ok && rank >= roleRank[required]
+}
+
+// sessionTransitions - the statuses a session may move to from each status
+var sessionTransitions = map[string][]string{
+	statusOpen:       {statusUploading, statusSubmitted, statusClosed, statusArchived},
+	statusUploading:  {statusSubmitted, statusClosed, statusArchived},
+	statusSubmitted:  {statusProcessing, statusClosed, statusArchived},
+	statusProcessing: {statusClosed, statusArchived},
+	statusClosed:     {statusArchived},
+	statusArchived:   {},
+}
+
+// canTransition - check whether a session may move from one status to another
+func canTransition(from, to string) bool {
+	for _, allowed := range sessionTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsUploads - check whether files may still be uploaded into a session in the given status
+func acceptsUploads(status string) bool {
+	return status == statusOpen || status == statusUploading
+}
+
+// statusOf - the status of the session; sessions saved before statuses were enforced are treated as open
+func statusOf(sess *session) string {
+	if sess.Status == nil {
+		return statusOpen
+	}
+	if _, ok := sessionTransitions[*sess.Status]; !ok {
+		return statusOpen
+	}
+	return *sess.Status
+}
+
+// file upload statuses
+const (
+	fileStatusPending  = "PENDING"
+	fileStatusComplete = "COMPLETE"
+	// the stored object did not match the upload and was moved to quarantine
+	fileStatusRejected = "REJECTED"
+)
+
+type file struct {
+	ID          string  `json:"id"`
+	SessionID   string  `json:"session_id"`
+	Email       string  `json:"email"`
+	Name        string  `json:"name"`
+	ContentType string  `json:"content_type"`
+	Size        int64   `json:"size"`
+	Key         string  `json:"key"`
+	Status      string  `json:"status"`
+	ETag        *string `json:"etag,omitempty"`
+	// the key date after which a PENDING upload that never arrived is expired; removed once the status changes
+	PendingUntil *string `json:"pending_until,omitempty"`
+	// the checksum the client declared for the upload, or the one recorded by the first audit
+	Checksum *fileChecksum `json:"checksum,omitempty"`
+	// set when the content is stored in a shared blob (under blobs/) instead of the session prefix
+	BlobHash *string `json:"blob_hash,omitempty"`
+	// the user whose storage quota the file counts against: the uploader, or the session owner for link uploads
+	ChargedTo string `json:"charged_to,omitempty"`
+	// the content type sniffed from the first bytes of the uploaded content, and whether it differs from the declared one
+	SniffedType  *string `json:"sniffed_type,omitempty"`
+	TypeMismatch bool    `json:"type_mismatch,omitempty"`
+	// the malware scan of the uploaded content; nil until the upload completes
+	Scan *fileScan `json:"scan,omitempty"`
+	// the thumbnails of a clean image, smallest first
+	Thumbnails []thumbnail `json:"thumbnails,omitempty"`
+	// the version of the file among the files of the session with the same name; 0 for files uploaded before
+	// versioning
+	Version int64 `json:"version,omitempty"`
+	// the version this one restored the content of
+	RestoredFrom *string `json:"restored_from,omitempty"`
+	// set once the uploaded content was sanitized; Key, Size, ETag and Checksum describe the sanitized content
+	Sanitization *fileSanitization `json:"sanitization,omitempty"`
+	// the key/value metadata and the tags users attach to the file
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	// set when the file was uploaded through an upload link by someone without an account
+	Contributor *contributor `json:"contributor,omitempty"`
+	Meta        *baseMeta    `json:"meta"`
+}
+
+// blob - content stored once under its sha256 and shared by every file uploaded with that checksum.
+//	* RefCount is the number of file records referencing the blob; the content is deleted with the last of them
+type blob struct {
+	Hash   string  `json:"hash"`
+	Key    string  `json:"key"`
+	Size   int64   `json:"size"`
+	Status string  `json:"status"`
+	ETag   *string `json:"etag,omitempty"`
+	// the content type sniffed when the content was uploaded
+	SniffedType *string `json:"sniffed_type,omitempty"`
+	// the malware scan of the content, shared by every file referencing it
+	Scan       *fileScan   `json:"scan,omitempty"`
+	Thumbnails []thumbnail `json:"thumbnails,omitempty"`
+	RefCount   int64       `json:"ref_count"`
+	Meta       *baseMeta   `json:"meta"`
+}
+
+// fileChecksum - the base64 encoded checksum of a file content.
+//	* VerifiedAt is set once s3 accepted the upload against the checksum, and refreshed by every audit that matches
+type fileChecksum struct {
+	Algorithm  string     `json:"algorithm"`
+	Value      string     `json:"value"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+// fileScan - the result of scanning a file content for malware.
+//	* Signature names the malware an INFECTED scan found; Message explains an ERROR
+type fileScan struct {
+	Status    string     `json:"status"`
+	Signature *string    `json:"signature,omitempty"`
+	Message   *string    `json:"message,omitempty"`
+	ScannedAt *time.Time `json:"scanned_at,omitempty"`
+}
+
+// thumbnail - a scaled down copy of an image stored under the thumbnails/ prefix.
+//	* Size is the bounding box it was generated for; Width and Height are its actual dimensions
+type thumbnail struct {
+	Size        int    `json:"size"`
+	Key         string `json:"key"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"content_type"`
+}
+
+// fileSanitization - the sanitization of an uploaded content.
+//	* Removed lists the metadata blocks found and removed; it is empty for images without metadata
+//	* Skipped explains why content of a sanitized type was left as uploaded
+//	* OriginalKey is the key the content was uploaded under; it is only kept in s3 when OriginalKept is set
+//	* Orientation is the exif orientation kept in the sanitized image so viewers still display it upright
+type fileSanitization struct {
+	Method       string    `json:"method"`
+	Removed      []string  `json:"removed"`
+	Orientation  *int64    `json:"orientation,omitempty"`
+	OriginalKey  string    `json:"original_key"`
+	OriginalSize int64     `json:"original_size"`
+	OriginalKept bool      `json:"original_kept"`
+	Skipped      *string   `json:"skipped,omitempty"`
+	SanitizedAt  time.Time `json:"sanitized_at"`
+}
+
+// fileVerification - the result of recomputing the checksum of a stored file
+type fileVerification struct {
+	FileID     string    `json:"file_id"`
+	Algorithm  string    `json:"algorithm"`
+	Expected   *string   `json:"expected,omitempty"`
+	Actual     string    `json:"actual"`
+	Match      bool      `json:"match"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// contributor - the external person who uploaded a file through an upload link
+type contributor struct {
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	LinkID string `json:"link_id"`
+}
+
+// uploadLink - a public link external contributors upload files into a session with.
+//	* the record is keyed by the sha256 of the token; the token itself is only returned when the link is created
+//	* the counters are only changed through conditional updates so the limits hold under concurrent uploads
+type uploadLink struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token,omitempty" dynamodbav:"-"`
+	Kind      string    `json:"kind"`
+	SessionID string    `json:"session_id"`
+	CreatedBy string    `json:"created_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+	TTL       int64     `json:"ttl"`
+	MaxFiles  int64     `json:"max_files"`
+	MaxBytes  int64     `json:"max_bytes"`
+	FileCount int64     `json:"file_count"`
+	ByteCount int64     `json:"byte_count"`
+	PwdHash   *string   `json:"pwd_hash,omitempty"`
+	Meta      *baseMeta `json:"meta"`
+}
+
+// member - a collaborator a session is shared with.
+//	* the owner is the session email and never has a member record
+type member struct {
+	SessionID string    `json:"session_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	Meta      *baseMeta `json:"meta"`
+}
+
+// sharedSession - a session shared with the user along with the role the user holds on it
+type sharedSession struct {
+	Role    string   `json:"role"`
+	Session *session `json:"session"`
+}
+
+// shareLink - a public link to download a whole session or some of its files.
+//	* stored in the links table next to the upload links, keyed by the sha256 of the token
+//	* no file ids means the whole session is shared
+type shareLink struct {
+	ID            string    `json:"id"`
+	Token         string    `json:"token,omitempty" dynamodbav:"-"`
+	Kind          string    `json:"kind"`
+	SessionID     string    `json:"session_id"`
+	FileIDs       []string  `json:"file_ids,omitempty"`
+	CreatedBy     string    `json:"created_by"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	TTL           int64     `json:"ttl"`
+	MaxDownloads  int64     `json:"max_downloads"`
+	DownloadCount int64     `json:"download_count"`
+	PwdHash       *string   `json:"pwd_hash,omitempty"`
+	Meta          *baseMeta `json:"meta"`
+}
+
+// sharedFile - a file shared through a share link and the presigned url to download it.
+//	* share links are resolved without an account, so only what is needed to download the file is exposed; the
+//	uploader, the session, the scan and the labels of the file are not
+type sharedFile struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// sharedContents - what a share link resolves to
+type sharedContents struct {
+	Files              []*sharedFile `json:"files"`
+	ExpiresAt          time.Time     `json:"expiresAt"`
+	DownloadsRemaining int64         `json:"downloadsRemaining"`
+}
+
+// archive job statuses
+const (
+	jobStatusPending  = "PENDING"
+	jobStatusRunning  = "RUNNING"
+	jobStatusComplete = "COMPLETE"
+	jobStatusFailed   = "FAILED"
+)
+
+// archiveJob - a background job zipping every uploaded file of a session into a single download
+type archiveJob struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"session_id"`
+	Email     string    `json:"email"`
+	Status    string    `json:"status"`
+	Key       string    `json:"key"`
+	FileCount int64     `json:"file_count"`
+	Size      int64     `json:"size"`
+	Error     *string   `json:"error,omitempty"`
+	URL       *string   `json:"url,omitempty" dynamodbav:"-"`
+	Meta      *baseMeta `json:"meta"`
+}
+
+// archiveEvent - the payload the archive worker is invoked with
+type archiveEvent struct {
+	JobID string `json:"jobId"`
+}
+
+// migrationEvent - the payload the migration worker is invoked with by hand: the name of the migration to run
+type migrationEvent struct {
+	Migration string `json:"migration"`
+}
+
+// uploadTicket - a pending file record together with the presigned url the client PUTs the file to.
+//	* the headers were signed into the url and must be sent with the PUT as they are
+//	* when the content is already stored there is nothing to upload: the file is COMPLETE and the url is empty
+type uploadTicket struct {
+	File           *file          `json:"file"`
+	URL            *string        `json:"url"`
+	Headers        []uploadHeader `json:"headers"`
+	ExpiresAt      time.Time      `json:"expiresAt"`
+	AlreadyPresent bool           `json:"alreadyPresent"`
+}
+
+// uploadHeader - a header the client must send with the upload
+type uploadHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// userUsage - the storage usage of a user with the quotas it is limited by
+type userUsage struct {
+	Email         string      `json:"email"`
+	ReservedBytes int64       `json:"reserved_bytes"`
+	StoredBytes   int64       `json:"stored_bytes"`
+	Files         int64       `json:"files"`
+	Quotas        []roleQuota `json:"quotas"`
+	SessionQuota  quota       `json:"session_quota"`
+}
+
+// roleQuota - the quota of the users uploading with a role
+type roleQuota struct {
+	Role        string `json:"role"`
+	MaxBytes    int64  `json:"max_bytes"`
+	MaxFiles    int64  `json:"max_files"`
+	MaxFileSize int64  `json:"max_file_size"`
+}
+
+// pageArgs - the relay pagination arguments of a connection query
+type pageArgs struct {
+	First int     `json:"first"`
+	After *string `json:"after,omitempty"`
+	Desc  bool    `json:"desc"`
+}
+
+// sessionFilter - the optional filters of the getSessions query
+type sessionFilter struct {
+	Status        []string   `json:"status,omitempty"`
+	StartedAfter  *time.Time `json:"startedAfter,omitempty"`
+	StartedBefore *time.Time `json:"startedBefore,omitempty"`
+	// archived (inactive) sessions are hidden unless asked for
+	IncludeArchived bool `json:"includeArchived,omitempty"`
+	// the metadata entries and tags the sessions must have
+	Labels labelFilter `json:"labels"`
+}
+
+// condition - the dynamodb filter expression for the filters that are not served by the index key
+func (f sessionFilter) condition() (expression.ConditionBuilder, bool) {
+	var conds []expression.ConditionBuilder
+	if len(f.Status) > 0 {
+		var others []expression.OperandBuilder
+		for _, status := range f.Status[1:] {
+			others = append(others, expression.Value(status))
+		}
+		conds = append(conds, expression.Name("status").In(expression.Value(f.Status[0]), others...))
+	}
+	if !f.IncludeArchived {
+		active := expression.Name("meta.meta__is_active")
+		conds = append(conds, active.AttributeNotExists().Or(active.Equal(expression.Value(true))))
+	}
+	conds = append(conds, f.Labels.conditions()...)
+	switch len(conds) {
+	case 0:
+		return expression.ConditionBuilder{}, false
+	case 1:
+		return conds[0], true
+	}
+	return conds[0].And(conds[1], conds[2:]...), true
+}
+
+type pageInfo struct {
+	HasNextPage     bool    `json:"hasNextPage"`
+	HasPreviousPage bool    `json:"hasPreviousPage"`
+	StartCursor     *string `json:"startCursor,omitempty"`
+	EndCursor       *string `json:"endCursor,omitempty"`
+}
+
+type sessionEdge struct {
+	Cursor string   `json:"cursor"`
+	Node   *session `json:"node"`
+}
+
+type sessionConnection struct {
+	Edges    []*sessionEdge `json:"edges"`
+	PageInfo pageInfo       `json:"pageInfo"`
 }
 
 var (
@@ -79,6 +482,7 @@ var (
 		Fields: graphql.Fields{
 			"meta__created_at": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
 			"meta__updated_at": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"meta__version":    &graphql.Field{Type: graphql.Int, Description: "Optimistic concurrency version; send it back when updating the record"},
 		},
 	})
 	userType = graphql.NewObject(graphql.ObjectConfig{
@@ -111,20 +515,452 @@ var (
 			"description":        &graphql.Field{Type: graphql.String},
 			"session_start_date": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
 			"session_end_date":   &graphql.Field{Type: graphql.DateTime},
-			"status":             &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
-			"meta":               &graphql.Field{Type: baseMetaType},
+			"status": &graphql.Field{
+				Type: graphql.NewNonNull(sessionStatusType),
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					if sess, ok := p.Source.(*session); ok {
+						return statusOf(sess), nil
+					}
+					return nil, nil
+				},
+			},
+			"type_policy": &graphql.Field{Type: typePolicyType, Description: "The file types allowed in the session on top of the global policy"},
+			"sanitize":    &graphql.Field{Type: sanitizeSettingsType, Description: "Whether uploaded images get their metadata stripped"},
+			"metadata": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(metadataEntryType))),
+				Description: "The key/value metadata of the session, sorted by key",
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					if sess, ok := p.Source.(*session); ok {
+						return metadataEntries(sess.Metadata), nil
+					}
+					return nil, nil
+				},
+			},
+			"tags": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					if sess, ok := p.Source.(*session); ok {
+						return tagsOf(sess.Tags), nil
+					}
+					return nil, nil
+				},
+			},
+			"meta": &graphql.Field{Type: baseMetaType},
+		},
+	})
+	typePolicyType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "TypePolicy",
+		Description: "Content types (exact or type/*) and file extensions allowed or denied in a session",
+		Fields: graphql.Fields{
+			"allow_types":      &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"deny_types":       &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"allow_extensions": &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"deny_extensions":  &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+		},
+	})
+	metadataEntryType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "MetadataEntry",
+		Description: "A key/value pair of the metadata of a session or a file",
+		Fields: graphql.Fields{
+			"key":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"value": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	metadataEntryInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "MetadataEntryInput",
+		Description: "A key/value pair of metadata; keys start with a letter and contain letters, digits, _ and -",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"key":   &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"value": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	sanitizeSettingsType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "SanitizeSettings",
+		Description: "The sanitization uploaded images of a session go through",
+		Fields: graphql.Fields{
+			"strip_metadata": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Description: "Whether exif (including gps), xmp, iptc and comments are stripped from jpeg and png images"},
+			"keep_original":  &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Description: "Whether the original upload is kept once sanitized"},
+		},
+	})
+	typePolicyInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "TypePolicyInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"allow_types":      &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"deny_types":       &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"allow_extensions": &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"deny_extensions":  &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
 		},
 	})
 	sessionInputType = graphql.NewInputObject(graphql.InputObjectConfig{
 		Name: "SessionInput",
 		Fields: graphql.InputObjectConfigFieldMap{
-			"id":                 &graphql.InputObjectFieldConfig{Type: graphql.String},
-			"email":              &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"id": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"email": &graphql.InputObjectFieldConfig{
+				Type:        graphql.String,
+				Description: "Deprecated and ignored: the owner of a session is always the authenticated user",
+			},
 			"name":               &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
 			"description":        &graphql.InputObjectFieldConfig{Type: graphql.String},
 			"session_start_date": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.DateTime)},
-			"session_end_date":   &graphql.InputObjectFieldConfig{Type: graphql.DateTime},
-			"status":             &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"session_end_date": &graphql.InputObjectFieldConfig{
+				Type:        graphql.DateTime,
+				Description: "Deprecated and ignored: the end date is set by the server when the session is submitted or closed",
+			},
+			"status": &graphql.InputObjectFieldConfig{
+				Type:        graphql.String,
+				Description: "Deprecated and ignored: the status only changes through the session lifecycle mutations",
+			},
+			"version": &graphql.InputObjectFieldConfig{
+				Type:        graphql.Int,
+				Description: "The meta__version the update is based on; required when id is set",
+			},
+		},
+	})
+)
+
+var (
+	pageInfoType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "PageInfo",
+		Description: "Relay pagination info of a connection",
+		Fields: graphql.Fields{
+			"hasNextPage":     &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"hasPreviousPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"startCursor":     &graphql.Field{Type: graphql.String},
+			"endCursor":       &graphql.Field{Type: graphql.String},
+		},
+	})
+	sessionEdgeType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "SessionEdge",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"node":   &graphql.Field{Type: graphql.NewNonNull(sessionType)},
+		},
+	})
+	sessionConnectionType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "SessionConnection",
+		Description: "A cursor paginated list of sessions",
+		Fields: graphql.Fields{
+			"edges":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(sessionEdgeType)))},
+			"pageInfo": &graphql.Field{Type: graphql.NewNonNull(pageInfoType)},
+		},
+	})
+	sessionOrderType = graphql.NewEnum(graphql.EnumConfig{
+		Name:        "SessionOrder",
+		Description: "Sort order of a session list on session_start_date",
+		Values: graphql.EnumValueConfigMap{
+			"START_DATE_ASC":  &graphql.EnumValueConfig{Value: "START_DATE_ASC"},
+			"START_DATE_DESC": &graphql.EnumValueConfig{Value: "START_DATE_DESC"},
+		},
+	})
+)
+
+var (
+	sessionStatusType = graphql.NewEnum(graphql.EnumConfig{
+		Name:        "SessionStatus",
+		Description: "The lifecycle status of a session; only OPEN and UPLOADING sessions accept uploads",
+		Values: graphql.EnumValueConfigMap{
+			statusOpen:       &graphql.EnumValueConfig{Value: statusOpen},
+			statusUploading:  &graphql.EnumValueConfig{Value: statusUploading},
+			statusSubmitted:  &graphql.EnumValueConfig{Value: statusSubmitted},
+			statusProcessing: &graphql.EnumValueConfig{Value: statusProcessing},
+			statusClosed:     &graphql.EnumValueConfig{Value: statusClosed},
+			statusArchived:   &graphql.EnumValueConfig{Value: statusArchived},
+		},
+	})
+	fileType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "File",
+		Description: "A file uploaded into a session",
+		Fields: graphql.Fields{
+			"id":           &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"session_id":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"email":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"content_type": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"size":         &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"status":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"checksum":     &graphql.Field{Type: fileChecksumType},
+			"sniffed_type": &graphql.Field{Type: graphql.String, Description: "The content type detected from the uploaded content"},
+			"type_mismatch": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Whether the detected content type differs from the declared one",
+			},
+			"scan": &graphql.Field{
+				Type:        graphql.NewNonNull(fileScanType),
+				Description: "The malware scan of the content; only CLEAN files can be downloaded",
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					if f, ok := p.Source.(*file); ok {
+						return scanOf(f), nil
+					}
+					return nil, nil
+				},
+			},
+			"thumbnailUrl": &graphql.Field{
+				Type:        graphql.String,
+				Description: "A short lived url to a thumbnail of an image at least size pixels wide or high where one was generated; null for other files",
+				Args: graphql.FieldConfigArgument{
+					"size": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: thumbnailSizes[0]},
+				},
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					f, ok := p.Source.(*file)
+					c := configFromContext(p.Context)
+					if !ok || c == nil {
+						return nil, nil
+					}
+					return thumbnailURL(f, p.Args["size"].(int), c.uploadsBucket(), c.s3Impl(), loggerFromContext(p.Context))
+				},
+			},
+			"version":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "The version of the file among the files of the session with the same name"},
+			"restored_from": &graphql.Field{Type: graphql.String, Description: "The id of the version this one restored"},
+			"sanitization":  &graphql.Field{Type: fileSanitizationType, Description: "The sanitization of the uploaded content; null if it was not sanitized"},
+			"metadata": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(metadataEntryType))),
+				Description: "The key/value metadata of the file, sorted by key",
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					if f, ok := p.Source.(*file); ok {
+						return metadataEntries(f.Metadata), nil
+					}
+					return nil, nil
+				},
+			},
+			"tags": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+				Resolve: func(p graphql.ResolveParams) (i interface{}, e error) {
+					if f, ok := p.Source.(*file); ok {
+						return tagsOf(f.Tags), nil
+					}
+					return nil, nil
+				},
+			},
+			"contributor": &graphql.Field{Type: contributorType},
+			"meta":        &graphql.Field{Type: baseMetaType},
+		},
+	})
+	checksumAlgorithmType = graphql.NewEnum(graphql.EnumConfig{
+		Name:        "ChecksumAlgorithm",
+		Description: "The algorithm of a file checksum",
+		Values: graphql.EnumValueConfigMap{
+			checksumSHA256: &graphql.EnumValueConfig{Value: checksumSHA256},
+			checksumCRC32C: &graphql.EnumValueConfig{Value: checksumCRC32C},
+		},
+	})
+	fileChecksumType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "FileChecksum",
+		Description: "The base64 encoded checksum of a file content",
+		Fields: graphql.Fields{
+			"algorithm":   &graphql.Field{Type: graphql.NewNonNull(checksumAlgorithmType)},
+			"value":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"verified_at": &graphql.Field{Type: graphql.DateTime, Description: "When the stored content last matched the checksum"},
+		},
+	})
+	scanStatusType = graphql.NewEnum(graphql.EnumConfig{
+		Name:        "ScanStatus",
+		Description: "The malware scan status of a file",
+		Values: graphql.EnumValueConfigMap{
+			scanStatusPending:  &graphql.EnumValueConfig{Value: scanStatusPending},
+			scanStatusClean:    &graphql.EnumValueConfig{Value: scanStatusClean},
+			scanStatusInfected: &graphql.EnumValueConfig{Value: scanStatusInfected},
+			scanStatusError:    &graphql.EnumValueConfig{Value: scanStatusError},
+			scanStatusTooLarge: &graphql.EnumValueConfig{Value: scanStatusTooLarge},
+		},
+	})
+	fileScanType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "FileScan",
+		Description: "The malware scan of a file content",
+		Fields: graphql.Fields{
+			"status":     &graphql.Field{Type: graphql.NewNonNull(scanStatusType)},
+			"signature":  &graphql.Field{Type: graphql.String, Description: "The malware found in an INFECTED file"},
+			"message":    &graphql.Field{Type: graphql.String, Description: "Why the scan ended in an ERROR"},
+			"scanned_at": &graphql.Field{Type: graphql.DateTime},
+		},
+	})
+	fileSanitizationType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "FileSanitization",
+		Description: "The sanitization of an uploaded content",
+		Fields: graphql.Fields{
+			"method":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"removed":       &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))), Description: "The metadata blocks removed: exif, xmp, iptc, comment, text or app1"},
+			"orientation":   &graphql.Field{Type: graphql.Int, Description: "The exif orientation (2 to 8) kept in the sanitized jpeg; null when the image is upright"},
+			"original_size": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"original_kept": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"skipped":       &graphql.Field{Type: graphql.String, Description: "Why the content was left as uploaded"},
+			"sanitized_at":  &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		},
+	})
+	fileVerificationType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "FileVerification",
+		Description: "The result of recomputing the checksum of a stored file",
+		Fields: graphql.Fields{
+			"file_id":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"algorithm":   &graphql.Field{Type: graphql.NewNonNull(checksumAlgorithmType)},
+			"expected":    &graphql.Field{Type: graphql.String, Description: "The recorded checksum; null if the file had none"},
+			"actual":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"match":       &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"verified_at": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		},
+	})
+	contributorType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Contributor",
+		Description: "The external person who uploaded a file through an upload link",
+		Fields: graphql.Fields{
+			"name":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"email":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"link_id": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	uploadLinkType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "UploadLink",
+		Description: "A public link external contributors can upload files into a session with",
+		Fields: graphql.Fields{
+			"id":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"token":      &graphql.Field{Type: graphql.String, Description: "The opaque link token; only returned when the link is created"},
+			"session_id": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"expires_at": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"max_files":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"max_bytes":  &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"file_count": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"byte_count": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"has_password": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					link, ok := p.Source.(*uploadLink)
+					return ok && link.PwdHash != nil, nil
+				},
+			},
+		},
+	})
+	shareLinkType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "ShareLink",
+		Description: "A public link to download a whole session or some of its files",
+		Fields: graphql.Fields{
+			"id":             &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"token":          &graphql.Field{Type: graphql.String, Description: "The opaque link token; only returned when the link is created"},
+			"session_id":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"file_ids":       &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), Description: "The shared files; empty when the whole session is shared"},
+			"expires_at":     &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"max_downloads":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"download_count": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"has_password": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					link, ok := p.Source.(*shareLink)
+					return ok && link.PwdHash != nil, nil
+				},
+			},
+		},
+	})
+	sharedFileType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "SharedFile",
+		Description: "A file shared through a share link and a short lived presigned url to download it",
+		Fields: graphql.Fields{
+			"id":           &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"content_type": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"size":         &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"url":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	sharedContentsType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "SharedContents",
+		Description: "The files a share link gives access to",
+		Fields: graphql.Fields{
+			"files":              &graphql.Field{Type: graphql.NewList(sharedFileType)},
+			"expiresAt":          &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"downloadsRemaining": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+	archiveJobType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "ArchiveJob",
+		Description: "A background job zipping every uploaded file of a session; poll it until the url is set",
+		Fields: graphql.Fields{
+			"id":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"session_id": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"status": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.String),
+				Description: "PENDING, RUNNING, COMPLETE or FAILED",
+			},
+			"file_count": &graphql.Field{Type: graphql.Int},
+			"size":       &graphql.Field{Type: graphql.Float},
+			"error":      &graphql.Field{Type: graphql.String},
+			"url":        &graphql.Field{Type: graphql.String, Description: "A presigned url to download the zip; set once the job is COMPLETE"},
+			"meta":       &graphql.Field{Type: baseMetaType},
+		},
+	})
+	uploadTicketType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "UploadTicket",
+		Description: "The pending file record and the presigned url to PUT the file content to",
+		Fields: graphql.Fields{
+			"file":           &graphql.Field{Type: graphql.NewNonNull(fileType)},
+			"url":            &graphql.Field{Type: graphql.String, Description: "The url to PUT the content to; null when the content is already present"},
+			"alreadyPresent": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Description: "The content is already stored and the transfer can be skipped"},
+			"headers":        &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(uploadHeaderType)), Description: "The headers to send with the PUT"},
+			"expiresAt":      &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		},
+	})
+	uploadHeaderType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "UploadHeader",
+		Description: "A header signed into the upload url",
+		Fields: graphql.Fields{
+			"name":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"value": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	quotaType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Quota",
+		Description: "Storage limits; a limit of 0 is unlimited",
+		Fields: graphql.Fields{
+			"max_bytes":     &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"max_files":     &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"max_file_size": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+		},
+	})
+	roleQuotaType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "RoleQuota",
+		Description: "The limits of the total storage of a user uploading with the role; a limit of 0 is unlimited",
+		Fields: graphql.Fields{
+			"role":          &graphql.Field{Type: graphql.NewNonNull(sessionRoleType)},
+			"max_bytes":     &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"max_files":     &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"max_file_size": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+		},
+	})
+	usageType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Usage",
+		Description: "The storage used by a user; uploads through upload links count against the session owner",
+		Fields: graphql.Fields{
+			"email":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"reserved_bytes": &graphql.Field{Type: graphql.NewNonNull(graphql.Float), Description: "The bytes of every upload, including the ones still pending"},
+			"stored_bytes":   &graphql.Field{Type: graphql.NewNonNull(graphql.Float), Description: "The bytes of the completed uploads"},
+			"files":          &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"quotas":         &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(roleQuotaType))},
+			"session_quota":  &graphql.Field{Type: graphql.NewNonNull(quotaType), Description: "The limits of every session"},
+		},
+	})
+	sessionRoleType = graphql.NewEnum(graphql.EnumConfig{
+		Name:        "SessionRole",
+		Description: "The role of a user on a session: VIEWER can read, EDITOR can also upload and submit, OWNER can do anything",
+		Values: graphql.EnumValueConfigMap{
+			roleOwner:  &graphql.EnumValueConfig{Value: roleOwner},
+			roleEditor: &graphql.EnumValueConfig{Value: roleEditor},
+			roleViewer: &graphql.EnumValueConfig{Value: roleViewer},
+		},
+	})
+	memberType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Collaborator",
+		Description: "A user a session is shared with",
+		Fields: graphql.Fields{
+			"session_id": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"email":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"role":       &graphql.Field{Type: graphql.NewNonNull(sessionRoleType)},
+			"invited_by": &graphql.Field{Type: graphql.String},
+			"meta":       &graphql.Field{Type: baseMetaType},
+		},
+	})
+	sharedSessionType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "SharedSession",
+		Description: "A session shared with the user and the role the user holds on it",
+		Fields: graphql.Fields{
+			"role":    &graphql.Field{Type: graphql.NewNonNull(sessionRoleType)},
+			"session": &graphql.Field{Type: graphql.NewNonNull(sessionType)},
 		},
 	})
 )
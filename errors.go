@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// errorCode - the machine readable error code surfaced as `extensions.code` on graphql errors
+type errorCode string
+
+const (
+	codeUnauthenticated errorCode = "UNAUTHENTICATED"
+	codeForbidden       errorCode = "FORBIDDEN"
+	codeNotFound        errorCode = "NOT_FOUND"
+	codeValidation      errorCode = "VALIDATION_FAILED"
+	codeConflict        errorCode = "CONFLICT"
+	codeInternal        errorCode = "INTERNAL"
+	errorCodeKey                  = "code"
+)
+
+// errorStatus - the http status returned for each error code
+var errorStatus = map[errorCode]int{
+	codeUnauthenticated: http.StatusUnauthorized,
+	codeForbidden:       http.StatusForbidden,
+	codeNotFound:        http.StatusNotFound,
+	codeValidation:      http.StatusBadRequest,
+	codeConflict:        http.StatusConflict,
+	codeInternal:        http.StatusInternalServerError,
+}
+
+// serviceError - a typed error returned by the service layer.
+//	* implements gqlerrors.ExtendedError so graphql-go copies the code (and any extra extensions) onto the formatted error
+//	* the cause is kept for logging only; it is never sent to the client
+type serviceError struct {
+	code       errorCode
+	message    string
+	cause      error
+	extensions map[string]interface{}
+}
+
+func (e *serviceError) Error() string {
+	return e.message
+}
+
+func (e *serviceError) Unwrap() error {
+	return e.cause
+}
+
+// Extensions() - the graphql error extensions; always includes the code
+func (e *serviceError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{errorCodeKey: e.code}
+	for k, v := range e.extensions {
+		ext[k] = v
+	}
+	return ext
+}
+
+// withExtension() - attach an extra extension field to the error
+func (e *serviceError) withExtension(key string, val interface{}) *serviceError {
+	if e.extensions == nil {
+		e.extensions = map[string]interface{}{}
+	}
+	e.extensions[key] = val
+	return e
+}
+
+func errUnauthenticated(msg string) *serviceError {
+	return &serviceError{code: codeUnauthenticated, message: msg}
+}
+
+func errForbidden(msg string) *serviceError {
+	return &serviceError{code: codeForbidden, message: msg}
+}
+
+func errNotFound(msg string) *serviceError {
+	return &serviceError{code: codeNotFound, message: msg}
+}
+
+func errValidation(msg string) *serviceError {
+	return &serviceError{code: codeValidation, message: msg}
+}
+
+func errConflict(msg string) *serviceError {
+	return &serviceError{code: codeConflict, message: msg}
+}
+
+// errVersionConflict - an optimistic concurrency conflict; carries the current server version as `extensions.currentVersion`
+func errVersionConflict(current int64) *serviceError {
+	return errConflict("the record was changed by another request. Merge with the current version and try again").
+		withExtension("currentVersion", current)
+}
+
+// errInternal - wrap an unexpected failure (dynamodb, s3, marshalling) with a message that is safe to return
+func errInternal(msg string, cause error) *serviceError {
+	return &serviceError{code: codeInternal, message: msg, cause: cause}
+}
+
+// isConditionalCheckFailed - check whether the error is dynamodb rejecting a write because its condition expression failed
+func isConditionalCheckFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+// errorCodeOf - the code of a formatted graphql error.
+//	* errors raised by graphql-go itself carry no code: those without a path failed parsing/validation of the query,
+//	those with a path are untyped resolver errors and treated as internal
+func errorCodeOf(err gqlerrors.FormattedError) errorCode {
+	if code, ok := err.Extensions[errorCodeKey].(errorCode); ok {
+		return code
+	}
+	if code, ok := err.Extensions[errorCodeKey].(string); ok {
+		return errorCode(code)
+	}
+	if len(err.Path) == 0 {
+		return codeValidation
+	}
+	return codeInternal
+}
+
+// withErrorCodes - make sure every formatted error carries an `extensions.code`
+func withErrorCodes(errs []gqlerrors.FormattedError) []gqlerrors.FormattedError {
+	for i, err := range errs {
+		if _, ok := err.Extensions[errorCodeKey]; ok {
+			continue
+		}
+		if err.Extensions == nil {
+			errs[i].Extensions = map[string]interface{}{}
+		}
+		errs[i].Extensions[errorCodeKey] = errorCodeOf(err)
+	}
+	return errs
+}
+
+// statusForErrors - pick the http status for a set of graphql errors.
+//	* an internal error always wins so outages are never reported as client errors
+//	* otherwise the first error's code decides
+func statusForErrors(errs []gqlerrors.FormattedError) int {
+	if len(errs) == 0 {
+		return http.StatusOK
+	}
+	for _, err := range errs {
+		if errorCodeOf(err) == codeInternal {
+			return http.StatusInternalServerError
+		}
+	}
+	if status, ok := errorStatus[errorCodeOf(errs[0])]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	"github.com/satori/go.uuid"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+const (
+	sessionsKeyPrefix = "sessions/"
+	uploadURLExpiry   = 15 * time.Minute
+	downloadURLExpiry = 15 * time.Minute
+	// the most keys a single s3 DeleteObjects / dynamodb BatchWriteItem request accepts
+	s3DeleteBatchSize    = 1000
+	dynamoWriteBatchSize = 25
+	// how often a batch of unprocessed dynamodb writes is resent before giving up
+	maxBatchWriteAttempts = 5
+)
+
+// sessionPrefix - the s3 prefix every object of a session is stored under
+func sessionPrefix(sessionID string) string {
+	return sessionsKeyPrefix + sessionID + "/"
+}
+
+// uploadKey - the s3 key of an uploaded file: sessions/{sessionId}/{fileId}/{name}
+func uploadKey(sessionID, fileID, name string) string {
+	return sessionPrefix(sessionID) + fileID + "/" + name
+}
+
+// cleanFileName - reduce a client supplied file name to a single safe path segment
+func cleanFileName(name string) string {
+	name = strings.TrimSpace(strings.Replace(name, "\\", "/", -1))
+	name = path.Base(name)
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// requestUploadURL - create a pending file record in the session and presign the PUT the client uploads the file with.
+//	* the session must still accept uploads (OPEN or UPLOADING)
+//	* the presigned request is bound to the declared content type and size
+//	* the first upload moves an OPEN session to UPLOADING
+//	* the contributor is set when the upload comes through an upload link
+//	* a declared checksum is signed into the request as an s3 checksum header, so s3 refuses content that does not
+//	match it
+//	* content with a SHA256 checksum is stored once under blobs/ and shared between the files charged to the same
+//	user; when that user already stored it the file is COMPLETE right away and no url is issued. The declared
+//	checksum of such a file is not marked verified, since no content was uploaded for it
+//	* the declared content type and the extension of the name must be allowed by the global and the session file
+//	type policies; the content itself is sniffed once it is uploaded
+//	* a file with the name of one already in the session is added as its newest version; the previous versions are
+//	kept until more than maxVersions of them are complete; the new version starts with the metadata and tags of the
+//	newest one
+//	* the file is counted against the storage quotas of the session and of the user with the given role, or of the
+//	session owner for uploads through an upload link; the size is signed into the url as its Content-Length, so
+//	the upload cannot exceed what the quotas were checked for
+func requestUploadURL(sess *session, email, name, contentType string, size int64, checksum *fileChecksum, contrib *contributor, role string, quotas *quotaConfig, policy *typePolicy, maxVersions int, store storeNames, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) (*uploadTicket, error) {
+	logger.WithFields(LOGGER.Fields{
+		"session_id":   *sess.ID,
+		"name":         name,
+		"content_type": contentType,
+		"size":         size,
+	}).Info("requestUploadURL() - create a pending file record and presign its upload")
+	status := statusOf(sess)
+	if !acceptsUploads(status) {
+		return nil, errConflict("the session is "+status+" and no longer accepts uploads").
+			withExtension("status", status)
+	}
+	name = cleanFileName(name)
+	if name == "" {
+		return nil, errValidation("a file name is required")
+	}
+	if size <= 0 {
+		return nil, errValidation("the file size must be greater than 0")
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if err := checkFileType(name, contentType, policy, sess); err != nil {
+		return nil, err
+	}
+	files, err := findFiles(*sess.ID, store.files, dbAPI, logger)
+	if err != nil {
+		return nil, err
+	}
+	versions := sameFile(files, name)
+	// build the pending file record
+	id, _ := uuid.NewV4()
+	now := time.Now()
+	active := true
+	f := &file{
+		ID:          id.String(),
+		SessionID:   *sess.ID,
+		Email:       email,
+		Name:        name,
+		ContentType: contentType,
+		Size:        size,
+		Key:         uploadKey(*sess.ID, id.String(), name),
+		Status:      fileStatusPending,
+		Checksum:    checksum,
+		ChargedTo:   email,
+		Scan:        &fileScan{Status: scanStatusPending},
+		Contributor: contrib,
+		Version:     nextVersion(versions),
+		Meta: &baseMeta{
+			MetaCreatedAt: &now,
+			MetaUpdatedAt: &now,
+			MetaIsActive:  &active,
+		},
+	}
+	if contrib != nil {
+		f.ChargedTo = sess.Email
+	}
+	if len(versions) > 0 {
+		f.Metadata, f.Tags = versions[0].Metadata, versions[0].Tags
+	}
+	if err := reserveUpload(f, role, quotas, store.usage, dbAPI, logger); err != nil {
+		return nil, err
+	}
+	present := false
+	// content shared through a blob is stored as uploaded, so sessions that strip metadata do not deduplicate
+	if hash := blobHash(checksum); hash != "" && (sess.Sanitize == nil || !sess.Sanitize.StripMetadata) {
+		hash = blobID(f.ChargedTo, hash)
+		b, err := acquireBlob(hash, size, store.blobs, dbAPI, logger)
+		if err != nil {
+			releaseUpload(f, store.usage, dbAPI, logger)
+			return nil, err
+		}
+		f.Key = b.Key
+		f.BlobHash = &hash
+		if b.Status == fileStatusComplete && b.SniffedType != nil {
+			// the content was sniffed when it was first uploaded; it must be allowed in this session as well
+			if reason := sniffedRejection(name, *b.SniffedType, policy, sess.TypePolicy); reason != "" {
+				if err := releaseBlob(hash, store.bucket, store.blobs, dbAPI, s3API, logger); err != nil {
+					logger.WithFields(LOGGER.Fields{
+						"hash":  hash,
+						"error": err.Error(),
+					}).Warn("requestUploadURL() - unable to release the blob of the rejected file")
+				}
+				releaseUpload(f, store.usage, dbAPI, logger)
+				return nil, errValidation(reason).withExtension("contentType", *b.SniffedType)
+			}
+			f.SniffedType = b.SniffedType
+			f.TypeMismatch = !typesMatch(contentType, *b.SniffedType)
+		}
+		if b.Status == fileStatusComplete {
+			present = true
+			f.Status = fileStatusComplete
+			f.ETag = b.ETag
+			if b.Scan != nil {
+				f.Scan = b.Scan
+				f.Thumbnails = b.Thumbnails
+			}
+		}
+	}
+	if !present {
+		f.PendingUntil = aws.String(formatKeyDate(now.Add(uploadURLExpiry)))
+	}
+	fileMap, err := dynamodbattribute.MarshalMap(f)
+	if err != nil {
+		return nil, errInternal("unable to create the file record", err)
+	}
+	if err := putNewItem(fileMap, "id", store.files, dbAPI, logger); err != nil {
+		if f.BlobHash != nil {
+			if err := releaseBlob(*f.BlobHash, store.bucket, store.blobs, dbAPI, s3API, logger); err != nil {
+				logger.WithFields(LOGGER.Fields{
+					"hash":  *f.BlobHash,
+					"error": err.Error(),
+				}).Warn("requestUploadURL() - unable to release the blob of the unsaved file")
+			}
+		}
+		f.Status = fileStatusPending
+		releaseUpload(f, store.usage, dbAPI, logger)
+		return nil, errInternal("unable to create the file record", err)
+	}
+	if status == statusOpen {
+		if _, err := transitionSession(sess, statusUploading, store.sessions, dbAPI, logger); err != nil {
+			// a concurrent upload may have moved the session already; the upload itself is still valid
+			logger.WithFields(LOGGER.Fields{
+				"session_id": *sess.ID,
+				"error":      err.Error(),
+			}).Warn("requestUploadURL() - unable to move the session to UPLOADING")
+		}
+	}
+	if present {
+		commitUpload(f, store.usage, dbAPI, logger)
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"hash":    *f.BlobHash,
+		}).Info("requestUploadURL() - the content is already stored; skipping the upload")
+		if err := pruneVersions(f, maxVersions, store.bucket, store.files, store.blobs, store.usage, dbAPI, s3API, logger); err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"file_id": f.ID,
+				"error":   err.Error(),
+			}).Warn("requestUploadURL() - unable to delete the versions beyond the version limit")
+		}
+		return &uploadTicket{File: f, Headers: []uploadHeader{}, ExpiresAt: now, AlreadyPresent: true}, nil
+	}
+	// presign the upload
+	req := s3API.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(store.bucket),
+		Key:           aws.String(f.Key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	})
+	if checksum != nil {
+		req.HTTPRequest.Header.Set(checksumHeaders[checksum.Algorithm], checksum.Value)
+	}
+	url, signed, err := req.PresignRequest(uploadURLExpiry)
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("requestUploadURL() - an error occurred while trying to presign the upload")
+		return nil, errInternal("unable to create the upload url", err)
+	}
+	headers := []uploadHeader{}
+	for name := range signed {
+		headers = append(headers, uploadHeader{Name: name, Value: signed.Get(name)})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return &uploadTicket{File: f, URL: &url, Headers: headers, ExpiresAt: now.Add(uploadURLExpiry)}, nil
+}
+
+// findFileByID - find a file record by its id
+func findFileByID(id, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*file, error) {
+	logger.WithFields(LOGGER.Fields{
+		"id":               id,
+		"files_table_name": filesTableName,
+	}).Info("findFileByID() - find the file record by the id primary key")
+	output, err := dbAPI.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(filesTableName),
+		Key:       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Error("findFileByID() - an error occurred while trying to find the file record")
+		return nil, errInternal("unable to look up the file", err)
+	}
+	if len(output.Item) == 0 {
+		return nil, errNotFound("no file exists with the given id")
+	}
+	var f = new(file)
+	if err = dynamodbattribute.UnmarshalMap(output.Item, &f); err != nil {
+		return nil, errInternal("unable to read the file", err)
+	}
+	return f, nil
+}
+
+// findFiles - find all file records of a session through the session_id index, following LastEvaluatedKey
+func findFiles(sessionID, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) ([]*file, error) {
+	logger.WithFields(LOGGER.Fields{
+		"session_id":       sessionID,
+		"files_table_name": filesTableName,
+	}).Info("findFiles() - find all file records of the session")
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("session_id").Equal(expression.Value(sessionID))).
+		Build()
+	if err != nil {
+		return nil, errInternal("unable to list the files", err)
+	}
+	files := []*file{}
+	var startKey map[string]dynamodb.AttributeValue
+	for {
+		output, err := dbAPI.QueryRequest(&dynamodb.QueryInput{
+			TableName:                 aws.String(filesTableName),
+			IndexName:                 aws.String(filesBySessionIndex),
+			KeyConditionExpression:    expr.KeyCondition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			ExclusiveStartKey:         startKey,
+		}).Send()
+		if err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"session_id": sessionID,
+				"error":      err.Error(),
+			}).Error("findFiles() - an error occurred while trying to query the file session index")
+			return nil, errInternal("unable to list the files", err)
+		}
+		for _, item := range output.Items {
+			var f = new(file)
+			if err := dynamodbattribute.UnmarshalMap(item, &f); err == nil {
+				files = append(files, f)
+			}
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = output.LastEvaluatedKey
+	}
+	return files, nil
+}
+
+// downloadURL - presign a GET of the file content that downloads under the original file name
+func downloadURL(f *file, bucketName string, s3API s3iface.S3API, logger *LOGGER.Entry) (*string, error) {
+	logger.WithFields(LOGGER.Fields{
+		"file_id": f.ID,
+	}).Info("downloadURL() - presign the download of the file")
+	url, err := s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(f.Key),
+		ResponseContentDisposition: aws.String(`attachment; filename="` + strings.Replace(f.Name, `"`, "", -1) + `"`),
+	}).Presign(downloadURLExpiry)
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("downloadURL() - an error occurred while trying to presign the download")
+		return nil, errInternal("unable to create the download url", err)
+	}
+	return &url, nil
+}
+
+// deleteFile - delete a file record and its stored content.
+//	* the caller must have authorized the user as an editor of the session
+//	* content shared with other files through a blob is only deleted with the last file referencing it
+//	* the record goes first: if releasing the content fails the blob keeps a reference too many, which only delays
+//	its cleanup, where the other order could delete content another file still references when the delete is retried
+func deleteFile(f *file, bucketName, filesTableName, blobsTableName, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) error {
+	logger.WithFields(LOGGER.Fields{
+		"file_id":    f.ID,
+		"session_id": f.SessionID,
+	}).Info("deleteFile() - delete the file and its stored content")
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("id").AttributeExists()).
+		Build()
+	if err != nil {
+		return errInternal("unable to delete the file", err)
+	}
+	_, err = dbAPI.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		TableName:                aws.String(filesTableName),
+		Key:                      map[string]dynamodb.AttributeValue{"id": {S: aws.String(f.ID)}},
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return errNotFound("no file exists with the given id")
+		}
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("deleteFile() - an error occurred while trying to delete the file record")
+		return errInternal("unable to delete the file", err)
+	}
+	releaseUpload(f, usageTableName, dbAPI, logger)
+	return deleteFileContent(f, bucketName, blobsTableName, dbAPI, s3API, logger)
+}
+
+// deleteFileContent - delete the stored content of a deleted file record, or its reference to a shared blob
+func deleteFileContent(f *file, bucketName, blobsTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) error {
+	if f.BlobHash != nil {
+		return releaseBlob(*f.BlobHash, bucketName, blobsTableName, dbAPI, s3API, logger)
+	}
+	_, err := s3API.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(f.Key),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("deleteFileContent() - an error occurred while trying to delete the stored file")
+		return errInternal("unable to delete the stored file", err)
+	}
+	if err := deleteOriginal(f, bucketName, s3API, logger); err != nil {
+		return err
+	}
+	if len(f.Thumbnails) > 0 {
+		if _, err := deleteObjects(thumbnailsPrefix(f.Key), bucketName, s3API, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteObjects - delete every s3 object under the prefix, one listed page (at most 1000 keys) at a time.
+//	* deleting a key that is already gone is not an error, so a partially completed run can be repeated
+func deleteObjects(prefix, bucketName string, s3API s3iface.S3API, logger *LOGGER.Entry) (int, error) {
+	logger.WithFields(LOGGER.Fields{
+		"prefix": prefix,
+	}).Info("deleteObjects() - delete every object under the prefix")
+	deleted := 0
+	var token *string
+	for {
+		page, err := s3API.ListObjectsV2Request(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucketName),
+			Prefix:            aws.String(prefix),
+			ContinuationToken: token,
+			MaxKeys:           aws.Int64(s3DeleteBatchSize),
+		}).Send()
+		if err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"prefix": prefix,
+				"error":  err.Error(),
+			}).Error("deleteObjects() - an error occurred while trying to list the objects")
+			return deleted, errInternal("unable to list the stored files", err)
+		}
+		if len(page.Contents) > 0 {
+			objects := make([]s3.ObjectIdentifier, 0, len(page.Contents))
+			for _, obj := range page.Contents {
+				objects = append(objects, s3.ObjectIdentifier{Key: obj.Key})
+			}
+			output, err := s3API.DeleteObjectsRequest(&s3.DeleteObjectsInput{
+				Bucket: aws.String(bucketName),
+				Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			}).Send()
+			if err != nil {
+				logger.WithFields(LOGGER.Fields{
+					"prefix": prefix,
+					"error":  err.Error(),
+				}).Error("deleteObjects() - an error occurred while trying to delete the objects")
+				return deleted, errInternal("unable to delete the stored files", err)
+			}
+			if len(output.Errors) > 0 {
+				logger.WithFields(LOGGER.Fields{
+					"prefix": prefix,
+					"errors": output.Errors,
+				}).Error("deleteObjects() - some objects could not be deleted")
+				return deleted, errInternal("unable to delete the stored files", nil)
+			}
+			deleted += len(objects)
+		}
+		if page.IsTruncated == nil || !*page.IsTruncated {
+			return deleted, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// deleteFileRecords - delete every file record of a session in batches of 25, resending any unprocessed writes.
+//	* the storage usage and the references to shared blobs of the deleted records are released after each batch
+func deleteFileRecords(sessionID, bucketName, filesTableName, blobsTableName, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) (int, error) {
+	logger.WithFields(LOGGER.Fields{
+		"session_id":       sessionID,
+		"files_table_name": filesTableName,
+	}).Info("deleteFileRecords() - delete every file record of the session")
+	files, err := findFiles(sessionID, filesTableName, dbAPI, logger)
+	if err != nil {
+		return 0, err
+	}
+	for start := 0; start < len(files); start += dynamoWriteBatchSize {
+		end := start + dynamoWriteBatchSize
+		if end > len(files) {
+			end = len(files)
+		}
+		writes := make([]dynamodb.WriteRequest, 0, end-start)
+		for _, f := range files[start:end] {
+			writes = append(writes, dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: map[string]dynamodb.AttributeValue{"id": {S: aws.String(f.ID)}}},
+			})
+		}
+		if err := batchWrite(map[string][]dynamodb.WriteRequest{filesTableName: writes}, dbAPI, logger); err != nil {
+			return start, err
+		}
+		for _, f := range files[start:end] {
+			releaseUpload(f, usageTableName, dbAPI, logger)
+			if f.BlobHash == nil {
+				continue
+			}
+			if err := releaseBlob(*f.BlobHash, bucketName, blobsTableName, dbAPI, s3API, logger); err != nil {
+				return end, err
+			}
+		}
+	}
+	return len(files), nil
+}
+
+// batchWrite - send a BatchWriteItem request, resending the unprocessed items with a growing delay
+func batchWrite(items map[string][]dynamodb.WriteRequest, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	for attempt := 0; len(items) > 0; attempt++ {
+		if attempt == maxBatchWriteAttempts {
+			return errInternal("unable to delete the records", nil)
+		}
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt*attempt) * 50 * time.Millisecond)
+		}
+		output, err := dbAPI.BatchWriteItemRequest(&dynamodb.BatchWriteItemInput{RequestItems: items}).Send()
+		if err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"error": err.Error(),
+			}).Error("batchWrite() - an error occurred while trying to write the batch")
+			return errInternal("unable to delete the records", err)
+		}
+		items = output.UnprocessedItems
+	}
+	return nil
+}
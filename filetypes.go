@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+const (
+	// the most bytes the content type is sniffed from; the same as http.DetectContentType
+	sniffLength    = 512
+	unknownType    = "application/octet-stream"
+	executableType = "application/x-executable"
+)
+
+// typePolicy - the content types and file extensions allowed in a session.
+//	* types match exactly or by a `type/*` wildcard; extensions are compared without the dot, case insensitively
+//	* a deny rule always wins; a non empty allow list only lets its own entries through
+//	* the global policy (the FILE_TYPE_POLICY env variable) applies to every session on top of the session's own
+type typePolicy struct {
+	AllowTypes      []string `json:"allow_types,omitempty"`
+	DenyTypes       []string `json:"deny_types,omitempty"`
+	AllowExtensions []string `json:"allow_extensions,omitempty"`
+	DenyExtensions  []string `json:"deny_extensions,omitempty"`
+}
+
+// parseTypePolicy - read the global type policy; no configuration allows every type
+func parseTypePolicy(raw string) (*typePolicy, error) {
+	p := &typePolicy{}
+	if raw == "" {
+		return p, nil
+	}
+	if err := json.Unmarshal([]byte(raw), p); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", fileTypePolicyKey, err.Error())
+	}
+	return p.normalized(), nil
+}
+
+// normalized - the policy with lower case media types and extensions without their dot
+func (p *typePolicy) normalized() *typePolicy {
+	clean := func(values []string, fn func(string) string) []string {
+		out := []string{}
+		for _, v := range values {
+			if v = fn(v); v != "" {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+	return &typePolicy{
+		AllowTypes:      clean(p.AllowTypes, mediaType),
+		DenyTypes:       clean(p.DenyTypes, mediaType),
+		AllowExtensions: clean(p.AllowExtensions, extensionOf),
+		DenyExtensions:  clean(p.DenyExtensions, extensionOf),
+	}
+}
+
+// mediaType - the lower case media type without its parameters
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return t
+}
+
+// extensionOf - the lower case extension of a file name without the dot; a bare extension is returned as is
+func extensionOf(name string) string {
+	ext := path.Ext(name)
+	if ext == "" && !strings.Contains(name, "/") {
+		ext = name
+	}
+	return strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// matchesType - whether the media type matches one of the patterns
+func matchesType(t string, patterns []string) bool {
+	for _, p := range patterns {
+		if p == t || p == "*/*" || (strings.HasSuffix(p, "/*") && strings.HasPrefix(t, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesExtension - whether the extension is one of the extensions
+func matchesExtension(ext string, extensions []string) bool {
+	for _, e := range extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// rejects - the reason the policy does not allow the content type or the extension; empty if it allows both
+func (p *typePolicy) rejects(contentType, ext string) string {
+	if p == nil {
+		return ""
+	}
+	t := mediaType(contentType)
+	switch {
+	case matchesType(t, p.DenyTypes):
+		return "files of type " + t + " are not allowed"
+	case len(p.AllowTypes) > 0 && !matchesType(t, p.AllowTypes):
+		return "files of type " + t + " are not allowed"
+	case ext != "" && matchesExtension(ext, p.DenyExtensions):
+		return "." + ext + " files are not allowed"
+	case len(p.AllowExtensions) > 0 && !matchesExtension(ext, p.AllowExtensions):
+		return "." + ext + " files are not allowed"
+	}
+	return ""
+}
+
+// checkFileType - verify the declared type and the extension of a file are allowed by the global and the session
+// policies
+func checkFileType(name, contentType string, global *typePolicy, sess *session) error {
+	ext := extensionOf(name)
+	for _, p := range []*typePolicy{global, sess.TypePolicy} {
+		if reason := p.rejects(contentType, ext); reason != "" {
+			return errValidation(reason).withExtension("contentType", mediaType(contentType))
+		}
+	}
+	return nil
+}
+
+// sniffedRejection - the reason the policies do not allow the sniffed content of a file; empty if they all do.
+//	* content that cannot be recognized was already checked by its declared type when the upload was requested
+func sniffedRejection(name, sniffed string, policies ...*typePolicy) string {
+	if sniffed == "" || sniffed == unknownType {
+		return ""
+	}
+	ext := extensionOf(name)
+	for _, p := range policies {
+		if reason := p.rejects(sniffed, ext); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// sniffContentType - the content type of the first bytes of a file.
+//	* executables, which http.DetectContentType does not know, are recognized by their magic numbers first
+func sniffContentType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return executableType
+	case bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-shellscript"
+	}
+	return mediaType(http.DetectContentType(head))
+}
+
+// zipContainers - declared types whose content sniffs as a zip archive
+var zipContainers = []string{
+	"application/vnd.openxmlformats-officedocument.",
+	"application/vnd.oasis.opendocument.",
+	"application/epub+zip",
+	"application/java-archive",
+	"application/vnd.android.package-archive",
+	"application/x-zip-compressed",
+}
+
+// typesMatch - whether the sniffed content is consistent with the declared type.
+//	* content that cannot be recognized matches anything; sniffing only catches what it can identify
+//	* plain text matches every textual type and zip matches the formats built on it
+func typesMatch(declared, sniffed string) bool {
+	declared, sniffed = mediaType(declared), mediaType(sniffed)
+	switch {
+	case sniffed == unknownType || sniffed == declared:
+		return true
+	case sniffed == "text/plain":
+		return strings.HasPrefix(declared, "text/") || strings.HasSuffix(declared, "+json") || strings.HasSuffix(declared, "+xml") ||
+			declared == "application/json" || declared == "application/xml" || declared == "application/javascript"
+	case sniffed == "text/xml":
+		return declared == "application/xml" || strings.HasSuffix(declared, "+xml")
+	case sniffed == "application/zip":
+		for _, prefix := range zipContainers {
+			if strings.HasPrefix(declared, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sniffObject - read the first bytes of an uploaded object and sniff its content type
+func sniffObject(key, bucketName string, s3API s3iface.S3API, logger *LOGGER.Entry) (string, error) {
+	output, err := s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", sniffLength-1)),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"error": err.Error(),
+		}).Error("sniffObject() - an error occurred while trying to read the uploaded object")
+		return "", errInternal("unable to read the uploaded object", err)
+	}
+	defer output.Body.Close()
+	head, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return "", errInternal("unable to read the uploaded object", err)
+	}
+	return sniffContentType(head), nil
+}
+
+// setSessionTypePolicy - replace the file type policy of the session; an empty policy allows what the global one does.
+//	* the caller must have authorized the user as the owner of the session
+//	* files already uploaded are not checked again
+func setSessionTypePolicy(sess *session, policy typePolicy, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*session, error) {
+	logger.WithFields(LOGGER.Fields{
+		"id":     *sess.ID,
+		"policy": policy,
+	}).Info("setSessionTypePolicy() - replace the file type policy of the session")
+	update := expression.Set(expression.Name("type_policy"), expression.Value(policy.normalized()))
+	return saveSessionSettings(sess, update, "file type policy", sessionTableName, dbAPI, logger)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTypePolicy(t *testing.T) {
+	p, err := parseTypePolicy("")
+	assert.Nil(t, err)
+	assert.Equal(t, "", p.rejects("application/x-msdownload", "exe"), "no configuration allows every type")
+
+	p, err = parseTypePolicy(`{"allow_types":["Image/*","application/pdf; charset=binary"],"deny_extensions":[".EXE"]}`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"image/*", "application/pdf"}, p.AllowTypes)
+	assert.Equal(t, []string{"exe"}, p.DenyExtensions)
+
+	_, err = parseTypePolicy(`{"allow_types":`)
+	assert.NotNil(t, err)
+}
+
+func TestTypePolicy(t *testing.T) {
+	p := (&typePolicy{AllowTypes: []string{"image/*", "application/pdf"}, DenyTypes: []string{"image/svg+xml"}, DenyExtensions: []string{"exe"}}).normalized()
+	assert.Equal(t, "", p.rejects("image/png", "png"))
+	assert.Equal(t, "", p.rejects("application/pdf", ""))
+	assert.NotEqual(t, "", p.rejects("image/svg+xml", "svg"), "a deny rule wins over the wildcard")
+	assert.NotEqual(t, "", p.rejects("text/plain", "txt"))
+	assert.NotEqual(t, "", p.rejects("image/png", "exe"))
+
+	sess := &session{TypePolicy: &typePolicy{AllowExtensions: []string{"pdf"}}}
+	assert.Nil(t, checkFileType("report.PDF", "application/pdf", p, sess))
+	assert.NotNil(t, checkFileType("photo.png", "image/png", p, sess), "the session narrows the global policy")
+	assert.NotNil(t, checkFileType("setup.exe", "application/pdf", p, &session{}))
+
+	assert.Equal(t, "", sniffedRejection("a.pdf", unknownType, p), "unrecognized content was checked by its declared type")
+	assert.NotEqual(t, "", sniffedRejection("a.pdf", "application/x-msdownload", p))
+}
+
+func TestSniffContentType(t *testing.T) {
+	assert.Equal(t, "application/x-msdownload", sniffContentType([]byte("MZ\x90\x00\x03")))
+	assert.Equal(t, executableType, sniffContentType([]byte("\x7fELF\x02\x01\x01")))
+	assert.Equal(t, "application/x-mach-binary", sniffContentType([]byte{0xcf, 0xfa, 0xed, 0xfe, 0x07}))
+	assert.Equal(t, "text/x-shellscript", sniffContentType([]byte("#!/bin/sh\nrm -rf /\n")))
+	assert.Equal(t, "application/pdf", sniffContentType([]byte("%PDF-1.7\n")))
+	assert.Equal(t, "image/png", sniffContentType([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")))
+	assert.Equal(t, "text/plain", sniffContentType([]byte("name,size\na.jpg,10\n")))
+	assert.Equal(t, unknownType, sniffContentType([]byte{0x00, 0x01, 0x02, 0x03}))
+}
+
+func TestTypesMatch(t *testing.T) {
+	assert.True(t, typesMatch("application/pdf", "application/pdf"))
+	assert.True(t, typesMatch("application/x-custom", unknownType))
+	assert.True(t, typesMatch("text/csv", "text/plain; charset=utf-8"))
+	assert.True(t, typesMatch("application/json", "text/plain"))
+	assert.True(t, typesMatch("image/svg+xml", "text/xml"))
+	assert.True(t, typesMatch("application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip"))
+	assert.False(t, typesMatch("image/jpeg", "application/x-msdownload"))
+	assert.False(t, typesMatch("application/pdf", "text/plain"))
+	assert.False(t, typesMatch("image/png", "application/zip"))
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+const (
+	quarantineKeyPrefix = "quarantine/"
+	s3ObjectCreated     = "ObjectCreated:"
+)
+
+// reasons an uploaded object is quarantined
+const (
+	rejectUnknownKey  = "the key does not belong to an upload"
+	rejectNoRecord    = "no file record exists for the upload"
+	rejectKeyMismatch = "the key does not match the file record"
+	rejectSize        = "the size does not match the size the upload was requested for"
+	rejectRejected    = "the file was already rejected"
+)
+
+// uploadedObject - an object created in the uploads bucket, as reported by an s3 event record
+type uploadedObject struct {
+	Bucket string
+	Key    string
+	Size   int64
+	ETag   string
+	// the content type sniffed from the first bytes of the object; empty until it was read
+	SniffedType string
+}
+
+// uploadedObjectFrom - read the object of an s3 event record; nil for events other than object creation.
+//	* keys arrive url encoded; the decoded key is used when the event was unmarshalled from json
+func uploadedObjectFrom(record events.S3EventRecord) *uploadedObject {
+	if !strings.HasPrefix(record.EventName, s3ObjectCreated) {
+		return nil
+	}
+	key := record.S3.Object.URLDecodedKey
+	if key == "" {
+		key, _ = url.QueryUnescape(record.S3.Object.Key)
+	}
+	return &uploadedObject{
+		Bucket: record.S3.Bucket.Name,
+		Key:    key,
+		Size:   record.S3.Object.Size,
+		ETag:   strings.Trim(record.S3.Object.ETag, `"`),
+	}
+}
+
+// parseUploadKey - split an upload key sessions/{sessionId}/{fileId}/{name} into its parts
+func parseUploadKey(key string) (sessionID, fileID, name string, ok bool) {
+	if !strings.HasPrefix(key, sessionsKeyPrefix) {
+		return "", "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, sessionsKeyPrefix), "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// checkUpload - the reason the object does not match the upload of the file record; empty if it does.
+//	* a file that is already COMPLETE matches again, so redelivered events and re-uploads through the same url
+//	are accepted
+func checkUpload(obj *uploadedObject, f *file) string {
+	if f == nil {
+		return rejectNoRecord
+	}
+	if f.Key != obj.Key {
+		return rejectKeyMismatch
+	}
+	if f.Status == fileStatusRejected {
+		return rejectRejected
+	}
+	if f.Size != obj.Size {
+		return rejectSize
+	}
+	return ""
+}
+
+// ingestor - confirms the objects created in the uploads bucket by one s3 event against their file records
+type ingestor struct {
+	filesTableName    string
+	sessionsTableName string
+	blobsTableName    string
+	usageTableName    string
+	policy            *typePolicy         // the global file type policy
+	sessions          map[string]*session // the sessions looked up so far, by id
+	scanner           scanner             // the malware scanner; nil when none is configured
+	maxVersions       int                 // the most completed versions kept of a file
+	dbAPI             dynamodbiface.DynamoDBAPI
+	s3API             s3iface.S3API
+	logger            *LOGGER.Entry
+}
+
+// ingest - confirm an object created in the uploads bucket against its pending file record.
+//	* a matching object marks the file COMPLETE with the stored size and etag
+//	* the content type is sniffed from the first bytes; content the global or the session policy does not allow is
+//	rejected, and content that only differs from the declared type is flagged with type_mismatch
+//	* anything else is moved under quarantine/ and the file record, if there is one, is marked REJECTED
+//	* content uploaded to a blob key completes every file waiting for the blob
+//	* completed content is scanned for malware; the file stays blocked from downloads until the scan is CLEAN, and
+//	clean images get thumbnails
+//	* jpeg and png images uploaded to sessions that opted in are stripped of their metadata first
+//	* completing a new version of a file deletes its oldest versions beyond the version limit
+//	* only failures talking to dynamo or s3 are returned, so the event is retried
+func (in *ingestor) ingest(obj *uploadedObject) error {
+	logger := in.logger.WithField("key", obj.Key)
+	if strings.HasPrefix(obj.Key, blobsKeyPrefix) {
+		hash, ok := parseBlobKey(obj.Key)
+		if !ok {
+			return quarantineObject(obj.Key, rejectUnknownKey, obj.Bucket, in.s3API, logger)
+		}
+		return in.ingestBlob(obj, hash, logger)
+	}
+	_, fileID, _, ok := parseUploadKey(obj.Key)
+	if !ok {
+		return quarantineObject(obj.Key, rejectUnknownKey, obj.Bucket, in.s3API, logger)
+	}
+	f, err := findFileByID(fileID, in.filesTableName, in.dbAPI, logger)
+	if err != nil {
+		if serr, ok := err.(*serviceError); !ok || serr.code != codeNotFound {
+			return err
+		}
+		f = nil
+	}
+	if f != nil && f.Sanitization != nil && f.Sanitization.OriginalKey == obj.Key && f.Key != obj.Key {
+		// a redelivered event, or a second upload through the same url, of an upload that was already sanitized; the
+		// file keeps its sanitized content
+		return nil
+	}
+	reason := checkUpload(obj, f)
+	if reason == "" {
+		if obj.SniffedType, err = sniffObject(obj.Key, obj.Bucket, in.s3API, logger); err != nil {
+			return err
+		}
+		if reason, err = in.typeRejection(f, obj.SniffedType, logger); err != nil {
+			return err
+		}
+	}
+	if reason != "" {
+		if f != nil && f.Key == obj.Key && f.Status != fileStatusRejected {
+			if err := setFileStatus(f, fileStatusRejected, obj, in.filesTableName, in.usageTableName, in.dbAPI, logger); err != nil {
+				return err
+			}
+		}
+		return quarantineObject(obj.Key, reason, obj.Bucket, in.s3API, logger)
+	}
+	if err := setFileStatus(f, fileStatusComplete, obj, in.filesTableName, in.usageTableName, in.dbAPI, logger); err != nil {
+		return err
+	}
+	if f.Status != fileStatusComplete {
+		// the record was deleted or updated concurrently
+		return nil
+	}
+	sess, err := in.session(f.SessionID, logger)
+	if err != nil {
+		return err
+	}
+	if err := sanitizeUpload(f, sess, obj.Bucket, in.filesTableName, in.usageTableName, in.dbAPI, in.s3API, logger); err != nil {
+		return err
+	}
+	scan, thumbs := processContent(f.Key, thumbnailContentType(f), f.Size, obj.Bucket, in.scanner, in.s3API, logger)
+	if err := saveProcessing(map[string]dynamodb.AttributeValue{"id": {S: aws.String(f.ID)}}, "id", scan, thumbs, in.filesTableName, in.dbAPI, logger); err != nil {
+		return err
+	}
+	return pruneVersions(f, in.maxVersions, obj.Bucket, in.filesTableName, in.blobsTableName, in.usageTableName, in.dbAPI, in.s3API, logger)
+}
+
+// typeRejection - the reason the sniffed content of the file is not allowed in its session; empty if it is
+func (in *ingestor) typeRejection(f *file, sniffed string, logger *LOGGER.Entry) (string, error) {
+	sess, err := in.session(f.SessionID, logger)
+	if err != nil {
+		return "", err
+	}
+	return sniffedRejection(f.Name, sniffed, in.policy, sess.TypePolicy), nil
+}
+
+// session - the session of the id, looked up once per event.
+//	* a session that no longer exists is being deleted along with its files; an empty session stands in for it, so
+//	only the global policy applies and nothing is sanitized
+func (in *ingestor) session(id string, logger *LOGGER.Entry) (*session, error) {
+	if sess, ok := in.sessions[id]; ok {
+		return sess, nil
+	}
+	sess, err := findSessionByID(id, in.sessionsTableName, in.dbAPI, logger)
+	if err != nil {
+		if serr, ok := err.(*serviceError); !ok || serr.code != codeNotFound {
+			return nil, err
+		}
+		sess = &session{}
+	}
+	in.sessions[id] = sess
+	return sess, nil
+}
+
+// setFileStatus - save the status of the file record along with the size, etag and sniffed type of the stored object.
+//	* the update is conditioned on the status the record was read with, so a redelivered event is only counted once
+//	* a PENDING file that completes is counted as stored in the usage counters; one that is rejected is released
+//	* the pending_until date is removed, so the file is no longer considered by expirePendingUploads
+func setFileStatus(f *file, status string, obj *uploadedObject, filesTableName, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	logger.WithFields(LOGGER.Fields{
+		"file_id": f.ID,
+		"from":    f.Status,
+		"to":      status,
+	}).Info("setFileStatus() - update the status of the file record")
+	update := expression.Set(expression.Name("status"), expression.Value(status)).
+		Set(expression.Name("size"), expression.Value(obj.Size)).
+		Set(expression.Name("meta.meta__updated_at"), expression.Value(time.Now())).
+		Remove(expression.Name("pending_until"))
+	if obj.ETag != "" {
+		update = update.Set(expression.Name("etag"), expression.Value(obj.ETag))
+	}
+	if obj.SniffedType != "" {
+		mismatch := !typesMatch(f.ContentType, obj.SniffedType)
+		if mismatch {
+			logger.WithFields(LOGGER.Fields{
+				"file_id":  f.ID,
+				"declared": f.ContentType,
+				"sniffed":  obj.SniffedType,
+			}).Warn("setFileStatus() - the uploaded content does not match the declared content type")
+		}
+		update = update.Set(expression.Name("sniffed_type"), expression.Value(obj.SniffedType)).
+			Set(expression.Name("type_mismatch"), expression.Value(mismatch))
+	}
+	if status == fileStatusComplete && f.Checksum != nil && f.Checksum.VerifiedAt == nil {
+		// the checksum header was signed into the upload url, so s3 only stored the content if it matched
+		update = update.Set(expression.Name("checksum.verified_at"), expression.Value(time.Now()))
+	}
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.Name("status").Equal(expression.Value(f.Status))).
+		Build()
+	if err != nil {
+		return errInternal("unable to update the file record", err)
+	}
+	_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(filesTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(f.ID)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			// the file was deleted while the upload was in flight, or a concurrent delivery of the event updated it
+			return nil
+		}
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("setFileStatus() - an error occurred while trying to update the file record")
+		return errInternal("unable to update the file record", err)
+	}
+	if f.Status == fileStatusPending {
+		switch status {
+		case fileStatusComplete:
+			commitUpload(f, usageTableName, dbAPI, logger)
+		case fileStatusRejected:
+			releaseUpload(f, usageTableName, dbAPI, logger)
+		}
+	}
+	f.Status = status
+	f.PendingUntil = nil
+	f.Size = obj.Size
+	if obj.ETag != "" {
+		f.ETag = aws.String(obj.ETag)
+	}
+	if obj.SniffedType != "" {
+		f.SniffedType = aws.String(obj.SniffedType)
+		f.TypeMismatch = !typesMatch(f.ContentType, obj.SniffedType)
+	}
+	return nil
+}
+
+// copySource - the url encoded bucket/key source of a copy request
+func copySource(bucketName, key string) string {
+	segments := strings.Split(bucketName+"/"+key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// quarantineObject - move an unexpected object under quarantine/, out of reach of downloads and archives
+func quarantineObject(key, reason, bucketName string, s3API s3iface.S3API, logger *LOGGER.Entry) error {
+	logger.WithFields(LOGGER.Fields{
+		"reason": reason,
+	}).Warn("quarantineObject() - move the uploaded object to quarantine")
+	if strings.HasPrefix(key, quarantineKeyPrefix) {
+		return nil
+	}
+	_, err := s3API.CopyObjectRequest(&s3.CopyObjectInput{
+		Bucket:     aws.String(bucketName),
+		CopySource: aws.String(copySource(bucketName, key)),
+		Key:        aws.String(quarantineKeyPrefix + key),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"error": err.Error(),
+		}).Error("quarantineObject() - an error occurred while trying to copy the object to quarantine")
+		return errInternal("unable to quarantine the object", err)
+	}
+	_, err = s3API.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"error": err.Error(),
+		}).Error("quarantineObject() - an error occurred while trying to delete the quarantined object")
+		return errInternal("unable to quarantine the object", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUploadKey(t *testing.T) {
+	sid, fid, name, ok := parseUploadKey(uploadKey("s1", "f1", "photos/a.jpg"))
+	assert.True(t, ok)
+	assert.Equal(t, "s1", sid)
+	assert.Equal(t, "f1", fid)
+	assert.Equal(t, "photos/a.jpg", name)
+
+	for _, key := range []string{"archives/s1/j1.zip", "sessions/s1/a.jpg", "sessions//f1/a.jpg", "sessions/s1/f1/", "quarantine/sessions/s1/f1/a.jpg"} {
+		_, _, _, ok := parseUploadKey(key)
+		assert.False(t, ok, key)
+	}
+}
+
+// the canned event can also be replayed against a deployed stack: sam local invoke FileUploadMgrUploadsWorker -e testdata/s3-put-event.json
+func TestUploadEvent(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/s3-put-event.json")
+	assert.Nil(t, err)
+	var event events.S3Event
+	assert.Nil(t, json.Unmarshal(raw, &event))
+	assert.Len(t, event.Records, 3)
+
+	pending := &file{
+		ID:     "0c9e2a44-7d1f-4b7a-a3e5-6f2d8c1b9a70",
+		Key:    "sessions/5b6d3f0e-1c2a-4d8e-9f00-2a7c1e9b4d11/0c9e2a44-7d1f-4b7a-a3e5-6f2d8c1b9a70/quarterly report (2019).pdf",
+		Size:   1024,
+		Status: fileStatusPending,
+	}
+
+	// the expected upload; the key arrives url encoded
+	obj := uploadedObjectFrom(event.Records[0])
+	assert.NotNil(t, obj)
+	assert.Equal(t, pending.Key, obj.Key)
+	assert.Equal(t, "dev-file-upload-mgr-uploads", obj.Bucket)
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", obj.ETag)
+	assert.Equal(t, "", checkUpload(obj, pending))
+	sid, fid, _, ok := parseUploadKey(obj.Key)
+	assert.True(t, ok)
+	assert.Equal(t, "5b6d3f0e-1c2a-4d8e-9f00-2a7c1e9b4d11", sid)
+	assert.Equal(t, pending.ID, fid)
+
+	// a redelivered event of a completed upload still matches
+	complete := *pending
+	complete.Status = fileStatusComplete
+	assert.Equal(t, "", checkUpload(obj, &complete))
+
+	// a different size than requested, or a file rejected before
+	resized := *pending
+	resized.Size = 10
+	assert.Equal(t, rejectSize, checkUpload(obj, &resized))
+	rejected := *pending
+	rejected.Status = fileStatusRejected
+	assert.Equal(t, rejectRejected, checkUpload(obj, &rejected))
+
+	// an object outside any upload
+	stray := uploadedObjectFrom(event.Records[1])
+	assert.NotNil(t, stray)
+	_, _, _, ok = parseUploadKey(stray.Key)
+	assert.False(t, ok)
+	assert.Equal(t, rejectNoRecord, checkUpload(stray, nil))
+	assert.Equal(t, rejectKeyMismatch, checkUpload(stray, pending))
+
+	// only created objects are ingested
+	assert.Nil(t, uploadedObjectFrom(event.Records[2]))
+}
+
+func TestCopySource(t *testing.T) {
+	assert.Equal(t, "bucket/sessions/s1/f1/quarterly%20report%20%282019%29.pdf", copySource("bucket", "sessions/s1/f1/quarterly report (2019).pdf"))
+}
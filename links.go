@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+const (
+	linkTokenBytes = 32
+	// the longest an upload or share link may stay valid
+	maxUploadLinkLifetime = 30 * 24 * time.Hour
+	// upload and share links live in the same table and are told apart by their kind
+	linkKindUpload = "UPLOAD"
+	linkKindShare  = "SHARE"
+)
+
+// newLinkToken - a random, url safe link token and the id (sha256 hex) its record is stored under
+func newLinkToken() (string, string, error) {
+	b := make([]byte, linkTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, linkID(token), nil
+}
+
+// linkID - the id a link record is stored under; only the hash of the token is stored so a leaked table does not leak
+// usable links
+func linkID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createUploadLink - create a public upload link into the session.
+//	* the caller must have authorized the user as an editor of the session
+//	* the link is limited by its expiry, the number of files and the total bytes uploaded through it
+//	* an optional password is stored as a bcrypt hash
+func createUploadLink(sess *session, email string, expiresAt time.Time, maxFiles, maxBytes int64, password, linksTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*uploadLink, error) {
+	logger.WithFields(LOGGER.Fields{
+		"session_id": *sess.ID,
+		"expires_at": expiresAt,
+		"max_files":  maxFiles,
+		"max_bytes":  maxBytes,
+	}).Info("createUploadLink() - create a public upload link into the session")
+	if status := statusOf(sess); !acceptsUploads(status) {
+		return nil, errConflict("the session is "+status+" and no longer accepts uploads").
+			withExtension("status", status)
+	}
+	now := time.Now()
+	if !expiresAt.After(now) || expiresAt.Sub(now) > maxUploadLinkLifetime {
+		return nil, errValidation("the link must expire in the future and within 30 days")
+	}
+	if maxFiles < 1 || maxBytes < 1 {
+		return nil, errValidation("maxFiles and maxBytes must be greater than 0")
+	}
+	token, id, err := newLinkToken()
+	if err != nil {
+		return nil, errInternal("unable to create the upload link", err)
+	}
+	active := true
+	link := &uploadLink{
+		ID:        id,
+		Token:     token,
+		Kind:      linkKindUpload,
+		SessionID: *sess.ID,
+		CreatedBy: email,
+		ExpiresAt: expiresAt.UTC(),
+		TTL:       expiresAt.Unix(),
+		MaxFiles:  maxFiles,
+		MaxBytes:  maxBytes,
+		Meta: &baseMeta{
+			MetaCreatedAt: &now,
+			MetaUpdatedAt: &now,
+			MetaIsActive:  &active,
+		},
+	}
+	if password != "" {
+		if link.PwdHash, err = hashPwd(password); err != nil {
+			return nil, errInternal("unable to create the upload link", err)
+		}
+	}
+	linkMap, err := dynamodbattribute.MarshalMap(link)
+	if err != nil {
+		return nil, errInternal("unable to create the upload link", err)
+	}
+	if err := putNewItem(linkMap, "id", linksTableName, dbAPI, logger); err != nil {
+		return nil, errInternal("unable to create the upload link", err)
+	}
+	return link, nil
+}
+
+// findLinkItem - find the link record of a token.
+//	* unknown, expired, revoked links and links of another kind are all reported as not found so a token cannot be probed
+func findLinkItem(token, kind, linksTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry, out interface{}) error {
+	output, err := dbAPI.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(linksTableName),
+		Key:       map[string]dynamodb.AttributeValue{"id": {S: aws.String(linkID(token))}},
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"error": err.Error(),
+		}).Error("findLinkItem() - an error occurred while trying to find the link")
+		return errInternal("unable to look up the link", err)
+	}
+	notFound := errNotFound("the link does not exist or has expired")
+	if len(output.Item) == 0 {
+		return notFound
+	}
+	var header struct {
+		Kind      string    `json:"kind"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Meta      *baseMeta `json:"meta"`
+	}
+	if err = dynamodbattribute.UnmarshalMap(output.Item, &header); err != nil {
+		return errInternal("unable to read the link", err)
+	}
+	// links created before share links existed have no kind and are upload links
+	if header.Kind == "" {
+		header.Kind = linkKindUpload
+	}
+	if header.Kind != kind || !time.Now().Before(header.ExpiresAt) ||
+		(header.Meta != nil && header.Meta.MetaIsActive != nil && !*header.Meta.MetaIsActive) {
+		return notFound
+	}
+	if err = dynamodbattribute.UnmarshalMap(output.Item, out); err != nil {
+		return errInternal("unable to read the link", err)
+	}
+	return nil
+}
+
+// findUploadLink - find an active upload link by its token
+func findUploadLink(token, linksTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*uploadLink, error) {
+	var link = new(uploadLink)
+	if err := findLinkItem(token, linkKindUpload, linksTableName, dbAPI, logger, link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// errLinkLimit - the error of an upload the link limits do not allow
+func errLinkLimit(link *uploadLink) *serviceError {
+	return errConflict("the upload link does not allow any more files of this size").
+		withExtension("remainingFiles", link.MaxFiles-link.FileCount).
+		withExtension("remainingBytes", link.MaxBytes-link.ByteCount)
+}
+
+// reserveLinkUpload - count a file of the given size against the link limits.
+//	* uploads that do not fit the counters read with the link are refused right away
+//	* a single conditional update checks and increments the counters, so concurrent uploads cannot exceed the limits
+func reserveLinkUpload(link *uploadLink, size int64, linksTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	if link.FileCount >= link.MaxFiles || link.ByteCount+size > link.MaxBytes {
+		return errLinkLimit(link)
+	}
+	update := expression.Add(expression.Name("file_count"), expression.Value(1)).
+		Add(expression.Name("byte_count"), expression.Value(size))
+	cond := expression.Name("file_count").LessThan(expression.Value(link.MaxFiles)).
+		And(expression.Name("byte_count").LessThanEqual(expression.Value(link.MaxBytes - size))).
+		And(expression.Name("expires_at").GreaterThan(expression.Value(time.Now().UTC())))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return errInternal("unable to reserve the upload", err)
+	}
+	_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(linksTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(link.ID)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return errLinkLimit(link)
+		}
+		logger.WithFields(LOGGER.Fields{
+			"link_id": link.ID,
+			"error":   err.Error(),
+		}).Error("reserveLinkUpload() - an error occurred while trying to update the link counters")
+		return errInternal("unable to reserve the upload", err)
+	}
+	return nil
+}
+
+// releaseLinkUpload - give back a reservation whose upload could not be started; best effort
+func releaseLinkUpload(link *uploadLink, size int64, linksTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) {
+	update := expression.Add(expression.Name("file_count"), expression.Value(-1)).
+		Add(expression.Name("byte_count"), expression.Value(-size))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err == nil {
+		_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(linksTableName),
+			Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(link.ID)}},
+			UpdateExpression:          expr.Update(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		}).Send()
+	}
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"link_id": link.ID,
+			"error":   err.Error(),
+		}).Warn("releaseLinkUpload() - unable to release the reserved upload")
+	}
+}
+
+// uploadViaLink - register a file uploaded through an upload link by someone without an account.
+//	* the link must exist, be unexpired and, if it has one, the password must match
+//	* the file is counted against the link limits before the upload url is issued
+//	* the contributor's name and email are recorded on the file; the storage is charged to the session owner
+func uploadViaLink(token, password string, contrib contributor, name, contentType string, size int64, checksum *fileChecksum, quotas *quotaConfig, policy *typePolicy, maxVersions int, store storeNames, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) (*uploadTicket, error) {
+	logger.WithFields(LOGGER.Fields{
+		"contributor_email": contrib.Email,
+		"name":              name,
+		"size":              size,
+	}).Info("uploadViaLink() - register a file uploaded through an upload link")
+	if contrib.Name == "" || !strings.Contains(contrib.Email, "@") {
+		return nil, errValidation("the contributor's name and a valid email are required")
+	}
+	if size <= 0 {
+		return nil, errValidation("the file size must be greater than 0")
+	}
+	link, err := findUploadLink(token, store.links, dbAPI, logger)
+	if err != nil {
+		return nil, err
+	}
+	if link.PwdHash != nil && !verifyPwd(*link.PwdHash, password) {
+		return nil, errUnauthenticated("the upload link password is incorrect")
+	}
+	sess, err := findSessionByID(link.SessionID, store.sessions, dbAPI, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := reserveLinkUpload(link, size, store.links, dbAPI, logger); err != nil {
+		return nil, err
+	}
+	contrib.LinkID = link.ID
+	ticket, err := requestUploadURL(sess, contrib.Email, name, contentType, size, checksum, &contrib, roleOwner, quotas, policy, maxVersions, store, dbAPI, s3API, logger)
+	if err != nil {
+		releaseLinkUpload(link, size, store.links, dbAPI, logger)
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// createShareLink - create a public link to download either a whole session or some of its files.
+//	* the caller must have authorized the user as an editor of the session
+//	* the files must all belong to the session; without files the link shares the whole session, including files
+//	uploaded after the link was created
+func createShareLink(sess *session, fileIDs []string, email string, expiresAt time.Time, maxDownloads int64, password, linksTableName, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*shareLink, error) {
+	logger.WithFields(LOGGER.Fields{
+		"session_id":    *sess.ID,
+		"file_ids":      fileIDs,
+		"expires_at":    expiresAt,
+		"max_downloads": maxDownloads,
+	}).Info("createShareLink() - create a public share link of the session contents")
+	now := time.Now()
+	if !expiresAt.After(now) || expiresAt.Sub(now) > maxUploadLinkLifetime {
+		return nil, errValidation("the link must expire in the future and within 30 days")
+	}
+	if maxDownloads < 1 {
+		return nil, errValidation("maxDownloads must be greater than 0")
+	}
+	for _, fileID := range fileIDs {
+		f, err := findFileByID(fileID, filesTableName, dbAPI, logger)
+		if err != nil {
+			return nil, err
+		}
+		if f.SessionID != *sess.ID {
+			return nil, errValidation("all shared files must belong to the same session").
+				withExtension("fileId", fileID)
+		}
+	}
+	token, id, err := newLinkToken()
+	if err != nil {
+		return nil, errInternal("unable to create the share link", err)
+	}
+	active := true
+	link := &shareLink{
+		ID:           id,
+		Token:        token,
+		Kind:         linkKindShare,
+		SessionID:    *sess.ID,
+		FileIDs:      fileIDs,
+		CreatedBy:    email,
+		ExpiresAt:    expiresAt.UTC(),
+		TTL:          expiresAt.Unix(),
+		MaxDownloads: maxDownloads,
+		Meta: &baseMeta{
+			MetaCreatedAt: &now,
+			MetaUpdatedAt: &now,
+			MetaIsActive:  &active,
+		},
+	}
+	if password != "" {
+		if link.PwdHash, err = hashPwd(password); err != nil {
+			return nil, errInternal("unable to create the share link", err)
+		}
+	}
+	linkMap, err := dynamodbattribute.MarshalMap(link)
+	if err != nil {
+		return nil, errInternal("unable to create the share link", err)
+	}
+	if err := putNewItem(linkMap, "id", linksTableName, dbAPI, logger); err != nil {
+		return nil, errInternal("unable to create the share link", err)
+	}
+	return link, nil
+}
+
+// countShareDownload - count one download against the share link; fails once the link has been used up
+func countShareDownload(link *shareLink, linksTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (int64, error) {
+	count := expression.Name("download_count")
+	update := expression.Add(count, expression.Value(1))
+	cond := count.AttributeNotExists().Or(count.LessThan(expression.Value(link.MaxDownloads)))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return 0, errInternal("unable to count the download", err)
+	}
+	output, err := dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(linksTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(link.ID)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueUpdatedNew,
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return 0, errForbidden("the share link has reached its download limit")
+		}
+		logger.WithFields(LOGGER.Fields{
+			"link_id": link.ID,
+			"error":   err.Error(),
+		}).Error("countShareDownload() - an error occurred while trying to update the download count")
+		return 0, errInternal("unable to count the download", err)
+	}
+	var updated struct {
+		DownloadCount int64 `json:"download_count"`
+	}
+	if err := dynamodbattribute.UnmarshalMap(output.Attributes, &updated); err != nil {
+		return 0, errInternal("unable to count the download", err)
+	}
+	return updated.DownloadCount, nil
+}
+
+// resolveShareLink - list the files shared through a share link along with presigned urls to download them.
+//	* the link must exist, be unexpired and unrevoked and, if it has one, the password must match
+//	* every resolve counts as one download of the link
+func resolveShareLink(token, password, bucketName, linksTableName, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) (*sharedContents, error) {
+	logger.Info("resolveShareLink() - list the files shared through the link")
+	var link = new(shareLink)
+	if err := findLinkItem(token, linkKindShare, linksTableName, dbAPI, logger, link); err != nil {
+		return nil, err
+	}
+	if link.PwdHash != nil && !verifyPwd(*link.PwdHash, password) {
+		return nil, errUnauthenticated("the share link password is incorrect")
+	}
+	var files []*file
+	if len(link.FileIDs) == 0 {
+		all, err := findFiles(link.SessionID, filesTableName, dbAPI, logger)
+		if err != nil {
+			return nil, err
+		}
+		files = currentFiles(all)
+	} else {
+		for _, fileID := range link.FileIDs {
+			f, err := findFileByID(fileID, filesTableName, dbAPI, logger)
+			if err != nil {
+				// files deleted since the link was created are left out
+				if serr, ok := err.(*serviceError); ok && serr.code == codeNotFound {
+					continue
+				}
+				return nil, err
+			}
+			files = append(files, f)
+		}
+	}
+	downloads, err := countShareDownload(link, linksTableName, dbAPI, logger)
+	if err != nil {
+		return nil, err
+	}
+	contents := &sharedContents{
+		ExpiresAt:          link.ExpiresAt,
+		DownloadsRemaining: link.MaxDownloads - downloads,
+		Files:              []*sharedFile{},
+	}
+	for _, f := range files {
+		if checkDownloadable(f) != nil {
+			// files not scanned clean yet are left out until they are
+			continue
+		}
+		url, err := downloadURL(f, bucketName, s3API, logger)
+		if err != nil {
+			return nil, err
+		}
+		contents.Files = append(contents.Files, &sharedFile{ID: f.ID, Name: f.Name, ContentType: f.ContentType, Size: f.Size, URL: *url})
+	}
+	return contents, nil
+}
+
+// revokeLink - deactivate an upload or share link by its id.
+//	* only the user who created the link or the owner of its session may revoke it
+func revokeLink(id, email, linksTableName, membersTableName, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	logger.WithFields(LOGGER.Fields{
+		"link_id": id,
+	}).Info("revokeLink() - deactivate the link")
+	output, err := dbAPI.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(linksTableName),
+		Key:       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"link_id": id,
+			"error":   err.Error(),
+		}).Error("revokeLink() - an error occurred while trying to find the link")
+		return errInternal("unable to look up the link", err)
+	}
+	if len(output.Item) == 0 {
+		return errNotFound("no link exists with the given id")
+	}
+	var link struct {
+		SessionID string `json:"session_id"`
+		CreatedBy string `json:"created_by"`
+	}
+	if err = dynamodbattribute.UnmarshalMap(output.Item, &link); err != nil {
+		return errInternal("unable to read the link", err)
+	}
+	if link.CreatedBy != email {
+		if _, _, err := authorizeSession(link.SessionID, email, roleOwner, membersTableName, sessionTableName, dbAPI, logger); err != nil {
+			return err
+		}
+	}
+	update := expression.Set(expression.Name("meta.meta__is_active"), expression.Value(false)).
+		Set(expression.Name("meta.meta__updated_at"), expression.Value(time.Now()))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return errInternal("unable to revoke the link", err)
+	}
+	_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(linksTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"link_id": id,
+			"error":   err.Error(),
+		}).Error("revokeLink() - an error occurred while trying to deactivate the link")
+		return errInternal("unable to revoke the link", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/graphql-go/graphql"
+	"github.com/stretchr/testify/assert"
+)
+
+var linkStore = storeNames{bucket: "bucket", sessions: "sessions", files: "files", links: "links", blobs: "blobs", usage: "usage"}
+
+// storedLink - a mock dynamodb with the upload link and its session stored; the session no longer accepts uploads,
+// so an upload allowed by the link fails once it reaches the session
+func storedLink(t *testing.T, link *uploadLink) *mockDynamo {
+	db := storedSession(t, statusSubmitted, nil)
+	item, err := dynamodbattribute.MarshalMap(link)
+	assert.Nil(t, err)
+	db.item = map[string]map[string]dynamodb.AttributeValue{"links": item}
+	return db
+}
+
+// openLink - an active upload link expiring in an hour that allows 2 files of 100 bytes in total
+func openLink() *uploadLink {
+	return &uploadLink{ID: "l1", Kind: linkKindUpload, SessionID: "s1", ExpiresAt: time.Now().Add(time.Hour), MaxFiles: 2, MaxBytes: 100}
+}
+
+// linkUpload - upload a file of the size through the link with the password
+func linkUpload(db *mockDynamo, password string, size int64) error {
+	contrib := contributor{Name: "Alice", Email: "alice@example.com"}
+	_, err := uploadViaLink("token", password, contrib, "a.txt", "text/plain", size, nil, &quotaConfig{}, &typePolicy{}, 1, linkStore, db, &mockS3{}, testLogger())
+	return err
+}
+
+// codeOf - the code of a service error
+func codeOf(err error) errorCode {
+	if serr, ok := err.(*serviceError); ok {
+		return serr.code
+	}
+	return ""
+}
+
+func TestUploadLinkExpiry(t *testing.T) {
+	sess := &session{ID: aws.String("s1"), Status: aws.String(statusOpen)}
+	for _, expiresAt := range []time.Time{time.Now().Add(-time.Minute), time.Now().Add(maxUploadLinkLifetime + time.Hour)} {
+		_, err := createUploadLink(sess, "owner@example.com", expiresAt, 1, 1, "", "links", &mockDynamo{}, testLogger())
+		assert.Equal(t, codeValidation, codeOf(err))
+	}
+	link, err := createUploadLink(sess, "owner@example.com", time.Now().Add(time.Hour), 1, 1, "", "links", &mockDynamo{}, testLogger())
+	assert.Nil(t, err)
+	assert.Equal(t, link.ExpiresAt.Unix(), link.TTL, "expired links are removed by the table ttl")
+
+	expired := openLink()
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	inactive := false
+	revoked := openLink()
+	revoked.Meta = &baseMeta{MetaIsActive: &inactive}
+	share := openLink()
+	share.Kind = linkKindShare
+	for _, l := range []*uploadLink{expired, revoked, share} {
+		db := storedLink(t, l)
+		assert.Equal(t, codeNotFound, codeOf(linkUpload(db, "", 10)))
+		assert.Empty(t, db.updates, "nothing is counted against the link")
+	}
+	assert.Equal(t, codeNotFound, codeOf(linkUpload(&mockDynamo{}, "", 10)))
+}
+
+func TestUploadLinkPassword(t *testing.T) {
+	link := openLink()
+	var err error
+	link.PwdHash, err = hashPwd("s3cret")
+	assert.Nil(t, err)
+
+	for _, password := range []string{"", "wrong"} {
+		db := storedLink(t, link)
+		assert.Equal(t, codeUnauthenticated, codeOf(linkUpload(db, password, 10)))
+		assert.Empty(t, db.updates)
+	}
+	db := storedLink(t, link)
+	assert.Equal(t, codeConflict, codeOf(linkUpload(db, "s3cret", 10)), "the upload gets past the link to the session")
+	assert.Equal(t, []string{"links", "links"}, db.updates, "the reservation is released when the upload fails")
+}
+
+func TestUploadLinkLimits(t *testing.T) {
+	full := openLink()
+	full.FileCount = 2
+	db := storedLink(t, full)
+	err := linkUpload(db, "", 1)
+	assert.Equal(t, codeConflict, codeOf(err))
+	assert.Equal(t, int64(0), err.(*serviceError).Extensions()["remainingFiles"])
+	assert.Empty(t, db.updates)
+
+	used := openLink()
+	used.ByteCount = 95
+	db = storedLink(t, used)
+	err = linkUpload(db, "", 10)
+	assert.Equal(t, codeConflict, codeOf(err))
+	assert.Equal(t, int64(5), err.(*serviceError).Extensions()["remainingBytes"])
+	assert.Empty(t, db.updates)
+
+	// uploads counted concurrently make the conditional update fail
+	db = storedLink(t, openLink())
+	db.updateErr = map[string]error{"links": awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil)}
+	assert.Equal(t, codeConflict, codeOf(linkUpload(db, "", 100)))
+	assert.Equal(t, []string{"links"}, db.updates)
+}
+
+// schemaFields - the names of every field reachable from the graphql type
+func schemaFields(typ graphql.Type, names map[string]bool) map[string]bool {
+	obj, ok := graphql.GetNamed(typ).(*graphql.Object)
+	if !ok {
+		return names
+	}
+	for name, field := range obj.Fields() {
+		if !names[name] {
+			names[name] = true
+			schemaFields(field.Type, names)
+		}
+	}
+	return names
+}
+
+func TestShareLinkExposesNoPersonalData(t *testing.T) {
+	fields := schemaFields(sharedContentsType, map[string]bool{})
+	assert.True(t, fields["url"])
+	for _, private := range []string{"email", "contributor", "session_id", "charged_to", "scan", "metadata", "tags"} {
+		assert.False(t, fields[private], private)
+	}
+}
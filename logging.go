@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/satori/go.uuid"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+const (
+	logRedactKeysKey   = "LOG_REDACT_KEYS"
+	redactedValue      = "[REDACTED]"
+	logFormatCompact   = "compact"
+	apiGwRequestIDKey  = "apigw_request_id"
+	lambdaRequestIDKey = "lambda_request_id"
+	correlationIDKey   = "correlation_id"
+	operationNameKey   = "operation_name"
+	authEmailKey       = "auth_email"
+)
+
+// correlationIDPattern - the correlation ids accepted from callers; anything else could forge or break log lines
+var correlationIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// defaultRedactKeys - field keys whose values are never written to the logs.
+//	* the emails of users and contributors are personal data and are redacted like secrets; the one exception is the
+//	auth_email field of the request logger, which identifies the authenticated caller of a request for auditing
+var defaultRedactKeys = []string{
+	"email",
+	"contributor_email",
+	"pwd",
+	"password",
+	"authorization",
+	"auth_header",
+	"token",
+	"jwt",
+	"secret",
+	"cookie",
+	"set-cookie",
+	"x-api-key",
+}
+
+// redactingFormatter - wraps a logrus formatter and masks the values of any configured keys before the entry is formatted.
+//	* keys are matched case-insensitively at any depth: top level fields, nested maps, slices and structs (by json tag)
+//	* string values are scrubbed for inline `key: value` / `"key":"value"` pairs, which covers raw graphql query strings
+type redactingFormatter struct {
+	formatter LOGGER.Formatter
+	keys      map[string]bool
+	inline    *regexp.Regexp
+}
+
+// newRedactingFormatter() - build a redactingFormatter that masks the given keys and delegates to the given formatter
+func newRedactingFormatter(formatter LOGGER.Formatter, keys []string) *redactingFormatter {
+	keySet := make(map[string]bool, len(keys))
+	quoted := make([]string, 0, len(keys))
+	for _, k := range keys {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k == "" || keySet[k] {
+			continue
+		}
+		keySet[k] = true
+		quoted = append(quoted, regexp.QuoteMeta(k))
+	}
+	f := &redactingFormatter{formatter: formatter, keys: keySet}
+	if len(quoted) > 0 {
+		// key (optionally quoted or escape-quoted), a : or = separator, then an escape-quoted, quoted or bare value
+		f.inline = regexp.MustCompile(`(?i)(\\?"?\b(?:` + strings.Join(quoted, "|") + `)\b\\?"?\s*[:=]\s*)` +
+			`(\\"(?:[^"\\]|\\[^"])*\\"|"(?:[^"\\]|\\.)*"|[^\s,}&)\]]+)`)
+	}
+	return f
+}
+
+// redactKeys() - the default redact keys plus any comma separated keys configured in the env
+func redactKeys() []string {
+	keys := append([]string{}, defaultRedactKeys...)
+	if extra := os.Getenv(logRedactKeysKey); extra != "" {
+		keys = append(keys, strings.Split(extra, ",")...)
+	}
+	return keys
+}
+
+// Format() - redact a copy of the entry data and format the copy with the wrapped formatter
+func (f *redactingFormatter) Format(entry *LOGGER.Entry) ([]byte, error) {
+	data := make(LOGGER.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = f.redactField(k, v)
+	}
+	redacted := *entry
+	redacted.Data = data
+	redacted.Message = f.scrub(entry.Message)
+	return f.formatter.Format(&redacted)
+}
+
+func (f *redactingFormatter) isRedactKey(key string) bool {
+	return f.keys[strings.ToLower(key)]
+}
+
+// redactField() - mask the value entirely if the key is configured, otherwise walk the value
+func (f *redactingFormatter) redactField(key string, v interface{}) interface{} {
+	if f.isRedactKey(key) {
+		return redactedValue
+	}
+	return f.redact(v)
+}
+
+// redact() - walk the value, masking any configured keys found in nested maps and scrubbing strings
+func (f *redactingFormatter) redact(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return f.scrub(val)
+	case error:
+		return f.scrub(val.Error())
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			out[k] = f.redactField(k, item)
+		}
+		return out
+	case map[string]string:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			out[k] = f.redactField(k, item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = f.redact(item)
+		}
+		return out
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return v
+	case reflect.String:
+		return f.scrub(reflect.ValueOf(v).String())
+	}
+	// anything else (structs, typed maps, slices, pointers) is round tripped through json so json tags are honored
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return v
+	}
+	return f.redact(generic)
+}
+
+// scrub() - mask the values of any inline `key: value` pairs in the string
+func (f *redactingFormatter) scrub(s string) string {
+	if f.inline == nil || s == "" {
+		return s
+	}
+	return f.inline.ReplaceAllString(s, "${1}"+redactedValue)
+}
+
+// newCompactFormatter() - single line json with the fields flattened next to short time/level/msg keys.
+//	* cheaper to write and to query in CloudWatch Logs Insights than the pretty printed format.
+func newCompactFormatter() LOGGER.Formatter {
+	return &LOGGER.JSONFormatter{
+		FieldMap: LOGGER.FieldMap{
+			LOGGER.FieldKeyTime:  "ts",
+			LOGGER.FieldKeyLevel: "lvl",
+			LOGGER.FieldKeyMsg:   "msg",
+			LOGGER.FieldKeyFunc:  "func",
+			LOGGER.FieldKeyFile:  "file",
+		},
+	}
+}
+
+// correlationID() - the id used to tie together every log line and the response of a single request.
+//	* prefer an id supplied by the caller, then the API Gateway request id, then the Lambda request id
+//	* ids supplied by the caller must be up to 128 letters, digits, '.', '_' or '-'; others are ignored
+//	* generate one if none of those are present (local invocations)
+func correlationID(ctx context.Context, request events.APIGatewayProxyRequest) string {
+	for k, v := range request.Headers {
+		if strings.EqualFold(k, correlationIDHeader) && correlationIDPattern.MatchString(v) {
+			return v
+		}
+	}
+	if request.RequestContext.RequestID != "" {
+		return request.RequestContext.RequestID
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+	id, _ := uuid.NewV4()
+	return id.String()
+}
+
+// requestLogger() - build the request scoped logger carrying the correlation fields of the invocation
+func requestLogger(ctx context.Context, logger *LOGGER.Logger, corrID string, request events.APIGatewayProxyRequest) *LOGGER.Entry {
+	fields := LOGGER.Fields{correlationIDKey: corrID}
+	if request.RequestContext.RequestID != "" {
+		fields[apiGwRequestIDKey] = request.RequestContext.RequestID
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		fields[lambdaRequestIDKey] = lc.AwsRequestID
+	}
+	return logger.WithFields(fields)
+}
+
+// withLogger() - add the request scoped logger to the context passed through to the resolvers
+func withLogger(ctx context.Context, logger *LOGGER.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// loggerFromContext() - get the request scoped logger from the context.
+//	* falls back to the standard logger so callers never have to nil check
+func loggerFromContext(ctx context.Context) *LOGGER.Entry {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey).(*LOGGER.Entry); ok && logger != nil {
+			return logger
+		}
+	}
+	return LOGGER.NewEntry(LOGGER.StandardLogger())
+}
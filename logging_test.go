@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	LOGGER "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactingFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	log := LOGGER.New()
+	log.SetOutput(&buf)
+	log.SetFormatter(newRedactingFormatter(&LOGGER.JSONFormatter{}, defaultRedactKeys))
+
+	variables := map[string]interface{}{
+		"email": "user@example.com",
+		"input": map[string]interface{}{"pwd": "hunter2"},
+	}
+	log.WithFields(LOGGER.Fields{
+		"request_headers":   map[string]string{"Authorization": "Bearer abc.def.ghi", "Content-Type": "application/json"},
+		"request_variables": variables,
+		"request_query":     `mutation { authenticate(email: "user@example.com", pwd: "hunter2") { token } }`,
+		"item":              &user{Email: "user@example.com", Pwd: "$2a$10$hash"},
+	}).Info("redact me")
+
+	out := buf.String()
+	assert.NotContains(t, out, "hunter2")
+	assert.NotContains(t, out, "abc.def.ghi")
+	assert.NotContains(t, out, "$2a$10$hash")
+	assert.NotContains(t, out, "user@example.com")
+	assert.Contains(t, out, "application/json")
+
+	var logged map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &logged))
+	assert.Equal(t, redactedValue, logged["request_headers"].(map[string]interface{})["Authorization"])
+	// the caller's fields must not be mutated by the formatter
+	assert.Equal(t, "hunter2", variables["input"].(map[string]interface{})["pwd"])
+
+	// the authenticated caller is kept for auditing
+	buf.Reset()
+	log.WithField(authEmailKey, "caller@example.com").Info("audit me")
+	assert.Contains(t, buf.String(), "caller@example.com")
+}
+
+func TestCorrelationID(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "lambda-1"})
+	withHeader := func(v string) events.APIGatewayProxyRequest {
+		return events.APIGatewayProxyRequest{Headers: map[string]string{"x-correlation-id": v}}
+	}
+	assert.Equal(t, "client_id-1.a", correlationID(ctx, withHeader("client_id-1.a")))
+	for _, invalid := range []string{"", "two words", "id\nforged=1", "<script>", strings.Repeat("a", 129)} {
+		assert.Equal(t, "lambda-1", correlationID(ctx, withHeader(invalid)), "%q", invalid)
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"net/http"
+	"os"
 	"time"
 
 	"github.com/graphql-go/graphql"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	LOGGER "github.com/sirupsen/logrus"
 )
 
@@ -16,7 +19,15 @@ type key string
 
 const (
 	authHeaderKey          key = "Authorization"
+	loggerKey              key = "Logger"
+	configKey              key = "Config"
 	authorizationHeaderKey     = "Authorization"
+	correlationIDHeader        = "X-Correlation-Id"
+	lambdaHandlerKey           = "LAMBDA_HANDLER"
+	archiveHandlerName         = "archive"
+	uploadsHandlerName         = "uploads"
+	sweepHandlerName           = "sweep"
+	migrateHandlerName         = "migrate"
 )
 
 type params struct {
@@ -29,8 +40,10 @@ type params struct {
 //	- initialize the required dependencies for the handler
 //	- get the request body and marshal into a params instance
 //	- attempt to run the graphql query
-//	- return the response of the query
+//	- return the {data, errors} response of the query; the apiResponse envelope is only used for transport failures
+//	Every response echoes the request correlation id in the X-Correlation-Id header.
 func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	corrID := correlationID(ctx, request)
 	// add the Authorization header to the context which is passed to the query
 	appCtx := context.WithValue(ctx, authHeaderKey, request.Headers[authorizationHeaderKey])
 	if len(request.Body) == 0 {
@@ -40,8 +53,9 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			WithMessage("Handler() - The Request body is null. Cannot Process").
 			ToJSON()
 		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
+			StatusCode: http.StatusBadRequest,
 			Body:       resp,
+			Headers:    responseHeaders(corrID),
 		}, nil
 	}
 	// initialize file upload manager config
@@ -53,20 +67,24 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			WithMessage("Handler() - error occurred trying to initialize").
 			ToJSON()
 		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
+			StatusCode: http.StatusInternalServerError,
 			Body:       resp,
+			Headers:    responseHeaders(corrID),
 		}, nil
 	}
+	// add the config to the context so the resolvers of the shared types reach the configured services
+	appCtx = context.WithValue(appCtx, configKey, mgr)
+	// build the request scoped logger; every log line for this request carries the correlation ids
+	logger := requestLogger(ctx, mgr.loggerImpl(), corrID, request)
 	// log event
-	mgr.loggerImpl().WithFields(LOGGER.Fields{
-		"request_body":    request.Body,
+	logger.WithFields(LOGGER.Fields{
 		"request_method":  request.HTTPMethod,
 		"request_headers": request.Headers,
 	}).Info("Handler() - File Upload Request Received")
 	// deserialize request body into params
 	var reqParams = new(params)
 	if err := json.Unmarshal([]byte(request.Body), &reqParams); err != nil {
-		mgr.loggerImpl().WithFields(LOGGER.Fields{
+		logger.WithFields(LOGGER.Fields{
 			"deserialization_error": err.Error(),
 		}).Error("Handler() - An error occurred while trying to deserialize the request body into the params")
 		resp := new(apiResponse).
@@ -75,10 +93,16 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			WithMessage("Handler() - An error occurred while trying to deserialize the request body into the params").
 			ToJSON()
 		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
+			StatusCode: http.StatusBadRequest,
 			Body:       resp,
+			Headers:    responseHeaders(corrID),
 		}, nil
 	}
+	logger = logger.WithField(operationNameKey, reqParams.OperationName)
+	logger.WithFields(LOGGER.Fields{
+		"request_query":     reqParams.Query,
+		"request_variables": reqParams.Variables,
+	}).Debug("Handler() - running the graphql query operation")
 	// run query against graphql instance to get result
 	schema := mgr.schemaImpl()
 	response := graphql.Do(graphql.Params{
@@ -86,34 +110,29 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		RequestString:  reqParams.Query,
 		VariableValues: reqParams.Variables,
 		OperationName:  reqParams.OperationName,
-		Context:        appCtx,
+		Context:        withLogger(appCtx, logger),
 	})
-	// check for errors
+	// check for errors; every error carries an extensions.code
+	status := http.StatusOK
 	if response.HasErrors() {
-		mgr.loggerImpl().WithFields(LOGGER.Fields{
-			"request_query":          reqParams.Query,
-			"request_operation_name": reqParams.OperationName,
-			"request_variables":      reqParams.Variables,
-			"request_errors":         response.Errors,
+		response.Errors = withErrorCodes(response.Errors)
+		logger.WithFields(LOGGER.Fields{
+			"request_query":     reqParams.Query,
+			"request_variables": reqParams.Variables,
+			"request_errors":    response.Errors,
 		}).Error("Handler() - an error occurred trying to perform the graphql query operation")
-		resp := new(apiResponse).
-			WithReceivedAt(time.Now()).
-			WithErrors(response.Errors).
-			WithMessage("Handler() - an error occurred trying to perform the graphql query operation").
-			ToJSON()
-		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
-			Body:       resp,
-		}, nil
+		// fields that resolved are still returned next to the errors; only fail the status when nothing resolved
+		if !hasData(response.Data) {
+			status = statusForErrors(response.Errors)
+		}
 	}
-	// parse response; serialize into JSON
-	r, err := json.Marshal(response.Data)
+	// parse response; serialize the spec compliant {data, errors} payload into JSON
+	r, err := json.Marshal(response)
 	if err != nil {
-		mgr.loggerImpl().WithFields(LOGGER.Fields{
-			"request_query":          reqParams.Query,
-			"request_operation_name": reqParams.OperationName,
-			"request_variables":      reqParams.Variables,
-			"request_errors":         err.Error(),
+		logger.WithFields(LOGGER.Fields{
+			"request_query":     reqParams.Query,
+			"request_variables": reqParams.Variables,
+			"request_errors":    err.Error(),
 		}).Error("Handler() - an error occurred trying to marshal the graphql query response into json")
 		resp := new(apiResponse).
 			WithReceivedAt(time.Now()).
@@ -121,19 +140,150 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			WithMessage("Handler() - an error occurred trying to marshal the graphql query response into json").
 			ToJSON()
 		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
+			StatusCode: http.StatusInternalServerError,
 			Body:       resp,
+			Headers:    responseHeaders(corrID),
 		}, nil
 	}
 	return events.APIGatewayProxyResponse{
-		StatusCode: 200,
+		StatusCode: status,
 		Body:       string(r),
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
+		Headers:    responseHeaders(corrID),
 	}, nil
 }
 
+// hasData - check whether at least one top level field of the graphql result resolved to a value
+func hasData(data interface{}) bool {
+	fields, ok := data.(map[string]interface{})
+	if !ok {
+		return data != nil
+	}
+	for _, v := range fields {
+		if v != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// responseHeaders - the headers sent on every response
+func responseHeaders(corrID string) map[string]string {
+	return map[string]string{
+		"Content-Type":      "application/json",
+		correlationIDHeader: corrID,
+	}
+}
+
+// ArchiveHandler - AWS Lambda invocation function point of the archive worker
+//	- initialize the required dependencies for the handler
+//	- run the archive job of the event until it finishes or the invocation runs out of time
+func ArchiveHandler(ctx context.Context, event archiveEvent) error {
+	mgr, err := new(conf).init()
+	if err != nil {
+		return err
+	}
+	fields := LOGGER.Fields{"job_id": event.JobID}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		fields[lambdaRequestIDKey] = lc.AwsRequestID
+	}
+	logger := mgr.loggerImpl().WithFields(fields)
+	logger.Info("ArchiveHandler() - Archive Job Received")
+	return runArchiveJob(ctx, event.JobID, mgr.uploadsBucket(), mgr.tableNames()[tablesMapJobKey], mgr.tableNames()[tablesMapFileKey], mgr.dynamoImpl(), mgr.s3Impl(), mgr.lambdaImpl(), logger)
+}
+
+// UploadsHandler - AWS Lambda invocation function point of the s3 notifications of the uploads bucket
+//	- initialize the required dependencies for the handler
+//	- confirm every created object against its pending file record, quarantining the ones that do not match
+//	- return an error if any record could not be processed, so the event is retried; records are idempotent
+func UploadsHandler(ctx context.Context, event events.S3Event) error {
+	mgr, err := new(conf).init()
+	if err != nil {
+		return err
+	}
+	fields := LOGGER.Fields{"records": len(event.Records)}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		fields[lambdaRequestIDKey] = lc.AwsRequestID
+	}
+	logger := mgr.loggerImpl().WithFields(fields)
+	logger.Info("UploadsHandler() - S3 Event Received")
+	in := &ingestor{
+		filesTableName:    mgr.tableNames()[tablesMapFileKey],
+		sessionsTableName: mgr.tableNames()[tablesMapSessionKey],
+		blobsTableName:    mgr.tableNames()[tablesMapBlobKey],
+		usageTableName:    mgr.tableNames()[tablesMapUsageKey],
+		policy:            mgr.fileTypePolicy(),
+		sessions:          map[string]*session{},
+		scanner:           mgr.malwareScanner(),
+		maxVersions:       mgr.fileVersionLimit(),
+		dbAPI:             mgr.dynamoImpl(),
+		s3API:             mgr.s3Impl(),
+		logger:            logger,
+	}
+	var failed error
+	for _, record := range event.Records {
+		obj := uploadedObjectFrom(record)
+		if obj == nil {
+			logger.WithFields(LOGGER.Fields{
+				"event_name": record.EventName,
+			}).Debug("UploadsHandler() - skipping a record that does not create an object")
+			continue
+		}
+		if err := in.ingest(obj); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// SweepHandler - AWS Lambda invocation function point of the scheduled sweep worker
+//	- initialize the required dependencies for the handler
+//	- expire the pending uploads that never arrived, releasing the quota, link counters and blobs they reserved
+func SweepHandler(ctx context.Context) error {
+	mgr, err := new(conf).init()
+	if err != nil {
+		return err
+	}
+	fields := LOGGER.Fields{}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		fields[lambdaRequestIDKey] = lc.AwsRequestID
+	}
+	logger := mgr.loggerImpl().WithFields(fields)
+	logger.Info("SweepHandler() - Sweep Scheduled")
+	expired, err := expirePendingUploads(time.Now(), mgr.stores(), mgr.dynamoImpl(), mgr.s3Impl(), logger)
+	logger.WithFields(LOGGER.Fields{"expired": expired}).Info("SweepHandler() - Sweep Finished")
+	return err
+}
+
+// MigrateHandler - AWS Lambda invocation function point of the migration worker; it has no triggers and is only
+// invoked by hand
+//	- initialize the required dependencies for the handler
+//	- run the maintenance migration named by the event
+func MigrateHandler(ctx context.Context, event migrationEvent) error {
+	mgr, err := new(conf).init()
+	if err != nil {
+		return err
+	}
+	fields := LOGGER.Fields{"migration": event.Migration}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		fields[lambdaRequestIDKey] = lc.AwsRequestID
+	}
+	logger := mgr.loggerImpl().WithFields(fields)
+	logger.Info("MigrateHandler() - Migration Received")
+	return runMigration(event.Migration, mgr.tableNames()[tablesMapSessionKey], mgr.dynamoImpl(), logger)
+}
+
+// main - start the handler selected by LAMBDA_HANDLER; the graphql api by default
 func main() {
-	lambda.Start(Handler)
+	switch os.Getenv(lambdaHandlerKey) {
+	case archiveHandlerName:
+		lambda.Start(ArchiveHandler)
+	case uploadsHandlerName:
+		lambda.Start(UploadsHandler)
+	case sweepHandlerName:
+		lambda.Start(SweepHandler)
+	case migrateHandlerName:
+		lambda.Start(MigrateHandler)
+	default:
+		lambda.Start(Handler)
+	}
 }
@@ -32,7 +32,82 @@ func TestHandler(t *testing.T) {
 	response, err := Handler(ctx, request)
 
 	assert.Contains(t, response.Body, expectedResponse.Body)
-	assert.Equal(t, response.Headers, expectedResponse.Headers)
+	assert.Equal(t, response.Headers["Content-Type"], expectedResponse.Headers["Content-Type"])
+	assert.NotEmpty(t, response.Headers[correlationIDHeader])
+	assert.Equal(t, err, nil)
+}
+
+func TestHandlerEchoesCorrelationID(t *testing.T) {
+	p := params{Query: `{hello}`}
+	rJSON, _ := json.Marshal(p)
+	request := events.APIGatewayProxyRequest{
+		Body:       string(rJSON),
+		HTTPMethod: "post",
+		Headers: map[string]string{
+			"Content-Type":     "application/json",
+			"x-correlation-id": "abc-123",
+		},
+	}
+
+	response, err := Handler(context.Background(), request)
+
+	assert.Equal(t, "abc-123", response.Headers[correlationIDHeader])
+	assert.Equal(t, err, nil)
+
+}
+
+func TestHandlerErrorStatus(t *testing.T) {
+	ctx := context.Background()
+
+	response, err := Handler(ctx, events.APIGatewayProxyRequest{Body: `{"query":`})
+	assert.Equal(t, 400, response.StatusCode)
 	assert.Equal(t, err, nil)
 
+	rJSON, _ := json.Marshal(params{Query: `{doesNotExist}`})
+	response, err = Handler(ctx, events.APIGatewayProxyRequest{Body: string(rJSON)})
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Contains(t, response.Body, `"code":"VALIDATION_FAILED"`)
+	assert.Equal(t, err, nil)
+
+	rJSON, _ = json.Marshal(params{Query: `{getAuthUser{email}}`})
+	response, err = Handler(ctx, events.APIGatewayProxyRequest{Body: string(rJSON)})
+	assert.Equal(t, 401, response.StatusCode)
+	assert.Contains(t, response.Body, `"code":"UNAUTHENTICATED"`)
+	assert.Equal(t, err, nil)
+}
+
+func TestHandlerPartialData(t *testing.T) {
+	rJSON, _ := json.Marshal(params{Query: `{hello getAuthUser{email}}`})
+
+	response, err := Handler(context.Background(), events.APIGatewayProxyRequest{Body: string(rJSON)})
+
+	var body map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(response.Body), &body))
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "World", body["data"].(map[string]interface{})["hello"])
+	assert.Len(t, body["errors"], 1)
+	assert.Equal(t, err, nil)
+}
+
+func TestHandlerAcceptsDeprecatedSessionEndDate(t *testing.T) {
+	rJSON, _ := json.Marshal(params{Query: `mutation { saveSession(sess: {name: "s", session_start_date: "2019-05-01T10:00:00Z", session_end_date: "2019-05-02T10:00:00Z"}) { id } }`})
+
+	response, err := Handler(context.Background(), events.APIGatewayProxyRequest{Body: string(rJSON)})
+
+	// the input is valid, so the request only fails for the missing authorization
+	assert.Equal(t, 401, response.StatusCode)
+	assert.Contains(t, response.Body, `"code":"UNAUTHENTICATED"`)
+	assert.Equal(t, err, nil)
+}
+
+func TestHandlerAcceptsDeprecatedSessionStatus(t *testing.T) {
+	// the input as clients sent it before the session lifecycle: with the owner email and a free-form status
+	rJSON, _ := json.Marshal(params{Query: `mutation { saveSession(sess: {email: "owner@example.com", name: "s", session_start_date: "2019-05-01T10:00:00Z", status: "done"}) { id } }`})
+
+	response, err := Handler(context.Background(), events.APIGatewayProxyRequest{Body: string(rJSON)})
+
+	// the input is valid, so the request only fails for the missing authorization
+	assert.Equal(t, 401, response.StatusCode)
+	assert.Contains(t, response.Body, `"code":"UNAUTHENTICATED"`)
+	assert.Equal(t, err, nil)
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+// memberKey - the primary key of a member record: session_id (hash) + email (range)
+func memberKey(sessionID, email string) map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"session_id": {S: aws.String(sessionID)},
+		"email":      {S: aws.String(email)},
+	}
+}
+
+// sessionRole - the role the user holds on the session.
+//	* the session email is the owner; anyone else needs a member record
+//	* returns an empty role if the user has no access to the session
+func sessionRole(sess *session, email, membersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (string, error) {
+	if sess.Email == email {
+		return roleOwner, nil
+	}
+	m, err := findMember(*sess.ID, email, membersTableName, dbAPI, logger)
+	if err != nil {
+		return "", err
+	}
+	if m == nil {
+		return "", nil
+	}
+	return m.Role, nil
+}
+
+// authorizeSession - find a session record by its id and verify the user holds at least the required role on it.
+//	* returns the session and the role the user holds
+func authorizeSession(id, email, required, membersTableName, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*session, string, error) {
+	sess, err := findSessionByID(id, sessionTableName, dbAPI, logger)
+	if err != nil {
+		return nil, "", err
+	}
+	role, err := sessionRole(sess, email, membersTableName, dbAPI, logger)
+	if err != nil {
+		return nil, "", err
+	}
+	if role == "" {
+		logger.WithFields(LOGGER.Fields{
+			"id": id,
+		}).Warn("authorizeSession() - the session is not shared with the user")
+		return nil, "", errForbidden("the session belongs to another user")
+	}
+	if !hasRole(role, required) {
+		logger.WithFields(LOGGER.Fields{
+			"id":       id,
+			"role":     role,
+			"required": required,
+		}).Warn("authorizeSession() - the user's role on the session does not allow the request")
+		return nil, "", errForbidden("this requires the "+required+" role on the session").
+			withExtension("role", role)
+	}
+	return sess, role, nil
+}
+
+// findMember - find the member record of the user on the session; nil if the session is not shared with the user
+func findMember(sessionID, email, membersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*member, error) {
+	output, err := dbAPI.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(membersTableName),
+		Key:       memberKey(sessionID, email),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"session_id": sessionID,
+			"error":      err.Error(),
+		}).Error("findMember() - an error occurred while trying to find the member record")
+		return nil, errInternal("unable to check access to the session", err)
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	var m = new(member)
+	if err = dynamodbattribute.UnmarshalMap(output.Item, &m); err != nil {
+		return nil, errInternal("unable to check access to the session", err)
+	}
+	return m, nil
+}
+
+// findMembers - find the collaborators of a session
+func findMembers(sessionID, membersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) ([]*member, error) {
+	logger.WithFields(LOGGER.Fields{
+		"session_id":         sessionID,
+		"members_table_name": membersTableName,
+	}).Info("findMembers() - find the collaborators of the session")
+	return queryMembers(expression.Key("session_id").Equal(expression.Value(sessionID)), "", membersTableName, dbAPI, logger)
+}
+
+// queryMembers - query the member records matching the key condition on the table or the given index, following LastEvaluatedKey
+func queryMembers(keyCond expression.KeyConditionBuilder, indexName, membersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) ([]*member, error) {
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return nil, errInternal("unable to list the collaborators", err)
+	}
+	input := dynamodb.QueryInput{
+		TableName:                 aws.String(membersTableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	if indexName != "" {
+		input.IndexName = aws.String(indexName)
+	}
+	members := []*member{}
+	for {
+		output, err := dbAPI.QueryRequest(&input).Send()
+		if err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"index": indexName,
+				"error": err.Error(),
+			}).Error("queryMembers() - an error occurred while trying to query the member records")
+			return nil, errInternal("unable to list the collaborators", err)
+		}
+		for _, item := range output.Items {
+			var m = new(member)
+			if err := dynamodbattribute.UnmarshalMap(item, &m); err == nil {
+				members = append(members, m)
+			}
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			return members, nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// inviteToSession - share the session with a user in the given role.
+//	* the caller must have authorized the inviter as the owner of the session
+//	* the owner is implied by the session and cannot be invited; re-inviting a collaborator replaces their role
+func inviteToSession(sess *session, email, role, invitedBy, membersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*member, error) {
+	logger.WithFields(LOGGER.Fields{
+		"session_id": *sess.ID,
+		"email":      email,
+		"role":       role,
+	}).Info("inviteToSession() - share the session with the user")
+	if role != roleEditor && role != roleViewer {
+		return nil, errValidation("collaborators can only be invited as " + roleEditor + " or " + roleViewer)
+	}
+	if email == sess.Email {
+		return nil, errValidation("the owner of the session cannot be invited to it")
+	}
+	now := time.Now()
+	active := true
+	m := &member{
+		SessionID: *sess.ID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: invitedBy,
+		Meta: &baseMeta{
+			MetaCreatedAt: &now,
+			MetaUpdatedAt: &now,
+			MetaIsActive:  &active,
+		},
+	}
+	if existing, err := findMember(*sess.ID, email, membersTableName, dbAPI, logger); err != nil {
+		return nil, err
+	} else if existing != nil && existing.Meta != nil {
+		m.Meta.MetaCreatedAt = existing.Meta.MetaCreatedAt
+	}
+	memberMap, err := dynamodbattribute.MarshalMap(m)
+	if err != nil {
+		return nil, errInternal("unable to share the session", err)
+	}
+	if err := putItem(memberMap, membersTableName, dbAPI, logger); err != nil {
+		return nil, errInternal("unable to share the session", err)
+	}
+	return m, nil
+}
+
+// removeCollaborator - stop sharing the session with the user
+func removeCollaborator(sessionID, email, membersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	logger.WithFields(LOGGER.Fields{
+		"session_id": sessionID,
+		"email":      email,
+	}).Info("removeCollaborator() - stop sharing the session with the user")
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("session_id").AttributeExists()).
+		Build()
+	if err != nil {
+		return errInternal("unable to remove the collaborator", err)
+	}
+	_, err = dbAPI.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		TableName:                aws.String(membersTableName),
+		Key:                      memberKey(sessionID, email),
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return errNotFound("the session is not shared with the user")
+		}
+		logger.WithFields(LOGGER.Fields{
+			"session_id": sessionID,
+			"error":      err.Error(),
+		}).Error("removeCollaborator() - an error occurred while trying to delete the member record")
+		return errInternal("unable to remove the collaborator", err)
+	}
+	return nil
+}
+
+// findSharedSessions - find the sessions shared with the user through the email index of the members table.
+//	* archived sessions and sessions deleted since they were shared are left out
+func findSharedSessions(email, membersTableName, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) ([]*sharedSession, error) {
+	logger.WithFields(LOGGER.Fields{
+		"email":              email,
+		"members_table_name": membersTableName,
+	}).Info("findSharedSessions() - find the sessions shared with the user")
+	members, err := queryMembers(expression.Key("email").Equal(expression.Value(email)), membersByEmailIndex, membersTableName, dbAPI, logger)
+	if err != nil {
+		return nil, err
+	}
+	shared := []*sharedSession{}
+	for _, m := range members {
+		sess, err := findSessionByID(m.SessionID, sessionTableName, dbAPI, logger)
+		if err != nil {
+			if serr, ok := err.(*serviceError); ok && serr.code == codeNotFound {
+				continue
+			}
+			return nil, err
+		}
+		if sess.Meta != nil && sess.Meta.MetaIsActive != nil && !*sess.Meta.MetaIsActive {
+			continue
+		}
+		shared = append(shared, &sharedSession{Role: m.Role, Session: sess})
+	}
+	return shared, nil
+}
+
+// deleteMemberRecords - delete every member record of a session in batches of 25
+func deleteMemberRecords(sessionID, membersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	members, err := findMembers(sessionID, membersTableName, dbAPI, logger)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(members); start += dynamoWriteBatchSize {
+		end := start + dynamoWriteBatchSize
+		if end > len(members) {
+			end = len(members)
+		}
+		writes := make([]dynamodb.WriteRequest, 0, end-start)
+		for _, m := range members[start:end] {
+			writes = append(writes, dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: memberKey(m.SessionID, m.Email)},
+			})
+		}
+		if err := batchWrite(map[string][]dynamodb.WriteRequest{membersTableName: writes}, dbAPI, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+// the limits of the metadata and tags of a session or a file; they keep the records well below the dynamodb item size
+const (
+	maxMetadataEntries     = 50
+	maxMetadataValueLength = 1024
+	maxTags                = 50
+	maxTagLength           = 64
+)
+
+// metadataKeyPattern - metadata keys start with a letter and are used as dynamodb attribute names in filters, so dots
+// are not allowed
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,63}$`)
+
+// metadataEntry - one key/value pair of the metadata of a session or a file, as exposed through graphql
+type metadataEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// metadataEntries - the metadata as entries sorted by key
+func metadataEntries(metadata map[string]string) []metadataEntry {
+	entries := make([]metadataEntry, 0, len(metadata))
+	for k, v := range metadata {
+		entries = append(entries, metadataEntry{Key: k, Value: v})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// tagsOf - the tags of a session or a file; records without tags have none rather than nil
+func tagsOf(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
+
+// hasControlChars - whether the text contains control characters such as newlines
+func hasControlChars(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// metadataArg - read and validate a list of metadata entry inputs.
+//	* keys must match metadataKeyPattern and appear once; values are required, at most maxMetadataValueLength
+//	characters and on a single line
+func metadataArg(arg interface{}) (map[string]string, error) {
+	var entries []metadataEntry
+	if err := decodeInput(arg, &entries); err != nil {
+		return nil, errValidation(err.Error())
+	}
+	if len(entries) > maxMetadataEntries {
+		return nil, errValidation("too many metadata entries").withExtension("max", maxMetadataEntries)
+	}
+	metadata := map[string]string{}
+	for _, e := range entries {
+		if !metadataKeyPattern.MatchString(e.Key) {
+			return nil, errValidation("metadata keys start with a letter and only contain letters, digits, _ and -, up to 64 characters").
+				withExtension("key", e.Key)
+		}
+		if _, ok := metadata[e.Key]; ok {
+			return nil, errValidation("the metadata key is given more than once").withExtension("key", e.Key)
+		}
+		if e.Value == "" || len([]rune(e.Value)) > maxMetadataValueLength || hasControlChars(e.Value) {
+			return nil, errValidation("metadata values are required, on a single line and up to 1024 characters").
+				withExtension("key", e.Key)
+		}
+		metadata[e.Key] = e.Value
+	}
+	return metadata, nil
+}
+
+// tagsArg - read and normalize a list of tags: trimmed, lower cased, without duplicates and sorted
+func tagsArg(arg interface{}) ([]string, error) {
+	values, _ := arg.([]interface{})
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, value := range values {
+		tag, _ := value.(string)
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len([]rune(tag)) > maxTagLength || hasControlChars(tag) {
+			return nil, errValidation("tags are required, on a single line and up to 64 characters").withExtension("tag", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTags {
+		return nil, errValidation("too many tags").withExtension("max", maxTags)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// labelFilter - the metadata entries and tags a session or a file must all have to be listed
+type labelFilter struct {
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+}
+
+// labelFilterFrom - read the metadata and tags arguments of a list query or a mutation; omitted ones stay nil
+func labelFilterFrom(args map[string]interface{}) (labelFilter, error) {
+	var filter labelFilter
+	if arg, ok := args["metadata"]; ok && arg != nil {
+		metadata, err := metadataArg(arg)
+		if err != nil {
+			return filter, err
+		}
+		filter.Metadata = metadata
+	}
+	if arg, ok := args["tags"]; ok && arg != nil {
+		tags, err := tagsArg(arg)
+		if err != nil {
+			return filter, err
+		}
+		filter.Tags = tags
+	}
+	return filter, nil
+}
+
+// matches - whether the metadata and tags have every entry and tag of the filter
+func (f labelFilter) matches(metadata map[string]string, tags []string) bool {
+	for k, v := range f.Metadata {
+		if value, ok := metadata[k]; !ok || value != v {
+			return false
+		}
+	}
+	has := map[string]bool{}
+	for _, tag := range tags {
+		has[tag] = true
+	}
+	for _, tag := range f.Tags {
+		if !has[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// conditions - the dynamodb filter conditions matching the records with every entry and tag of the filter
+func (f labelFilter) conditions() []expression.ConditionBuilder {
+	var conds []expression.ConditionBuilder
+	keys := make([]string, 0, len(f.Metadata))
+	for k := range f.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		conds = append(conds, expression.Name("metadata."+k).Equal(expression.Value(f.Metadata[k])))
+	}
+	for _, tag := range f.Tags {
+		conds = append(conds, expression.Name("tags").Contains(tag))
+	}
+	return conds
+}
+
+// filterFiles - the files matching the filter
+func filterFiles(files []*file, filter labelFilter) []*file {
+	matching := []*file{}
+	for _, f := range files {
+		if filter.matches(f.Metadata, f.Tags) {
+			matching = append(matching, f)
+		}
+	}
+	return matching
+}
+
+// labelsUpdate - the update replacing the metadata and the tags that are given; empty ones are removed
+func labelsUpdate(metadata map[string]string, tags []string) expression.UpdateBuilder {
+	var update expression.UpdateBuilder
+	if metadata != nil {
+		if len(metadata) == 0 {
+			update = update.Remove(expression.Name("metadata"))
+		} else {
+			update = update.Set(expression.Name("metadata"), expression.Value(metadata))
+		}
+	}
+	if tags != nil {
+		if len(tags) == 0 {
+			update = update.Remove(expression.Name("tags"))
+		} else {
+			update = update.Set(expression.Name("tags"), expression.Value(tags))
+		}
+	}
+	return update
+}
+
+// setSessionMetadata - replace the metadata and/or the tags of the session; nil leaves them as they are.
+//	* the caller must have authorized the user as an editor of the session
+//	* closed and archived sessions can no longer be labeled
+func setSessionMetadata(sess *session, metadata map[string]string, tags []string, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*session, error) {
+	logger.WithFields(LOGGER.Fields{
+		"id":       *sess.ID,
+		"metadata": len(metadata),
+		"tags":     tags,
+	}).Info("setSessionMetadata() - replace the metadata and tags of the session")
+	if metadata == nil && tags == nil {
+		return nil, errValidation("metadata or tags are required")
+	}
+	if err := checkSessionWritable(sess); err != nil {
+		return nil, err
+	}
+	return saveSessionSettings(sess, labelsUpdate(metadata, tags), "metadata and tags", sessionTableName, dbAPI, logger)
+}
+
+// setFileMetadata - replace the metadata and/or the tags of the file; nil leaves them as they are.
+//	* the caller must have authorized the user as an editor of sess, the session of the file
+//	* the files of closed and archived sessions can no longer be labeled
+//	* every version of a file has its own metadata and tags; new versions start with those of the newest one
+func setFileMetadata(sess *session, f *file, metadata map[string]string, tags []string, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*file, error) {
+	logger.WithFields(LOGGER.Fields{
+		"file_id":  f.ID,
+		"metadata": len(metadata),
+		"tags":     tags,
+	}).Info("setFileMetadata() - replace the metadata and tags of the file")
+	if metadata == nil && tags == nil {
+		return nil, errValidation("metadata or tags are required")
+	}
+	if err := checkSessionWritable(sess); err != nil {
+		return nil, err
+	}
+	update := labelsUpdate(metadata, tags).Set(expression.Name("meta.meta__updated_at"), expression.Value(time.Now()))
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.Name("id").AttributeExists()).
+		Build()
+	if err != nil {
+		return nil, errInternal("unable to save the metadata and tags", err)
+	}
+	output, err := dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(filesTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(f.ID)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueAllNew,
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, errNotFound("no file exists with the given id")
+		}
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("setFileMetadata() - an error occurred while trying to save the metadata and tags")
+		return nil, errInternal("unable to save the metadata and tags", err)
+	}
+	var updated = new(file)
+	if err = dynamodbattribute.UnmarshalMap(output.Attributes, &updated); err != nil {
+		return nil, errInternal("unable to read the file", err)
+	}
+	return updated, nil
+}
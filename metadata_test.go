@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+// entriesArg - metadata entries as graphql passes an input list
+func entriesArg(kv ...string) []interface{} {
+	arg := []interface{}{}
+	for i := 0; i < len(kv); i += 2 {
+		arg = append(arg, map[string]interface{}{"key": kv[i], "value": kv[i+1]})
+	}
+	return arg
+}
+
+func TestMetadataArg(t *testing.T) {
+	metadata, err := metadataArg(entriesArg("project_code", "P-100", "patientId", "12345"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"project_code": "P-100", "patientId": "12345"}, metadata)
+	assert.Equal(t, []metadataEntry{{Key: "patientId", Value: "12345"}, {Key: "project_code", Value: "P-100"}}, metadataEntries(metadata))
+
+	metadata, err = metadataArg([]interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{}, metadata, "an empty list clears the metadata")
+
+	for _, invalid := range [][]interface{}{
+		entriesArg("1st", "x"),
+		entriesArg("doc.type", "x"),
+		entriesArg(strings.Repeat("k", 65), "x"),
+		entriesArg("type", ""),
+		entriesArg("type", "two\nlines"),
+		entriesArg("type", strings.Repeat("v", maxMetadataValueLength+1)),
+		entriesArg("type", "a", "type", "b"),
+	} {
+		_, err := metadataArg(invalid)
+		assert.NotNil(t, err, "%v", invalid)
+	}
+	var many []string
+	for i := 0; i <= maxMetadataEntries; i++ {
+		many = append(many, "k"+strings.Repeat("x", i), "v")
+	}
+	_, err = metadataArg(entriesArg(many...))
+	assert.NotNil(t, err)
+}
+
+func TestTagsArg(t *testing.T) {
+	tags, err := tagsArg([]interface{}{" Invoice ", "urgent", "invoice"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"invoice", "urgent"}, tags)
+	_, err = tagsArg([]interface{}{"  "})
+	assert.NotNil(t, err)
+	_, err = tagsArg([]interface{}{strings.Repeat("t", maxTagLength+1)})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{}, tagsOf(nil))
+}
+
+func TestLabelFilter(t *testing.T) {
+	filter, err := labelFilterFrom(map[string]interface{}{
+		"metadata": entriesArg("doc_type", "invoice"),
+		"tags":     []interface{}{"Urgent"},
+	})
+	assert.Nil(t, err)
+	assert.True(t, filter.matches(map[string]string{"doc_type": "invoice", "project": "p1"}, []string{"paid", "urgent"}))
+	assert.False(t, filter.matches(map[string]string{"doc_type": "receipt"}, []string{"urgent"}))
+	assert.False(t, filter.matches(map[string]string{"doc_type": "invoice"}, nil))
+	assert.True(t, labelFilter{}.matches(nil, nil))
+
+	f1 := &file{ID: "f1", Tags: []string{"urgent"}, Metadata: map[string]string{"doc_type": "invoice"}}
+	f2 := &file{ID: "f2", Tags: []string{"urgent"}}
+	assert.Equal(t, []*file{f1}, filterFiles([]*file{f1, f2}, filter))
+
+	// one condition per metadata entry and tag, combined with the other session filters
+	assert.Len(t, filter.conditions(), 2)
+	_, ok := sessionFilter{IncludeArchived: true, Labels: filter}.condition()
+	assert.True(t, ok)
+	_, ok = sessionFilter{IncludeArchived: true}.condition()
+	assert.False(t, ok)
+}
+
+func TestLabelsOfClosedSessionsRejected(t *testing.T) {
+	tags := []string{"urgent"}
+	for _, status := range []string{statusClosed, statusArchived} {
+		sess := &session{ID: aws.String("s1"), Email: "owner@example.com", Status: aws.String(status)}
+		db := &mockDynamo{}
+		_, err := setSessionMetadata(sess, nil, tags, "sessions", db, testLogger())
+		assert.Equal(t, codeConflict, codeOf(err), status)
+		_, err = setFileMetadata(sess, &file{ID: "f1", SessionID: "s1"}, nil, tags, "files", db, testLogger())
+		assert.Equal(t, codeConflict, codeOf(err), status)
+		assert.Empty(t, db.updates, "nothing is written")
+	}
+
+	// submitted sessions can still be labeled
+	sess := &session{ID: aws.String("s1"), Email: "owner@example.com", Status: aws.String(statusSubmitted)}
+	db := &mockDynamo{}
+	_, err := setFileMetadata(sess, &file{ID: "f1", SessionID: "s1"}, nil, tags, "files", db, testLogger())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"files"}, db.updates)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+// the migrations the migration worker can be invoked with, e.g.
+//	aws lambda invoke --function-name <migration worker> --payload '{"migration":"session_start_date"}' out.json
+const migrationSessionStartDates = "session_start_date"
+
+// runMigration - run the named maintenance migration
+func runMigration(name, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	switch name {
+	case migrationSessionStartDates:
+		_, err := migrateSessionStartDates(sessionTableName, dbAPI, logger)
+		return err
+	}
+	return errValidation("no migration exists with the given name").withExtension("migration", name)
+}
+
+// keyDateMigration - the stored form of a key date written before key dates were fixed width, and whether it
+// differs from the stored value; values that are not dates are left alone
+func keyDateMigration(stored string) (string, bool) {
+	t, err := time.Parse(time.RFC3339Nano, stored)
+	if err != nil {
+		return stored, false
+	}
+	migrated := formatKeyDate(t)
+	return migrated, migrated != stored
+}
+
+// migrateSessionStartDates - rewrite the start dates of the sessions stored before key dates were fixed width, so
+// the email index sorts them in time order.
+//	* every session is scanned; the migration is idempotent and can be re-run if it fails or runs out of time
+//	* each rewrite is conditional on the value read, so a session saved concurrently is left to that save
+func migrateSessionStartDates(sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (int, error) {
+	logger.WithFields(LOGGER.Fields{
+		"session_table_name": sessionTableName,
+	}).Info("migrateSessionStartDates() - rewrite the session start dates in the fixed width key format")
+	expr, err := expression.NewBuilder().
+		WithProjection(expression.NamesList(expression.Name("id"), expression.Name("email"), expression.Name("session_start_date"))).
+		Build()
+	if err != nil {
+		return 0, errInternal("unable to migrate the session start dates", err)
+	}
+	migrated := 0
+	var startKey map[string]dynamodb.AttributeValue
+	for {
+		output, err := dbAPI.ScanRequest(&dynamodb.ScanInput{
+			TableName:                aws.String(sessionTableName),
+			ProjectionExpression:     expr.Projection(),
+			ExpressionAttributeNames: expr.Names(),
+			ExclusiveStartKey:        startKey,
+		}).Send()
+		if err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"error": err.Error(),
+			}).Error("migrateSessionStartDates() - an error occurred while trying to scan the sessions")
+			return migrated, errInternal("unable to migrate the session start dates", err)
+		}
+		for _, item := range output.Items {
+			stored := item["session_start_date"].S
+			if stored == nil {
+				continue
+			}
+			value, ok := keyDateMigration(*stored)
+			if !ok {
+				continue
+			}
+			update, err := expression.NewBuilder().
+				WithUpdate(expression.Set(expression.Name("session_start_date"), expression.Value(value))).
+				WithCondition(expression.Name("session_start_date").Equal(expression.Value(*stored))).
+				Build()
+			if err != nil {
+				return migrated, errInternal("unable to migrate the session start dates", err)
+			}
+			_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+				TableName:                 aws.String(sessionTableName),
+				Key:                       map[string]dynamodb.AttributeValue{"id": item["id"], "email": item["email"]},
+				UpdateExpression:          update.Update(),
+				ConditionExpression:       update.Condition(),
+				ExpressionAttributeNames:  update.Names(),
+				ExpressionAttributeValues: update.Values(),
+			}).Send()
+			if err != nil {
+				if isConditionalCheckFailed(err) {
+					continue
+				}
+				logger.WithFields(LOGGER.Fields{
+					"id":    aws.StringValue(item["id"].S),
+					"error": err.Error(),
+				}).Error("migrateSessionStartDates() - an error occurred while trying to rewrite the start date")
+				return migrated, errInternal("unable to migrate the session start dates", err)
+			}
+			migrated++
+		}
+		startKey = output.LastEvaluatedKey
+		if len(startKey) == 0 {
+			break
+		}
+	}
+	logger.WithFields(LOGGER.Fields{
+		"migrated": migrated,
+	}).Info("migrateSessionStartDates() - the session start dates were migrated")
+	return migrated, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatKeyDate(t *testing.T) {
+	whole := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+	fraction := whole.Add(500 * time.Millisecond)
+	assert.Equal(t, "2019-05-01T10:00:00.000000000Z", formatKeyDate(whole))
+	assert.Equal(t, "2019-05-01T10:00:00.500000000Z", formatKeyDate(fraction))
+	assert.True(t, formatKeyDate(whole) < formatKeyDate(fraction), "key dates sort in time order")
+	offset := time.FixedZone("CEST", 2*60*60)
+	assert.Equal(t, "2019-05-01T10:00:00.000000000Z", formatKeyDate(whole.In(offset)))
+}
+
+func TestKeyDateMigration(t *testing.T) {
+	migrated, ok := keyDateMigration("2019-05-01T10:00:00.5Z")
+	assert.True(t, ok)
+	assert.Equal(t, "2019-05-01T10:00:00.500000000Z", migrated)
+	migrated, ok = keyDateMigration("2019-05-01T12:00:00+02:00")
+	assert.True(t, ok)
+	assert.Equal(t, "2019-05-01T10:00:00.000000000Z", migrated)
+	_, ok = keyDateMigration("2019-05-01T10:00:00.000000000Z")
+	assert.False(t, ok, "already migrated")
+	_, ok = keyDateMigration("not a date")
+	assert.False(t, ok)
+	assert.NotNil(t, runMigration("unknown", "sessions", nil, nil))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+// usage record id prefixes: the usage of a user across every session, and the usage of a single session
+const (
+	userUsagePrefix    = "user#"
+	sessionUsagePrefix = "session#"
+)
+
+// quota - storage limits; a limit of 0 is unlimited
+type quota struct {
+	MaxBytes    int64 `json:"max_bytes"`
+	MaxFiles    int64 `json:"max_files"`
+	MaxFileSize int64 `json:"max_file_size"`
+}
+
+// quotaConfig - the configured quotas, read from the QUOTAS env variable as json.
+//	* Roles: the limits of a user's total usage, chosen by the role the user uploads into a session with; uploads
+//	through an upload link are charged to the session owner
+//	* Session: the limits of every session
+type quotaConfig struct {
+	Roles   map[string]quota `json:"roles"`
+	Session quota            `json:"session"`
+}
+
+// parseQuotas - read the quota configuration; no configuration means no limits
+func parseQuotas(raw string) (*quotaConfig, error) {
+	q := &quotaConfig{Roles: map[string]quota{}}
+	if raw == "" {
+		return q, nil
+	}
+	if err := json.Unmarshal([]byte(raw), q); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", quotasKey, err.Error())
+	}
+	for role := range q.Roles {
+		if _, ok := roleRank[role]; !ok {
+			return nil, fmt.Errorf("invalid %s: unknown role %s", quotasKey, role)
+		}
+	}
+	if q.Roles == nil {
+		q.Roles = map[string]quota{}
+	}
+	return q, nil
+}
+
+// usage - the storage counters of a user or a session.
+//	* ReservedBytes and Files count every upload from the moment its url is issued, so concurrent uploads cannot
+//	overrun a quota; StoredBytes only counts uploads that completed
+type usage struct {
+	ID            string `json:"id"`
+	ReservedBytes int64  `json:"reserved_bytes"`
+	StoredBytes   int64  `json:"stored_bytes"`
+	Files         int64  `json:"files"`
+}
+
+func userUsageID(email string) string {
+	return userUsagePrefix + email
+}
+
+func sessionUsageID(sessionID string) string {
+	return sessionUsagePrefix + sessionID
+}
+
+// checkFileSize - verify a single file fits the max file size of the quota
+func checkFileSize(q quota, size int64, scope string) error {
+	if q.MaxFileSize > 0 && size > q.MaxFileSize {
+		return errValidation(fmt.Sprintf("the file is larger than the %d bytes allowed per file", q.MaxFileSize)).
+			withExtension("quota", scope).
+			withExtension("maxFileSize", q.MaxFileSize)
+	}
+	return nil
+}
+
+// reserveUsage - count a new upload against the usage record, failing if it would exceed the quota.
+//	* the limits are checked in the condition of the same update that increments the counters, as with upload links
+func reserveUsage(id string, q quota, size int64, scope, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	if err := checkFileSize(q, size, scope); err != nil {
+		return err
+	}
+	exceeded := errConflict("the upload would exceed the "+scope+" storage quota").
+		withExtension("quota", scope).
+		withExtension("maxBytes", q.MaxBytes).
+		withExtension("maxFiles", q.MaxFiles)
+	if q.MaxBytes > 0 && size > q.MaxBytes {
+		return exceeded
+	}
+	update := expression.Add(expression.Name("reserved_bytes"), expression.Value(size)).
+		Add(expression.Name("files"), expression.Value(1))
+	builder := expression.NewBuilder().WithUpdate(update)
+	var conds []expression.ConditionBuilder
+	if q.MaxBytes > 0 {
+		conds = append(conds, expression.Or(
+			expression.Name("reserved_bytes").AttributeNotExists(),
+			expression.Name("reserved_bytes").LessThanEqual(expression.Value(q.MaxBytes-size)),
+		))
+	}
+	if q.MaxFiles > 0 {
+		conds = append(conds, expression.Or(
+			expression.Name("files").AttributeNotExists(),
+			expression.Name("files").LessThan(expression.Value(q.MaxFiles)),
+		))
+	}
+	switch len(conds) {
+	case 1:
+		builder = builder.WithCondition(conds[0])
+	case 2:
+		builder = builder.WithCondition(expression.And(conds[0], conds[1]))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return errInternal("unable to check the storage quota", err)
+	}
+	_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(usageTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return exceeded
+		}
+		logger.WithFields(LOGGER.Fields{
+			"usage_id": id,
+			"error":    err.Error(),
+		}).Error("reserveUsage() - an error occurred while trying to update the usage counters")
+		return errInternal("unable to check the storage quota", err)
+	}
+	return nil
+}
+
+// addUsage - adjust the counters of a usage record; best effort, failures are logged
+func addUsage(id string, reservedBytes, storedBytes, files int64, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) {
+	update := expression.Add(expression.Name("reserved_bytes"), expression.Value(reservedBytes)).
+		Add(expression.Name("stored_bytes"), expression.Value(storedBytes)).
+		Add(expression.Name("files"), expression.Value(files))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err == nil {
+		_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(usageTableName),
+			Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+			UpdateExpression:          expr.Update(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		}).Send()
+	}
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"usage_id": id,
+			"error":    err.Error(),
+		}).Warn("addUsage() - unable to update the usage counters")
+	}
+}
+
+// fileUsageIDs - the usage records a file is counted in
+func fileUsageIDs(f *file) []string {
+	ids := []string{sessionUsageID(f.SessionID)}
+	if f.ChargedTo != "" {
+		ids = append(ids, userUsageID(f.ChargedTo))
+	}
+	return ids
+}
+
+// reserveUpload - count a new file against the quota of the user it is charged to and of its session.
+//	* role is the role the user uploads with; its quota applies to the user's total usage
+func reserveUpload(f *file, role string, quotas *quotaConfig, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	if err := checkFileSize(quotas.Roles[role], f.Size, "user"); err != nil {
+		return err
+	}
+	if err := checkFileSize(quotas.Session, f.Size, "session"); err != nil {
+		return err
+	}
+	if err := reserveUsage(userUsageID(f.ChargedTo), quotas.Roles[role], f.Size, "user", usageTableName, dbAPI, logger); err != nil {
+		return err
+	}
+	if err := reserveUsage(sessionUsageID(f.SessionID), quotas.Session, f.Size, "session", usageTableName, dbAPI, logger); err != nil {
+		addUsage(userUsageID(f.ChargedTo), -f.Size, 0, -1, usageTableName, dbAPI, logger)
+		return err
+	}
+	return nil
+}
+
+// releaseUpload - stop counting a file that was rejected, deleted or never created.
+//	* rejected files were released when they were rejected, so they are not released again
+func releaseUpload(f *file, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) {
+	var stored int64
+	switch f.Status {
+	case fileStatusComplete:
+		stored = -f.Size
+	case fileStatusPending:
+	default:
+		return
+	}
+	for _, id := range fileUsageIDs(f) {
+		addUsage(id, -f.Size, stored, -1, usageTableName, dbAPI, logger)
+	}
+}
+
+// commitUpload - count the content of a completed upload as stored
+func commitUpload(f *file, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) {
+	for _, id := range fileUsageIDs(f) {
+		addUsage(id, 0, f.Size, 0, usageTableName, dbAPI, logger)
+	}
+}
+
+// findUsage - find the usage record of the id; a record that does not exist yet is empty
+func findUsage(id, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*usage, error) {
+	output, err := dbAPI.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(usageTableName),
+		Key:       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"usage_id": id,
+			"error":    err.Error(),
+		}).Error("findUsage() - an error occurred while trying to find the usage record")
+		return nil, errInternal("unable to look up the storage usage", err)
+	}
+	var u = &usage{ID: id}
+	if len(output.Item) == 0 {
+		return u, nil
+	}
+	if err = dynamodbattribute.UnmarshalMap(output.Item, &u); err != nil {
+		return nil, errInternal("unable to read the storage usage", err)
+	}
+	return u, nil
+}
+
+// deleteUsage - delete the usage record of a deleted session
+func deleteUsage(id, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	_, err := dbAPI.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		TableName: aws.String(usageTableName),
+		Key:       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"usage_id": id,
+			"error":    err.Error(),
+		}).Error("deleteUsage() - an error occurred while trying to delete the usage record")
+		return errInternal("unable to delete the storage usage", err)
+	}
+	return nil
+}
+
+// myUsage - the storage usage of the user with the quotas of each role
+func myUsage(email string, quotas *quotaConfig, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*userUsage, error) {
+	logger.WithFields(LOGGER.Fields{
+		"email": email,
+	}).Info("myUsage() - find the storage usage of the user")
+	u, err := findUsage(userUsageID(email), usageTableName, dbAPI, logger)
+	if err != nil {
+		return nil, err
+	}
+	result := &userUsage{
+		Email:         email,
+		ReservedBytes: u.ReservedBytes,
+		StoredBytes:   u.StoredBytes,
+		Files:         u.Files,
+		Quotas:        []roleQuota{},
+		SessionQuota:  quotas.Session,
+	}
+	for _, role := range []string{roleOwner, roleEditor} {
+		q := quotas.Roles[role]
+		result.Quotas = append(result.Quotas, roleQuota{Role: role, MaxBytes: q.MaxBytes, MaxFiles: q.MaxFiles, MaxFileSize: q.MaxFileSize})
+	}
+	return result, nil
+}
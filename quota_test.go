@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuotas(t *testing.T) {
+	q, err := parseQuotas("")
+	assert.Nil(t, err)
+	assert.Equal(t, quota{}, q.Roles[roleEditor], "no configuration is unlimited")
+
+	q, err = parseQuotas(`{"roles":{"OWNER":{"max_bytes":1000,"max_files":10},"EDITOR":{"max_file_size":100}},"session":{"max_files":5}}`)
+	assert.Nil(t, err)
+	assert.Equal(t, quota{MaxBytes: 1000, MaxFiles: 10}, q.Roles[roleOwner])
+	assert.Equal(t, quota{MaxFileSize: 100}, q.Roles[roleEditor])
+	assert.Equal(t, quota{MaxFiles: 5}, q.Session)
+
+	_, err = parseQuotas(`{"roles":{"ADMIN":{"max_bytes":1}}}`)
+	assert.NotNil(t, err)
+	_, err = parseQuotas(`{"roles":`)
+	assert.NotNil(t, err)
+}
+
+func TestFileUsage(t *testing.T) {
+	assert.Nil(t, checkFileSize(quota{}, 1<<40, "user"))
+	assert.Nil(t, checkFileSize(quota{MaxFileSize: 100}, 100, "user"))
+	err := checkFileSize(quota{MaxFileSize: 100}, 101, "session")
+	assert.NotNil(t, err)
+	assert.Equal(t, codeValidation, err.(*serviceError).code)
+
+	// link uploads are charged to the session owner; files from before quotas only count against their session
+	f := &file{SessionID: "s1", ChargedTo: "owner@example.com"}
+	assert.Equal(t, []string{"session#s1", "user#owner@example.com"}, fileUsageIDs(f))
+	assert.Equal(t, []string{"session#s1"}, fileUsageIDs(&file{SessionID: "s1"}))
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+const (
+	// sanitizedKeyPrefix - sanitized content is stored outside the sessions/ prefix, so storing it does not trigger
+	// another upload event
+	sanitizedKeyPrefix  = "sanitized/"
+	sanitizeStripMethod = "strip-metadata"
+	maxSanitizeBytes    = 100 << 20
+)
+
+// the metadata blocks stripping removes; GPS coordinates are stored inside the exif block
+const (
+	metadataExif    = "exif"
+	metadataXMP     = "xmp"
+	metadataIPTC    = "iptc"
+	metadataComment = "comment"
+	metadataText    = "text"
+	metadataApp1    = "app1"
+)
+
+var (
+	errMalformedJPEG = errors.New("malformed jpeg")
+	errMalformedPNG  = errors.New("malformed png")
+	pngSignature     = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader       = []byte("Exif\x00")
+	xmpHeaders       = [][]byte{[]byte("http://ns.adobe.com/xap/1.0/\x00"), []byte("http://ns.adobe.com/xmp/extension/\x00")}
+)
+
+// sanitizedKey - the s3 key the sanitized content of an upload is stored under: sanitized/{key}
+func sanitizedKey(key string) string {
+	return sanitizedKeyPrefix + key
+}
+
+// addRemoved - add the metadata block to the removed ones once
+func addRemoved(removed []string, block string) []string {
+	for _, r := range removed {
+		if r == block {
+			return removed
+		}
+	}
+	return append(removed, block)
+}
+
+// exifOrientation - the orientation (1 to 8) in IFD0 of an exif APP1 payload; 0 when it has none
+func exifOrientation(payload []byte) int {
+	tiff := payload[len(exifHeader):]
+	if len(tiff) > 0 && tiff[0] == 0 {
+		// the exif header is followed by a padding byte
+		tiff = tiff[1:]
+	}
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int64(order.Uint32(tiff[4:]))
+	if ifd+2 > int64(len(tiff)) {
+		return 0
+	}
+	count := int64(order.Uint16(tiff[ifd:]))
+	for e := ifd + 2; e+12 <= int64(len(tiff)) && e < ifd+2+count*12; e += 12 {
+		// tag 0x0112, a single SHORT
+		if order.Uint16(tiff[e:]) == 0x0112 && order.Uint16(tiff[e+2:]) == 3 && order.Uint32(tiff[e+4:]) == 1 {
+			if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orientationExif - a minimal exif APP1 payload holding only the orientation
+func orientationExif(orientation int) []byte {
+	payload := append([]byte{}, exifHeader...)
+	payload = append(payload, 0, 'M', 'M', 0, 0x2a, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1)
+	return append(payload, byte(orientation>>8), byte(orientation), 0, 0, 0, 0, 0, 0)
+}
+
+// stripJPEG - the jpeg without its metadata segments, with the metadata blocks removed and the exif orientation
+// kept.
+//	* APP1 (exif, xmp), APP13 (iptc) and COM segments are dropped; every other segment and the compressed image data
+//	are copied as they are, so the image is not re-encoded
+//	* viewers rotate the image by its exif orientation, so an orientation other than 1 is kept in a minimal exif
+//	segment in place of the one dropped; exif holding nothing else is left as it is and not reported as removed
+func stripJPEG(b []byte) ([]byte, []string, int, error) {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil, nil, 0, errMalformedJPEG
+	}
+	var out bytes.Buffer
+	out.Write(b[:2])
+	removed := []string{}
+	orientation := 0
+	for i := 2; i < len(b); {
+		if b[i] != 0xff {
+			return nil, nil, 0, errMalformedJPEG
+		}
+		// markers may be preceded by any number of fill bytes
+		for i+1 < len(b) && b[i+1] == 0xff {
+			i++
+		}
+		if i+1 >= len(b) {
+			return nil, nil, 0, errMalformedJPEG
+		}
+		marker := b[i+1]
+		switch {
+		case marker == 0xda || marker == 0xd9:
+			// start of scan or end of image: the rest is image data
+			out.Write(b[i:])
+			return out.Bytes(), removed, orientation, nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			out.Write(b[i : i+2])
+			i += 2
+			continue
+		}
+		if i+4 > len(b) {
+			return nil, nil, 0, errMalformedJPEG
+		}
+		end := i + 2 + (int(b[i+2])<<8 | int(b[i+3]))
+		if end < i+4 || end > len(b) {
+			return nil, nil, 0, errMalformedJPEG
+		}
+		payload := b[i+4 : end]
+		switch marker {
+		case 0xe1:
+			block := metadataApp1
+			if bytes.HasPrefix(payload, exifHeader) {
+				block = metadataExif
+				if o := exifOrientation(payload); o > 1 && orientation == 0 {
+					orientation = o
+					kept := orientationExif(o)
+					out.Write(jpegSegmentHeader(0xe1, len(kept)))
+					out.Write(kept)
+					if bytes.Equal(payload, kept) {
+						i = end
+						continue
+					}
+				}
+			}
+			for _, h := range xmpHeaders {
+				if bytes.HasPrefix(payload, h) {
+					block = metadataXMP
+				}
+			}
+			removed = addRemoved(removed, block)
+		case 0xed:
+			removed = addRemoved(removed, metadataIPTC)
+		case 0xfe:
+			removed = addRemoved(removed, metadataComment)
+		default:
+			out.Write(b[i:end])
+		}
+		i = end
+	}
+	return nil, nil, 0, errMalformedJPEG
+}
+
+// stripPNG - the png without its metadata chunks, with the metadata blocks removed.
+//	* eXIf and the textual chunks (tEXt, zTXt, iTXt, which also carry xmp) are dropped; every other chunk is copied
+//	with its crc as it is
+func stripPNG(b []byte) ([]byte, []string, error) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return nil, nil, errMalformedPNG
+	}
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	removed := []string{}
+	for i := len(pngSignature); i+12 <= len(b); {
+		length := int64(binary.BigEndian.Uint32(b[i:]))
+		end := int64(i) + 12 + length
+		if end > int64(len(b)) {
+			return nil, nil, errMalformedPNG
+		}
+		chunk := b[i:end]
+		switch typ := string(chunk[4:8]); typ {
+		case "eXIf":
+			removed = addRemoved(removed, metadataExif)
+		case "iTXt":
+			if bytes.HasPrefix(chunk[8:], []byte("XML:com.adobe.xmp\x00")) {
+				removed = addRemoved(removed, metadataXMP)
+			} else {
+				removed = addRemoved(removed, metadataText)
+			}
+		case "tEXt", "zTXt":
+			removed = addRemoved(removed, metadataText)
+		default:
+			out.Write(chunk)
+			if typ == "IEND" {
+				return out.Bytes(), removed, nil
+			}
+		}
+		i = int(end)
+	}
+	return nil, nil, errMalformedPNG
+}
+
+// jpegSegmentHeader - the marker and the length of a jpeg segment with a payload of the size
+func jpegSegmentHeader(marker byte, size int) []byte {
+	return []byte{0xff, marker, byte((size + 2) >> 8), byte(size + 2)}
+}
+
+// stripMetadata - the image without its metadata, for the image types that can be stripped, and the exif
+// orientation kept in it; 0 when none was kept
+func stripMetadata(content []byte, contentType string) ([]byte, []string, int, error) {
+	if contentType == "image/png" {
+		stripped, removed, err := stripPNG(content)
+		return stripped, removed, 0, err
+	}
+	return stripJPEG(content)
+}
+
+// sanitizes - whether the session sanitizes content of the sniffed type
+func sanitizes(sess *session, sniffed string) bool {
+	return sess != nil && sess.Sanitize != nil && sess.Sanitize.StripMetadata && (sniffed == "image/jpeg" || sniffed == "image/png")
+}
+
+// sanitizeUpload - rewrite a completed jpeg or png upload without its metadata, for sessions that opted in.
+//	* the sanitized content is stored under sanitized/ and the file record points at it from then on; its size,
+//	etag and checksum describe the sanitized content and the usage counters are adjusted to its size
+//	* the uploaded original is deleted unless the session keeps originals
+//	* the sanitization that ran is recorded on the file even when the image had no metadata, in which case the
+//	content is left where it was uploaded
+func sanitizeUpload(f *file, sess *session, bucketName, filesTableName, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) error {
+	if f.SniffedType == nil || f.BlobHash != nil || !sanitizes(sess, *f.SniffedType) || f.Sanitization != nil {
+		return nil
+	}
+	logger.WithFields(LOGGER.Fields{
+		"file_id": f.ID,
+	}).Info("sanitizeUpload() - strip the metadata of the uploaded image")
+	now := time.Now()
+	result := &fileSanitization{Method: sanitizeStripMethod, Removed: []string{}, OriginalKey: f.Key, OriginalSize: f.Size, SanitizedAt: now}
+	if f.Size > maxSanitizeBytes {
+		result.Skipped = aws.String("the image is too large to sanitize")
+		return saveSanitization(f, result, nil, filesTableName, dbAPI, logger)
+	}
+	output, err := s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(f.Key),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("sanitizeUpload() - an error occurred while trying to read the uploaded image")
+		return errInternal("unable to read the uploaded image", err)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(output.Body, maxSanitizeBytes))
+	output.Body.Close()
+	if err != nil {
+		return errInternal("unable to read the uploaded image", err)
+	}
+	stripped, removed, orientation, err := stripMetadata(content, *f.SniffedType)
+	if err != nil {
+		result.Skipped = aws.String("the image cannot be parsed: " + err.Error())
+		return saveSanitization(f, result, nil, filesTableName, dbAPI, logger)
+	}
+	result.Removed = removed
+	if orientation > 0 {
+		result.Orientation = aws.Int64(int64(orientation))
+	}
+	if len(removed) == 0 {
+		return saveSanitization(f, result, nil, filesTableName, dbAPI, logger)
+	}
+	key := sanitizedKey(f.Key)
+	put, err := s3API.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(stripped),
+		ContentType: aws.String(f.ContentType),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("sanitizeUpload() - an error occurred while trying to store the sanitized image")
+		return errInternal("unable to store the sanitized image", err)
+	}
+	result.OriginalKept = sess.Sanitize.KeepOriginal
+	sanitized := &file{Key: key, Size: int64(len(stripped)), ETag: put.ETag}
+	if f.Checksum != nil {
+		value, _ := computeChecksum(bytes.NewReader(stripped), f.Checksum.Algorithm)
+		sanitized.Checksum = &fileChecksum{Algorithm: f.Checksum.Algorithm, Value: value, VerifiedAt: &now}
+	}
+	original, originalSize := f.Key, f.Size
+	if err := saveSanitization(f, result, sanitized, filesTableName, dbAPI, logger); err != nil {
+		return err
+	}
+	remove := original
+	if f.Sanitization == nil {
+		// the file was deleted or sanitized concurrently; the content just stored is not referenced
+		remove = key
+	} else {
+		for _, id := range fileUsageIDs(f) {
+			addUsage(id, f.Size-originalSize, f.Size-originalSize, 0, usageTableName, dbAPI, logger)
+		}
+		if result.OriginalKept {
+			return nil
+		}
+	}
+	_, err = s3API.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(remove),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("sanitizeUpload() - an error occurred while trying to delete the original image")
+		return errInternal("unable to delete the original image", err)
+	}
+	return nil
+}
+
+// saveSanitization - record the sanitization on the file, along with the key, size, etag and checksum of the
+// sanitized content when it was stored.
+//	* the update is conditional on the record still pointing at the uploaded content; a record deleted or changed in
+//	the meantime is left as it is and the file is not marked sanitized
+func saveSanitization(f *file, result *fileSanitization, sanitized *file, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	update := expression.Set(expression.Name("sanitization"), expression.Value(result))
+	if sanitized != nil {
+		update = update.Set(expression.Name("key"), expression.Value(sanitized.Key)).
+			Set(expression.Name("size"), expression.Value(sanitized.Size))
+		if sanitized.ETag != nil {
+			update = update.Set(expression.Name("etag"), expression.Value(*sanitized.ETag))
+		}
+		if sanitized.Checksum != nil {
+			update = update.Set(expression.Name("checksum"), expression.Value(sanitized.Checksum))
+		}
+	}
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.Name("key").Equal(expression.Value(f.Key))).
+		Build()
+	if err != nil {
+		return errInternal("unable to save the sanitization", err)
+	}
+	_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(filesTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(f.ID)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil
+		}
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("saveSanitization() - an error occurred while trying to save the sanitization")
+		return errInternal("unable to save the sanitization", err)
+	}
+	f.Sanitization = result
+	if sanitized != nil {
+		f.Key, f.Size, f.ETag, f.Checksum = sanitized.Key, sanitized.Size, sanitized.ETag, sanitized.Checksum
+	}
+	return nil
+}
+
+// deleteOriginal - delete the original upload of a sanitized file.
+//	* the original is only left in s3 when the session kept it, or when it was uploaded again through the same url
+//	after being sanitized; deleting a key that is already gone is not an error
+func deleteOriginal(f *file, bucketName string, s3API s3iface.S3API, logger *LOGGER.Entry) error {
+	if f.Sanitization == nil || f.Sanitization.OriginalKey == f.Key {
+		return nil
+	}
+	_, err := s3API.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(f.Sanitization.OriginalKey),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("deleteOriginal() - an error occurred while trying to delete the original image")
+		return errInternal("unable to delete the original image", err)
+	}
+	return nil
+}
+
+// setSessionSanitization - replace the sanitization uploaded images of the session go through.
+//	* the caller must have authorized the user as the owner of the session
+//	* files already uploaded are not sanitized; the originals of files sanitized before are kept or deleted as they were
+func setSessionSanitization(sess *session, settings sanitizeSettings, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*session, error) {
+	logger.WithFields(LOGGER.Fields{
+		"id":       *sess.ID,
+		"settings": settings,
+	}).Info("setSessionSanitization() - replace the sanitization settings of the session")
+	if settings.KeepOriginal && !settings.StripMetadata {
+		return nil, errValidation("keepOriginal only applies when stripMetadata is set")
+	}
+	update := expression.Set(expression.Name("sanitize"), expression.Value(settings))
+	return saveSessionSettings(sess, update, "sanitization settings", sessionTableName, dbAPI, logger)
+}
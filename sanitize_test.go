@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// jpegSegment - a jpeg marker segment with the payload
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// pngChunk - a png chunk of the type with the payload and its crc
+func pngChunk(typ string, payload []byte) []byte {
+	chunk := make([]byte, 4, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	chunk = append(append(chunk, typ...), payload...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	var clean bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&clean, image.NewGray(image.Rect(0, 0, 16, 16)), nil))
+	var tagged []byte
+	tagged = append(tagged, clean.Bytes()[:2]...)
+	tagged = append(tagged, jpegSegment(0xe1, append([]byte("Exif\x00\x00"), "GPS 51.5N 0.1W"...))...)
+	tagged = append(tagged, jpegSegment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))...)
+	tagged = append(tagged, jpegSegment(0xfe, []byte("taken by alice"))...)
+	tagged = append(tagged, clean.Bytes()[2:]...)
+
+	stripped, removed, orientation, err := stripMetadata(tagged, "image/jpeg")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{metadataExif, metadataXMP, metadataComment}, removed)
+	assert.Equal(t, 0, orientation, "the exif has no orientation")
+	assert.Equal(t, clean.Bytes(), stripped)
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	assert.Nil(t, err)
+
+	stripped, removed, _, err = stripJPEG(clean.Bytes())
+	assert.Nil(t, err)
+	assert.Empty(t, removed)
+	assert.Equal(t, clean.Bytes(), stripped)
+
+	_, _, _, err = stripJPEG([]byte("not a jpeg"))
+	assert.Equal(t, errMalformedJPEG, err)
+	_, _, _, err = stripJPEG(append([]byte{0xff, 0xd8}, jpegSegment(0xe1, []byte("Exif\x00"))[:5]...))
+	assert.Equal(t, errMalformedJPEG, err, "a segment longer than the content")
+}
+
+// littleEndianExif - an exif APP1 payload in intel byte order with the orientation and a gps info pointer in IFD0
+func littleEndianExif(orientation uint16) []byte {
+	tiff := []byte("II\x2a\x00\x08\x00\x00\x00\x02\x00")
+	entry := make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry, 0x8825)
+	binary.LittleEndian.PutUint16(entry[2:], 4)
+	binary.LittleEndian.PutUint32(entry[4:], 1)
+	binary.LittleEndian.PutUint32(entry[8:], 38)
+	tiff = append(tiff, entry...)
+	binary.LittleEndian.PutUint16(entry, 0x0112)
+	binary.LittleEndian.PutUint16(entry[2:], 3)
+	binary.LittleEndian.PutUint32(entry[8:], uint32(orientation))
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0)
+	return append([]byte("Exif\x00\x00"), append(tiff, "GPS 51.5N 0.1W"...)...)
+}
+
+func TestStripJPEGKeepsOrientation(t *testing.T) {
+	var clean bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&clean, image.NewGray(image.Rect(0, 0, 16, 8)), nil))
+	var tagged []byte
+	tagged = append(tagged, clean.Bytes()[:2]...)
+	tagged = append(tagged, jpegSegment(0xe1, littleEndianExif(6))...)
+	tagged = append(tagged, clean.Bytes()[2:]...)
+
+	stripped, removed, orientation, err := stripJPEG(tagged)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{metadataExif}, removed, "everything but the orientation is removed")
+	assert.Equal(t, 6, orientation)
+	assert.Equal(t, 6, exifOrientation(orientationExif(6)))
+	assert.Equal(t, append(append(clean.Bytes()[:2:2], jpegSegment(0xe1, orientationExif(6))...), clean.Bytes()[2:]...), stripped)
+	assert.NotContains(t, string(stripped), "GPS")
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	assert.Nil(t, err)
+
+	// stripping again finds nothing more to remove
+	again, removed, orientation, err := stripJPEG(stripped)
+	assert.Nil(t, err)
+	assert.Empty(t, removed)
+	assert.Equal(t, 6, orientation)
+	assert.Equal(t, stripped, again)
+
+	// an upright image needs no orientation
+	tagged = append(append(clean.Bytes()[:2:2], jpegSegment(0xe1, littleEndianExif(1))...), clean.Bytes()[2:]...)
+	stripped, _, orientation, err = stripJPEG(tagged)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, orientation)
+	assert.Equal(t, clean.Bytes(), stripped)
+}
+
+func TestStripPNG(t *testing.T) {
+	var clean bytes.Buffer
+	assert.Nil(t, png.Encode(&clean, image.NewGray(image.Rect(0, 0, 16, 16))))
+	ihdrEnd := len(pngSignature) + 12 + 13
+	var tagged []byte
+	tagged = append(tagged, clean.Bytes()[:ihdrEnd]...)
+	tagged = append(tagged, pngChunk("eXIf", []byte("MM\x00\x2a"))...)
+	tagged = append(tagged, pngChunk("tEXt", []byte("Author\x00alice"))...)
+	tagged = append(tagged, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))...)
+	tagged = append(tagged, clean.Bytes()[ihdrEnd:]...)
+
+	stripped, removed, _, err := stripMetadata(tagged, "image/png")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{metadataExif, metadataText, metadataXMP}, removed)
+	assert.Equal(t, clean.Bytes(), stripped)
+	_, err = png.Decode(bytes.NewReader(stripped))
+	assert.Nil(t, err)
+
+	_, _, err = stripPNG(clean.Bytes()[:ihdrEnd])
+	assert.Equal(t, errMalformedPNG, err, "no IEND chunk")
+	_, _, err = stripPNG([]byte("GIF89a"))
+	assert.Equal(t, errMalformedPNG, err)
+}
+
+func TestSanitizes(t *testing.T) {
+	sess := &session{Sanitize: &sanitizeSettings{StripMetadata: true}}
+	assert.True(t, sanitizes(sess, "image/jpeg"))
+	assert.True(t, sanitizes(sess, "image/png"))
+	assert.False(t, sanitizes(sess, "image/gif"))
+	assert.False(t, sanitizes(&session{}, "image/jpeg"))
+	assert.False(t, sanitizes(&session{Sanitize: &sanitizeSettings{}}, "image/jpeg"))
+	assert.Equal(t, "sanitized/sessions/s1/f1/a.jpg", sanitizedKey(uploadKey("s1", "f1", "a.jpg")))
+}
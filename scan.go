@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+// malware scan statuses of a file; only CLEAN files can be downloaded
+const (
+	scanStatusPending  = "PENDING"
+	scanStatusClean    = "CLEAN"
+	scanStatusInfected = "INFECTED"
+	scanStatusError    = "ERROR"
+	// the content is larger than the scanner accepts, so it was not scanned and cannot be downloaded
+	scanStatusTooLarge = "TOO_LARGE"
+)
+
+const (
+	// fakeScannerAddress - the scanner address that selects the fake scanner, for tests and local runs without clamd
+	fakeScannerAddress = "fake"
+	clamdChunkSize     = 64 * 1024
+	clamdTimeout       = 30 * time.Second
+	// defaultClamdStreamMaxLength - the StreamMaxLength clamd is configured with by default (25 MiB)
+	defaultClamdStreamMaxLength = 25 << 20
+)
+
+// eicarSignature - the start of the EICAR test file every scanner reports as infected
+var eicarSignature = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!`)
+
+// scanner - scans file content for malware.
+//	* scan returns the name of the malware found, or an empty string for clean content
+//	* maxSize is the largest content the scanner accepts, in bytes; 0 when it accepts any size
+type scanner interface {
+	scan(r io.Reader) (string, error)
+	maxSize() int64
+}
+
+// newScanner - the scanner at the address: host:port of a clamd daemon accepting streams up to maxLength bytes, or
+// fake; nil when no address is configured
+func newScanner(address string, maxLength int64) scanner {
+	switch address {
+	case "":
+		return nil
+	case fakeScannerAddress:
+		return fakeScanner{}
+	}
+	return &clamdScanner{address: address, timeout: clamdTimeout, maxLength: maxLength}
+}
+
+// parseStreamMaxLength - read the StreamMaxLength the clamd daemon is configured with; clamd's default when not
+// configured
+func parseStreamMaxLength(raw string) (int64, error) {
+	if raw == "" {
+		return defaultClamdStreamMaxLength, nil
+	}
+	length, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || length < 1 {
+		return 0, errValidation("the clamd stream max length must be a number of bytes greater than 0")
+	}
+	return length, nil
+}
+
+// clamdScanner - scans content with a clamd daemon over tcp using the INSTREAM command.
+//	* the content is sent in length prefixed chunks and the daemon replies once the zero length chunk ends the stream
+//	* clamd refuses streams longer than its StreamMaxLength; maxLength must match it so larger content is not sent
+type clamdScanner struct {
+	address   string
+	timeout   time.Duration // the most time to wait for each chunk and the reply
+	maxLength int64
+}
+
+func (s *clamdScanner) maxSize() int64 {
+	return s.maxLength
+}
+
+func (s *clamdScanner) scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	write := func(b []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		_, err := conn.Write(b)
+		return err
+	}
+	sendErr := write([]byte("zINSTREAM\x00"))
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for sendErr == nil {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if sendErr = write(size); sendErr == nil {
+				sendErr = write(buf[:n])
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if sendErr == nil {
+		sendErr = write([]byte{0, 0, 0, 0})
+	}
+	// clamd replies before closing the connection when it refuses a stream, so the reply explains a failed send
+	conn.SetReadDeadline(time.Now().Add(s.timeout))
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if sendErr != nil {
+			return "", sendErr
+		}
+		return "", err
+	}
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply - read the verdict of a clamd INSTREAM reply: "stream: OK", "stream: {name} FOUND" or
+// "{message} ERROR"
+func parseClamdReply(reply string) (string, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	verdict := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case verdict == "OK":
+		return "", nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return strings.TrimSuffix(verdict, " FOUND"), nil
+	case strings.HasSuffix(verdict, " ERROR"):
+		return "", fmt.Errorf("clamd: %s", strings.TrimSuffix(verdict, " ERROR"))
+	}
+	return "", fmt.Errorf("clamd: unexpected reply %q", reply)
+}
+
+// fakeScanner - a scanner for tests and local runs; content containing the EICAR test string is infected.
+//	* the content is streamed through a window keeping the end of the previous chunk, so a signature across two
+//	chunks is found without holding the whole content in memory
+type fakeScanner struct{}
+
+func (fakeScanner) scan(r io.Reader) (string, error) {
+	keep := len(eicarSignature) - 1
+	window := make([]byte, keep+clamdChunkSize)
+	held := 0
+	for {
+		n, err := r.Read(window[held:])
+		held += n
+		if bytes.Contains(window[:held], eicarSignature) {
+			return "Eicar-Test-Signature", nil
+		}
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if held > keep {
+			held = copy(window, window[held-keep:held])
+		}
+	}
+}
+
+func (fakeScanner) maxSize() int64 {
+	return 0
+}
+
+// scanOf - the scan of the file; files uploaded before scanning was introduced have not been scanned yet
+func scanOf(f *file) *fileScan {
+	if f.Scan == nil {
+		return &fileScan{Status: scanStatusPending}
+	}
+	return f.Scan
+}
+
+// checkDownloadable - verify the file content was uploaded and found clean
+func checkDownloadable(f *file) error {
+	if f.Status == fileStatusRejected {
+		return errConflict("the uploaded file was rejected").withExtension("status", f.Status)
+	}
+	if scan := scanOf(f); scan.Status != scanStatusClean {
+		return errConflict("the file cannot be downloaded until it is scanned clean").withExtension("scanStatus", scan.Status)
+	}
+	return nil
+}
+
+// scanObject - scan the stored content of the size under the key.
+//	* failing to read the content or to reach the scanner is recorded as an ERROR scan, so the file stays blocked
+//	until it is scanned again
+//	* content larger than the scanner accepts is not sent to it and is recorded as TOO_LARGE; scanning it again
+//	would fail the same way
+func scanObject(key string, size int64, bucketName string, sc scanner, s3API s3iface.S3API, logger *LOGGER.Entry) *fileScan {
+	now := time.Now()
+	result := &fileScan{Status: scanStatusError, ScannedAt: &now}
+	if sc == nil {
+		result.Message = aws.String("no malware scanner is configured")
+		return result
+	}
+	if limit := sc.maxSize(); limit > 0 && size > limit {
+		logger.WithFields(LOGGER.Fields{
+			"key":   key,
+			"size":  size,
+			"limit": limit,
+		}).Warn("scanObject() - the stored content is larger than the malware scanner accepts")
+		result.Status = scanStatusTooLarge
+		result.Message = aws.String(fmt.Sprintf("the content is larger than the %d bytes the malware scanner accepts", limit))
+		return result
+	}
+	output, err := s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"key":   key,
+			"error": err.Error(),
+		}).Error("scanObject() - an error occurred while trying to read the stored content")
+		result.Message = aws.String("unable to read the stored content")
+		return result
+	}
+	defer output.Body.Close()
+	signature, err := sc.scan(output.Body)
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"key":   key,
+			"error": err.Error(),
+		}).Error("scanObject() - an error occurred while trying to scan the stored content")
+		result.Message = aws.String(err.Error())
+		return result
+	}
+	result.Status = scanStatusClean
+	if signature != "" {
+		logger.WithFields(LOGGER.Fields{
+			"key":       key,
+			"signature": signature,
+		}).Warn("scanObject() - malware found in the stored content")
+		result.Status = scanStatusInfected
+		result.Signature = aws.String(signature)
+	}
+	return result
+}
+
+// processContent - scan the stored content for malware, then generate the thumbnails of clean images.
+//	* failing to generate the thumbnails is logged and leaves the content without any
+func processContent(key, contentType string, size int64, bucketName string, sc scanner, s3API s3iface.S3API, logger *LOGGER.Entry) (*fileScan, []thumbnail) {
+	scan := scanObject(key, size, bucketName, sc, s3API, logger)
+	if scan.Status != scanStatusClean {
+		return scan, nil
+	}
+	thumbs, err := generateThumbnails(key, contentType, size, bucketName, s3API, logger)
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"key":   key,
+			"error": err.Error(),
+		}).Warn("processContent() - unable to generate the thumbnails")
+	}
+	return scan, thumbs
+}
+
+// saveProcessing - save the scan result and the thumbnails on a file or blob record; a record deleted in the
+// meantime is ignored
+func saveProcessing(key map[string]dynamodb.AttributeValue, keyName string, scan *fileScan, thumbs []thumbnail, tableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	update := expression.Set(expression.Name("scan"), expression.Value(scan))
+	if len(thumbs) > 0 {
+		update = update.Set(expression.Name("thumbnails"), expression.Value(thumbs))
+	}
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.Name(keyName).AttributeExists()).
+		Build()
+	if err != nil {
+		return errInternal("unable to save the scan result", err)
+	}
+	_, err = dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       key,
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send()
+	if err != nil && !isConditionalCheckFailed(err) {
+		logger.WithFields(LOGGER.Fields{
+			"table": tableName,
+			"error": err.Error(),
+		}).Error("saveProcessing() - an error occurred while trying to save the scan result")
+		return errInternal("unable to save the scan result", err)
+	}
+	return nil
+}
+
+// scanFile - scan the stored content of a completed file and save the result.
+//	* content shared through a blob is scanned once for every file referencing it: the result is saved on the blob
+//	and on each of its completed files
+//	* clean images without thumbnails get them generated
+//	* the caller must have authorized the user on the session; files are scanned when their upload completes, so this
+//	is only needed to retry a scan that ended in an ERROR
+func scanFile(f *file, bucketName, filesTableName, blobsTableName string, sc scanner, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) (*file, error) {
+	logger.WithFields(LOGGER.Fields{
+		"file_id": f.ID,
+	}).Info("scanFile() - scan the stored content of the file")
+	if f.Status != fileStatusComplete {
+		return nil, errConflict("only completely uploaded files can be scanned").withExtension("status", f.Status)
+	}
+	scan, thumbs := processContent(f.Key, thumbnailContentType(f), f.Size, bucketName, sc, s3API, logger)
+	if len(f.Thumbnails) > 0 {
+		// the thumbnails were generated before; they were just stored again under the same keys
+		thumbs = f.Thumbnails
+	}
+	files := []*file{f}
+	if f.BlobHash != nil {
+		if err := saveProcessing(map[string]dynamodb.AttributeValue{"hash": {S: aws.String(*f.BlobHash)}}, "hash", scan, thumbs, blobsTableName, dbAPI, logger); err != nil {
+			return nil, err
+		}
+		shared, err := findFilesByBlob(*f.BlobHash, filesTableName, dbAPI, logger)
+		if err != nil {
+			return nil, err
+		}
+		files = shared
+	}
+	for _, shared := range files {
+		if shared.Status != fileStatusComplete && shared.ID != f.ID {
+			continue
+		}
+		if err := saveProcessing(map[string]dynamodb.AttributeValue{"id": {S: aws.String(shared.ID)}}, "id", scan, thumbs, filesTableName, dbAPI, logger); err != nil {
+			return nil, err
+		}
+	}
+	f.Scan = scan
+	f.Thumbnails = thumbs
+	return f, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClamd - a clamd daemon answering one INSTREAM command with the reply for the streamed content
+func fakeClamd(t *testing.T, reply func(content []byte) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+			conn.Write([]byte("UNKNOWN COMMAND\x00"))
+			return
+		}
+		var content bytes.Buffer
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r, size); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(&content, r, int64(n)); err != nil {
+				return
+			}
+		}
+		conn.Write([]byte(reply(content.Bytes()) + "\x00"))
+	}()
+	return l.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	reply := func(content []byte) string {
+		if bytes.Contains(content, eicarSignature) {
+			return "stream: Eicar-Signature FOUND"
+		}
+		return "stream: OK"
+	}
+	// content over several chunks, with the signature across a chunk boundary
+	content := strings.Repeat("a", clamdChunkSize-10) + string(eicarSignature)
+	signature, err := newScanner(fakeClamd(t, reply), defaultClamdStreamMaxLength).scan(strings.NewReader(content))
+	assert.Nil(t, err)
+	assert.Equal(t, "Eicar-Signature", signature)
+
+	signature, err = newScanner(fakeClamd(t, reply), defaultClamdStreamMaxLength).scan(strings.NewReader("quarterly report"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", signature)
+
+	limit := func([]byte) string { return "INSTREAM size limit exceeded. ERROR" }
+	_, err = newScanner(fakeClamd(t, limit), defaultClamdStreamMaxLength).scan(strings.NewReader("quarterly report"))
+	assert.NotNil(t, err)
+
+	_, err = (&clamdScanner{address: "127.0.0.1:1", timeout: time.Second}).scan(strings.NewReader("x"))
+	assert.NotNil(t, err, "no daemon listening")
+}
+
+// chunkedReader - a reader returning the content in reads of at most n bytes
+type chunkedReader struct {
+	r io.Reader
+	n int
+}
+
+func (c chunkedReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+func TestFakeScanner(t *testing.T) {
+	sc := fakeScanner{}
+	// the signature split across reads, and across a full window, is still found
+	for _, content := range []string{
+		"ab" + string(eicarSignature) + "cd",
+		strings.Repeat("a", clamdChunkSize+len(eicarSignature)/2) + string(eicarSignature),
+	} {
+		signature, err := sc.scan(chunkedReader{r: strings.NewReader(content), n: 7})
+		assert.Nil(t, err)
+		assert.Equal(t, "Eicar-Test-Signature", signature)
+		signature, err = sc.scan(strings.NewReader(content))
+		assert.Nil(t, err)
+		assert.Equal(t, "Eicar-Test-Signature", signature)
+	}
+	signature, err := sc.scan(chunkedReader{r: strings.NewReader(strings.Repeat(string(eicarSignature[:20]), 5000)), n: 7})
+	assert.Nil(t, err)
+	assert.Equal(t, "", signature)
+}
+
+func TestScanSizeLimit(t *testing.T) {
+	length, err := parseStreamMaxLength("")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(defaultClamdStreamMaxLength), length)
+	length, err = parseStreamMaxLength("104857600")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100<<20), length)
+	_, err = parseStreamMaxLength("0")
+	assert.NotNil(t, err)
+
+	// content over the limit is not read nor sent to the daemon
+	sc := newScanner("127.0.0.1:1", 10)
+	scan := scanObject("sessions/s1/f1/a.bin", 11, "bucket", sc, &mockS3{}, testLogger())
+	assert.Equal(t, scanStatusTooLarge, scan.Status)
+	assert.NotNil(t, scan.Message)
+	assert.NotNil(t, checkDownloadable(&file{Status: fileStatusComplete, Scan: scan}))
+}
+
+func TestScanStatus(t *testing.T) {
+	assert.Nil(t, newScanner("", 0))
+	signature, err := newScanner(fakeScannerAddress, 0).scan(bytes.NewReader(eicarSignature))
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", signature)
+
+	_, err = parseClamdReply("stream: unexpected")
+	assert.NotNil(t, err)
+
+	f := &file{Status: fileStatusComplete}
+	assert.Equal(t, scanStatusPending, scanOf(f).Status, "files uploaded before scanning are not scanned yet")
+	assert.NotNil(t, checkDownloadable(f))
+	f.Scan = &fileScan{Status: scanStatusInfected}
+	assert.NotNil(t, checkDownloadable(f))
+	f.Scan = &fileScan{Status: scanStatusClean}
+	assert.Nil(t, checkDownloadable(f))
+	f.Status = fileStatusRejected
+	assert.NotNil(t, checkDownloadable(f))
+}
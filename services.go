@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/satori/go.uuid"
@@ -10,11 +13,12 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
 	LOGGER "github.com/sirupsen/logrus"
 )
 
 // findUserByEmail query the users tables to find a user record by the id
-func findUserByEmail(email, usersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Logger) (*user, error) {
+func findUserByEmail(email, usersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*user, error) {
 	logger.WithFields(LOGGER.Fields{
 		"email":            email,
 		"users_table_name": usersTableName,
@@ -27,33 +31,39 @@ func findUserByEmail(email, usersTableName string, dbAPI dynamodbiface.DynamoDBA
 			},
 		},
 	}).Send()
-	if err != nil || len(output.Item) == 0 {
+	if err != nil {
 		logger.WithFields(LOGGER.Fields{
 			"email":            email,
 			"users_table_name": usersTableName,
 			"error":            err.Error(),
 		}).Error("findUserByEmail() - an error occurred while trying to find the user record by email")
-		return nil, err
+		return nil, errInternal("unable to look up the user record", err)
+	}
+	if len(output.Item) == 0 {
+		return nil, errNotFound("no user record exists with the given email")
 	}
 	// unmarshal return into user
 	var user = new(user)
 	if err = dynamodbattribute.UnmarshalMap(output.Item, &user); err != nil {
-		return nil, err
+		return nil, errInternal("unable to read the user record", err)
 	}
 	return user, nil
 }
 
 // registerUser register a new user instance using the dynamo service
-func registerUser(email, pwd, name, role, usersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Logger) (*user, error) {
+func registerUser(email, pwd, name, role, usersTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*user, error) {
 	logger.WithFields(LOGGER.Fields{
 		"email":            email,
 		"name":             name,
 		"role":             role,
 		"users_table_name": usersTableName,
 	}).Info("registerUser() - attempting to register a new user")
+	if strings.TrimSpace(email) == "" || pwd == "" {
+		return nil, errValidation("an email and password are required to register")
+	}
 	hashed, err := hashPwd(pwd)
 	if err != nil {
-		return nil, err
+		return nil, errInternal("unable to register the user", err)
 	}
 	// build user instance
 	now := time.Now()
@@ -71,136 +81,481 @@ func registerUser(email, pwd, name, role, usersTableName string, dbAPI dynamodbi
 	}
 	userMap, err := dynamodbattribute.MarshalMap(user)
 	if err != nil {
-		return nil, err
+		return nil, errInternal("unable to register the user", err)
 	}
-	// save the user record in dynamo
-	if err := putItem(userMap, usersTableName, dbAPI, logger); err != nil {
-		return nil, err
+	// save the user record in dynamo; never overwrite an existing registration
+	if err := putNewItem(userMap, "email", usersTableName, dbAPI, logger); err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, errConflict("a user is already registered with the given email")
+		}
+		return nil, errInternal("unable to register the user", err)
 	}
 	return user, nil
 }
 
 // authenticate a user
 //	* attempt to find the user with the given email
-//		* if not found, return a non-successful authentication
+//		* if not found, return an unauthenticated error
 //	* otherwise, validate that the submitted password matches the password on file
-//		* if the passwords do not match, return a non-successful authentication
-func authenticate(email, pwd, usersTableName string, jwtSecret []byte, tokenExpiryMin int, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Logger) auth {
+//		* if the passwords do not match, return an unauthenticated error
+//	* the same message is used for both cases so the response does not reveal which emails are registered
+func authenticate(email, pwd, usersTableName string, jwtSecret []byte, tokenExpiryMin int, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*auth, error) {
 	user, err := findUserByEmail(email, usersTableName, dbAPI, logger)
 	if err != nil {
-		return auth{
-			Success: false,
-			Message: "Unable to find a record with the given email. Please Verify your email and try again",
+		if sErr, ok := err.(*serviceError); ok && sErr.code == codeNotFound {
+			return nil, errUnauthenticated("the email or password submitted is incorrect. Please check the email and password and try again")
 		}
+		return nil, err
 	}
 	// verify password match
 	if !verifyPwd(user.Pwd, pwd) {
-		return auth{
-			Success: false,
-			Message: "The password submitted does not match this users password. Please check the email and password and try again",
-		}
+		return nil, errUnauthenticated("the email or password submitted is incorrect. Please check the email and password and try again")
 	}
 	// build the auth token
 	token, expiry, err := buildToken(user.Email, jwtSecret, tokenExpiryMin)
 	if err != nil {
-		return auth{
-			Success: false,
-			Message: err.Error(),
-		}
+		return nil, errInternal("unable to build the authorization token", err)
 	}
-	return auth{Success: true, Token: *token, ExpiresAt: *expiry, User: user}
+	return &auth{Success: true, Token: *token, ExpiresAt: *expiry, User: user}, nil
 }
 
 // saveSession
+//	* the owner is always the authenticated email; an email sent by the client is ignored
+//	* new sessions start OPEN and are written only if the id is not taken
+//	* updates load the stored record first and must be made by its owner or an editor; the stored owner, status, end date
+//	and meta are kept since those are owned by the server, and the write is conditional on the record still existing
+//	* closed and archived sessions can no longer be updated
+//	* updates must send the version they were based on; the write is conditional on it so concurrent edits cannot
+//	silently overwrite each other, and a conflict error carries the current version so the client can merge
 //	* convert the input session item into a dynamodb.AttributeValue map
 //	* save the item
-func saveSession(sess session, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Logger) (*session, error) {
+func saveSession(sess session, version *int64, email, membersTableName, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*session, error) {
 	logger.WithFields(LOGGER.Fields{
 		"session":            sess,
 		"session_table_name": sessionTableName,
 	}).Info("saveSession() - save the incoming session instance into the dynamodb table")
+	sess.Email = email
+	sess.StartDate = sess.StartDate.UTC()
 	// check for an id value on the session; if nil, generate a new id & set the meta data
 	now := time.Now()
 	active := true
+	var cond expression.ConditionBuilder
 	if sess.ID == nil {
 		id, _ := uuid.NewV4()
 		idVal := id.String()
+		status := statusOpen
 		sess.ID = &idVal
+		sess.Status = &status
+		sess.EndDate = nil
+		sess.TypePolicy = nil
+		sess.Sanitize = nil
+		sess.Metadata = nil
+		sess.Tags = nil
+		initialVersion := int64(1)
 		sess.Meta = &baseMeta{
 			MetaCreatedAt: &now,
 			MetaUpdatedAt: &now,
 			MetaIsActive:  &active,
+			MetaVersion:   &initialVersion,
 		}
+		cond = expression.Name("id").AttributeNotExists()
 	} else {
-		// id has a value, update the updated at in meta
+		if version == nil {
+			return nil, errValidation("the version of the session being updated is required")
+		}
+		existing, _, err := authorizeSession(*sess.ID, email, roleEditor, membersTableName, sessionTableName, dbAPI, logger)
+		if err != nil {
+			return nil, err
+		}
+		sess.Email = existing.Email
+		if current := versionOf(existing.Meta); current != *version {
+			return nil, errVersionConflict(current)
+		}
+		if err := checkSessionWritable(existing); err != nil {
+			return nil, err
+		}
+		status := statusOf(existing)
+		sess.Status = &status
+		sess.EndDate = existing.EndDate
+		sess.TypePolicy = existing.TypePolicy
+		sess.Sanitize = existing.Sanitize
+		sess.Metadata = existing.Metadata
+		sess.Tags = existing.Tags
+		sess.Meta = existing.Meta
+		if sess.Meta == nil {
+			sess.Meta = &baseMeta{MetaCreatedAt: &now, MetaIsActive: &active}
+		}
+		// id has a value, update the updated at and version in meta
+		nextVersion := *version + 1
 		sess.Meta.MetaUpdatedAt = &now
-		sess.Meta.MetaIsActive = &active
+		sess.Meta.MetaVersion = &nextVersion
+		cond = expression.Name("id").AttributeExists().
+			And(expression.Name("email").Equal(expression.Value(sess.Email))).
+			And(versionCondition(*version))
 	}
 	// convert to map
 	sessMap, err := dynamodbattribute.MarshalMap(sess)
 	if err != nil {
-		return nil, err
+		return nil, errInternal("unable to save the session", err)
 	}
+	// store the start date in the fixed width key format so the email index sorts and range filters it lexically
+	sessMap["session_start_date"] = dynamodb.AttributeValue{S: aws.String(formatKeyDate(sess.StartDate))}
 	// save the session
-	if err := putItem(sessMap, sessionTableName, dbAPI, logger); err != nil {
-		return nil, err
+	if err := putItemIf(sessMap, cond, sessionTableName, dbAPI, logger); err != nil {
+		if isConditionalCheckFailed(err) {
+			if version != nil {
+				// report the version that won so the client can merge against it
+				if current, findErr := findSessionByID(*sess.ID, sessionTableName, dbAPI, logger); findErr == nil {
+					return nil, errVersionConflict(versionOf(current.Meta))
+				}
+			}
+			return nil, errConflict("the session was created or deleted by another request. Please reload the session and try again")
+		}
+		return nil, errInternal("unable to save the session", err)
 	}
 	return &sess, nil
 }
 
-// findSessionByID - find a session record in dynamodb by the session id and email associated to the session
-func findSessionByID(id, email, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Logger) (*session, error) {
+// versionOf - the optimistic concurrency version of a record; records written before versioning are version 0
+func versionOf(meta *baseMeta) int64 {
+	if meta == nil || meta.MetaVersion == nil {
+		return 0
+	}
+	return *meta.MetaVersion
+}
+
+// versionCondition - the condition that the stored record is still at the given version
+func versionCondition(version int64) expression.ConditionBuilder {
+	if version == 0 {
+		return expression.Name("meta.meta__version").AttributeNotExists()
+	}
+	return expression.Name("meta.meta__version").Equal(expression.Value(version))
+}
+
+// bumpVersion - the update that increments the optimistic concurrency version of a record
+func bumpVersion(update expression.UpdateBuilder) expression.UpdateBuilder {
+	name := expression.Name("meta.meta__version")
+	return update.Set(name, expression.Plus(expression.IfNotExists(name, expression.Value(0)), expression.Value(1)))
+}
+
+// touchMeta - the update setting the updated at date and the given meta attributes of a record and incrementing its
+// version.
+//	* records stored before meta was kept have no meta map to set attributes in, so the whole map is set instead,
+//	starting them at version 1
+func touchMeta(update expression.UpdateBuilder, stored *baseMeta, now time.Time, attrs map[string]interface{}) expression.UpdateBuilder {
+	meta := map[string]interface{}{"meta__updated_at": now}
+	for k, v := range attrs {
+		meta[k] = v
+	}
+	if stored == nil {
+		meta["meta__version"] = 1
+		return update.Set(expression.Name("meta"), expression.Value(meta))
+	}
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		update = update.Set(expression.Name("meta."+k), expression.Value(meta[k]))
+	}
+	return bumpVersion(update)
+}
+
+// transitionSession - move a session to a new lifecycle status.
+//	* the caller must have authorized the user on the session
+//	* the transition must be allowed from the current status
+//	* submitting or closing a session sets its end date when it has none
+//	* archiving a session also marks it inactive so it is hidden from getSessions
+//	* the update is conditional on the status it was read with, so two concurrent transitions cannot both win
+func transitionSession(sess *session, to, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*session, error) {
+	id := *sess.ID
 	logger.WithFields(LOGGER.Fields{
 		"id":                 id,
-		"email":              email,
+		"to":                 to,
 		"session_table_name": sessionTableName,
-	}).Info("findSessionByID() - find the session record by the id primary key and email sort key")
-	output, err := dbAPI.GetItemRequest(&dynamodb.GetItemInput{
-		TableName: aws.String(sessionTableName),
-		Key:       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}, "email": {S: aws.String(email)}},
+	}).Info("transitionSession() - move the session to a new lifecycle status")
+	from := statusOf(sess)
+	if !canTransition(from, to) {
+		return nil, errConflict(fmt.Sprintf("a %s session cannot be moved to %s", from, to)).
+			withExtension("status", from)
+	}
+	now := time.Now()
+	update := expression.Set(expression.Name("status"), expression.Value(to))
+	if (to == statusSubmitted || to == statusClosed) && sess.EndDate == nil {
+		update = update.Set(expression.Name("session_end_date"), expression.Value(now))
+	}
+	meta := map[string]interface{}{}
+	if to == statusArchived {
+		// archiving is a soft delete: the record is kept but hidden from getSessions
+		meta["meta__is_active"] = false
+	}
+	update = touchMeta(update, sess.Meta, now, meta)
+	// condition on the stored value; sessions saved before statuses were enforced may have none
+	cond := expression.Name("status").AttributeNotExists()
+	if sess.Status != nil {
+		cond = expression.Name("status").Equal(expression.Value(*sess.Status))
+	}
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(cond).
+		Build()
+	if err != nil {
+		return nil, errInternal("unable to update the session status", err)
+	}
+	output, err := dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(sessionTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}, "email": {S: aws.String(sess.Email)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueAllNew,
 	}).Send()
-	if err != nil || len(output.Item) == 0 {
-		return nil, err
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, errConflict("the session status was changed by another request. Please reload the session and try again")
+		}
+		logger.WithFields(LOGGER.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Error("transitionSession() - an error occurred while trying to update the session status")
+		return nil, errInternal("unable to update the session status", err)
 	}
-	// unmarshal return into session
-	var sess = new(session)
-	if err = dynamodbattribute.UnmarshalMap(output.Item, &sess); err != nil {
-		return nil, err
+	var updated = new(session)
+	if err = dynamodbattribute.UnmarshalMap(output.Attributes, &updated); err != nil {
+		return nil, errInternal("unable to read the session", err)
 	}
-	return sess, nil
+	return updated, nil
+}
+
+// checkSessionWritable - verify the session and its files can still be changed; closed and archived sessions are
+// read only
+func checkSessionWritable(sess *session) error {
+	if status := statusOf(sess); status == statusClosed || status == statusArchived {
+		return errConflict(fmt.Sprintf("a %s session can no longer be updated", status)).withExtension("status", status)
+	}
+	return nil
+}
+
+// saveSessionSettings - apply the update of setting attributes to the session, bumping its version.
+//	* what names the settings in the errors returned
+func saveSessionSettings(sess *session, update expression.UpdateBuilder, what, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*session, error) {
+	update = touchMeta(update, sess.Meta, time.Now(), nil)
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.Name("id").AttributeExists()).
+		Build()
+	if err != nil {
+		return nil, errInternal("unable to save the "+what, err)
+	}
+	output, err := dbAPI.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(sessionTableName),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(*sess.ID)}, "email": {S: aws.String(sess.Email)}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              dynamodb.ReturnValueAllNew,
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, errNotFound("no session exists with the given id")
+		}
+		logger.WithFields(LOGGER.Fields{
+			"id":    *sess.ID,
+			"error": err.Error(),
+		}).Error("saveSessionSettings() - an error occurred while trying to save the " + what)
+		return nil, errInternal("unable to save the "+what, err)
+	}
+	var updated = new(session)
+	if err = dynamodbattribute.UnmarshalMap(output.Attributes, &updated); err != nil {
+		return nil, errInternal("unable to read the session", err)
+	}
+	return updated, nil
 }
 
-// findSessions - find all session records with the given email sort key
-func findSessions(email, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Logger) ([]*session, error) {
+// deleteSession - permanently delete a session with all of its files and collaborators.
+//	* the caller must have authorized the user as the owner of the session
+//	* the s3 objects are removed first, then the file and member records and the session record last, so a run that
+//	fails part way leaves the session in place and the delete can simply be retried
+func deleteSession(sess *session, bucketName, filesTableName, membersTableName, sessionTableName, blobsTableName, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) error {
+	id := *sess.ID
 	logger.WithFields(LOGGER.Fields{
-		"email":              email,
+		"id":                 id,
 		"session_table_name": sessionTableName,
-	}).Info("findSessionByID() - find all session records with the email sort key")
-	keyCond := expression.Key("email").Equal(expression.Value(email))
+	}).Info("deleteSession() - delete the session, its files and their stored content")
+	objects, err := deleteObjects(sessionPrefix(id), bucketName, s3API, logger)
+	if err != nil {
+		return err
+	}
+	archives, err := deleteObjects(archivesKeyPrefix+id+"/", bucketName, s3API, logger)
+	if err != nil {
+		return err
+	}
+	objects += archives
+	thumbnails, err := deleteObjects(thumbnailsKeyPrefix+sessionPrefix(id), bucketName, s3API, logger)
+	if err != nil {
+		return err
+	}
+	objects += thumbnails
+	// sanitized content and its thumbnails are stored outside the session prefix as well
+	for _, prefix := range []string{sanitizedKey(sessionPrefix(id)), thumbnailsKeyPrefix + sanitizedKey(sessionPrefix(id))} {
+		sanitized, err := deleteObjects(prefix, bucketName, s3API, logger)
+		if err != nil {
+			return err
+		}
+		objects += sanitized
+	}
+	records, err := deleteFileRecords(id, bucketName, filesTableName, blobsTableName, usageTableName, dbAPI, s3API, logger)
+	if err != nil {
+		return err
+	}
+	if err := deleteMemberRecords(id, membersTableName, dbAPI, logger); err != nil {
+		return err
+	}
+	if err := deleteUsage(sessionUsageID(id), usageTableName, dbAPI, logger); err != nil {
+		return err
+	}
+	_, err = dbAPI.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		TableName: aws.String(sessionTableName),
+		Key:       map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}, "email": {S: aws.String(sess.Email)}},
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Error("deleteSession() - an error occurred while trying to delete the session record")
+		return errInternal("unable to delete the session", err)
+	}
+	logger.WithFields(LOGGER.Fields{
+		"id":           id,
+		"objects":      objects,
+		"file_records": records,
+	}).Info("deleteSession() - the session was deleted")
+	return nil
+}
+
+// findSessionByID - find a session record in dynamodb by the session id.
+//	* the id is the hash key, so a Query on it finds the record without knowing the email sort key
+func findSessionByID(id, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*session, error) {
+	logger.WithFields(LOGGER.Fields{
+		"id":                 id,
+		"session_table_name": sessionTableName,
+	}).Info("findSessionByID() - find the session record by the id primary key")
 	expr, err := expression.NewBuilder().
-		WithKeyCondition(keyCond).
+		WithKeyCondition(expression.Key("id").Equal(expression.Value(id))).
 		Build()
 	if err != nil {
-		return nil, err
+		return nil, errInternal("unable to look up the session", err)
 	}
 	output, err := dbAPI.QueryRequest(&dynamodb.QueryInput{
 		TableName:                 aws.String(sessionTableName),
 		KeyConditionExpression:    expr.KeyCondition(),
-		ExpressionAttributeValues: expr.Values(),
 		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Limit:                     aws.Int64(1),
 	}).Send()
 	if err != nil {
-		return nil, err
+		logger.WithFields(LOGGER.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Error("findSessionByID() - an error occurred while trying to find the session record")
+		return nil, errInternal("unable to look up the session", err)
+	}
+	if len(output.Items) == 0 {
+		return nil, errNotFound("no session exists with the given id")
 	}
-	if *output.Count == 0 {
-		return nil, nil
+	// unmarshal return into session
+	var sess = new(session)
+	if err = dynamodbattribute.UnmarshalMap(output.Items[0], &sess); err != nil {
+		return nil, errInternal("unable to read the session", err)
 	}
-	var sessions = make([]*session, *output.Count)
-	for _, item := range output.Items {
-		var sess = new(session)
-		if err := dynamodbattribute.UnmarshalMap(item, &sess); err == nil {
-			sessions = append(sessions, sess)
+	return sess, nil
+}
+
+// findSessions - find a page of the session records owned by the given email.
+//	* query the email/session_start_date GSI so the date range and the sort order are served by the index
+//	* the status filter is a FilterExpression, so keep querying until the page is full or the index is exhausted
+//	* the cursor is the index key of the last returned item and is used as the ExclusiveStartKey of the next page
+func findSessions(email string, filter sessionFilter, page pageArgs, sessionTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) (*sessionConnection, error) {
+	logger.WithFields(LOGGER.Fields{
+		"email":              email,
+		"filter":             filter,
+		"page":               page,
+		"session_table_name": sessionTableName,
+	}).Info("findSessions() - find a page of session records with the email index")
+	keyCond := expression.Key("email").Equal(expression.Value(email))
+	switch {
+	case filter.StartedAfter != nil && filter.StartedBefore != nil:
+		keyCond = keyCond.And(expression.Key("session_start_date").Between(
+			expression.Value(formatKeyDate(*filter.StartedAfter)),
+			expression.Value(formatKeyDate(*filter.StartedBefore))))
+	case filter.StartedAfter != nil:
+		keyCond = keyCond.And(expression.Key("session_start_date").GreaterThanEqual(expression.Value(formatKeyDate(*filter.StartedAfter))))
+	case filter.StartedBefore != nil:
+		keyCond = keyCond.And(expression.Key("session_start_date").LessThanEqual(expression.Value(formatKeyDate(*filter.StartedBefore))))
+	}
+	builder := expression.NewBuilder().WithKeyCondition(keyCond)
+	if cond, ok := filter.condition(); ok {
+		builder = builder.WithFilter(cond)
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, errInternal("unable to list the sessions", err)
+	}
+	var startKey map[string]dynamodb.AttributeValue
+	if page.After != nil {
+		if startKey, err = decodeKeyCursor(*page.After, sessionIndexKeys...); err != nil {
+			return nil, errValidation("the after cursor is not valid")
+		}
+	}
+	conn := &sessionConnection{
+		Edges:    []*sessionEdge{},
+		PageInfo: pageInfo{HasPreviousPage: page.After != nil},
+	}
+	for {
+		output, err := dbAPI.QueryRequest(&dynamodb.QueryInput{
+			TableName:                 aws.String(sessionTableName),
+			IndexName:                 aws.String(sessionsByEmailIndex),
+			KeyConditionExpression:    expr.KeyCondition(),
+			FilterExpression:          expr.Filter(),
+			ExpressionAttributeValues: expr.Values(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExclusiveStartKey:         startKey,
+			ScanIndexForward:          aws.Bool(!page.Desc),
+			Limit:                     aws.Int64(int64(page.First - len(conn.Edges))),
+		}).Send()
+		if err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"email": email,
+				"error": err.Error(),
+			}).Error("findSessions() - an error occurred while trying to query the session email index")
+			return nil, errInternal("unable to list the sessions", err)
 		}
+		for _, item := range output.Items {
+			var sess = new(session)
+			if err := dynamodbattribute.UnmarshalMap(item, &sess); err != nil {
+				logger.WithFields(LOGGER.Fields{
+					"error": err.Error(),
+				}).Warn("findSessions() - skipping a session record that could not be unmarshalled")
+				continue
+			}
+			conn.Edges = append(conn.Edges, &sessionEdge{
+				Cursor: encodeKeyCursor(item, sessionIndexKeys...),
+				Node:   sess,
+			})
+		}
+		startKey = output.LastEvaluatedKey
+		if len(startKey) == 0 || len(conn.Edges) >= page.First {
+			break
+		}
+	}
+	// dynamodb only reports that it stopped, not that more matching items exist; this may be a false positive on the last page
+	conn.PageInfo.HasNextPage = len(startKey) > 0
+	if len(conn.Edges) > 0 {
+		conn.PageInfo.StartCursor = &conn.Edges[0].Cursor
+		conn.PageInfo.EndCursor = &conn.Edges[len(conn.Edges)-1].Cursor
 	}
-	return sessions, nil
+	return conn, nil
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// testLogger - a logger that discards its output
+func testLogger() *LOGGER.Entry {
+	log := LOGGER.New()
+	log.SetOutput(ioutil.Discard)
+	return LOGGER.NewEntry(log)
+}
+
+// mockRequest - a request that completes with the output or the error without calling aws
+func mockRequest(output interface{}, err error) *aws.Request {
+	return &aws.Request{Data: output, Error: err, HTTPRequest: new(http.Request)}
+}
+
+// mockDynamo - a dynamodb client answering every query on a table with its items and recording the writes
+type mockDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string][]map[string]dynamodb.AttributeValue
+	// the item every GetItem request on a table finds and every UpdateItem request returns
+	item map[string]map[string]dynamodb.AttributeValue
+	// the error every UpdateItem request on a table fails with
+	updateErr map[string]error
+	// the table and the key of each UpdateItem request
+	updates    []string
+	updateKeys []map[string]dynamodb.AttributeValue
+	// the writes the first BatchWriteItem request leaves unprocessed
+	unprocessed int
+	// the error every BatchWriteItem request fails with
+	batchErr error
+	// the number of writes sent with each BatchWriteItem request
+	batches []int
+	puts    []map[string]dynamodb.AttributeValue
+	deletes []string
+	// the error every DeleteItem request on a table fails with
+	deleteErr map[string]error
+}
+
+func (m *mockDynamo) QueryRequest(in *dynamodb.QueryInput) dynamodb.QueryRequest {
+	return dynamodb.QueryRequest{Request: mockRequest(&dynamodb.QueryOutput{Items: m.items[*in.TableName]}, nil), Input: in}
+}
+
+func (m *mockDynamo) GetItemRequest(in *dynamodb.GetItemInput) dynamodb.GetItemRequest {
+	return dynamodb.GetItemRequest{Request: mockRequest(&dynamodb.GetItemOutput{Item: m.item[*in.TableName]}, nil), Input: in}
+}
+
+func (m *mockDynamo) PutItemRequest(in *dynamodb.PutItemInput) dynamodb.PutItemRequest {
+	m.puts = append(m.puts, in.Item)
+	return dynamodb.PutItemRequest{Request: mockRequest(&dynamodb.PutItemOutput{}, nil), Input: in}
+}
+
+func (m *mockDynamo) UpdateItemRequest(in *dynamodb.UpdateItemInput) dynamodb.UpdateItemRequest {
+	m.updates = append(m.updates, *in.TableName)
+	m.updateKeys = append(m.updateKeys, in.Key)
+	if err := m.updateErr[*in.TableName]; err != nil {
+		return dynamodb.UpdateItemRequest{Request: mockRequest(nil, err), Input: in}
+	}
+	return dynamodb.UpdateItemRequest{Request: mockRequest(&dynamodb.UpdateItemOutput{Attributes: m.item[*in.TableName]}, nil), Input: in}
+}
+
+func (m *mockDynamo) DeleteItemRequest(in *dynamodb.DeleteItemInput) dynamodb.DeleteItemRequest {
+	m.deletes = append(m.deletes, *in.TableName)
+	if err := m.deleteErr[*in.TableName]; err != nil {
+		return dynamodb.DeleteItemRequest{Request: mockRequest(nil, err), Input: in}
+	}
+	return dynamodb.DeleteItemRequest{Request: mockRequest(&dynamodb.DeleteItemOutput{}, nil), Input: in}
+}
+
+func (m *mockDynamo) BatchWriteItemRequest(in *dynamodb.BatchWriteItemInput) dynamodb.BatchWriteItemRequest {
+	writes := 0
+	for _, w := range in.RequestItems {
+		writes += len(w)
+	}
+	m.batches = append(m.batches, writes)
+	if m.batchErr != nil {
+		return dynamodb.BatchWriteItemRequest{Request: mockRequest(nil, m.batchErr), Input: in}
+	}
+	output := &dynamodb.BatchWriteItemOutput{}
+	if m.unprocessed > 0 {
+		output.UnprocessedItems = map[string][]dynamodb.WriteRequest{}
+		for table, w := range in.RequestItems {
+			output.UnprocessedItems[table] = w[:m.unprocessed]
+		}
+		m.unprocessed = 0
+	}
+	return dynamodb.BatchWriteItemRequest{Request: mockRequest(output, nil), Input: in}
+}
+
+// mockS3 - an s3 client for a bucket without objects, recording the copied and deleted keys
+type mockS3 struct {
+	s3iface.S3API
+	copied  []string
+	deleted []string
+}
+
+func (m *mockS3) CopyObjectRequest(in *s3.CopyObjectInput) s3.CopyObjectRequest {
+	m.copied = append(m.copied, *in.Key)
+	return s3.CopyObjectRequest{Request: mockRequest(&s3.CopyObjectOutput{}, nil), Input: in}
+}
+
+func (m *mockS3) DeleteObjectRequest(in *s3.DeleteObjectInput) s3.DeleteObjectRequest {
+	m.deleted = append(m.deleted, *in.Key)
+	return s3.DeleteObjectRequest{Request: mockRequest(&s3.DeleteObjectOutput{}, nil), Input: in}
+}
+
+func (m *mockS3) ListObjectsV2Request(in *s3.ListObjectsV2Input) s3.ListObjectsV2Request {
+	return s3.ListObjectsV2Request{Request: mockRequest(&s3.ListObjectsV2Output{}, nil), Input: in}
+}
+
+// storedSession - a mock dynamodb with the session of the owner stored with the status and meta
+func storedSession(t *testing.T, status string, meta *baseMeta) *mockDynamo {
+	item, err := dynamodbattribute.MarshalMap(&session{ID: aws.String("s1"), Email: "owner@example.com", Name: "s", Status: &status, Meta: meta})
+	assert.Nil(t, err)
+	return &mockDynamo{items: map[string][]map[string]dynamodb.AttributeValue{"sessions": {item}}}
+}
+
+func TestKeyCursor(t *testing.T) {
+	item := map[string]dynamodb.AttributeValue{
+		"id":                 {S: aws.String("7d3c")},
+		"email":              {S: aws.String("user@example.com")},
+		"session_start_date": {S: aws.String("2019-05-01T10:00:00Z")},
+		"name":               {S: aws.String("not part of the key")},
+	}
+
+	cursor := encodeKeyCursor(item, sessionIndexKeys...)
+	startKey, err := decodeKeyCursor(cursor, sessionIndexKeys...)
+
+	assert.Nil(t, err)
+	assert.Len(t, startKey, 3)
+	assert.Equal(t, "7d3c", *startKey["id"].S)
+	assert.Equal(t, "2019-05-01T10:00:00Z", *startKey["session_start_date"].S)
+
+	_, err = decodeKeyCursor("not-a-cursor", sessionIndexKeys...)
+	assert.NotNil(t, err)
+	_, err = decodeKeyCursor(encodeKeyCursor(item, "id"), sessionIndexKeys...)
+	assert.NotNil(t, err)
+}
+
+func TestSessionTransitions(t *testing.T) {
+	assert.True(t, canTransition(statusOpen, statusUploading))
+	assert.True(t, canTransition(statusUploading, statusSubmitted))
+	assert.True(t, canTransition(statusSubmitted, statusClosed))
+	assert.True(t, canTransition(statusClosed, statusArchived))
+	assert.False(t, canTransition(statusClosed, statusOpen))
+	assert.False(t, canTransition(statusArchived, statusOpen))
+	assert.False(t, canTransition(statusSubmitted, statusUploading))
+
+	assert.True(t, acceptsUploads(statusOpen))
+	assert.True(t, acceptsUploads(statusUploading))
+	assert.False(t, acceptsUploads(statusSubmitted))
+	assert.False(t, acceptsUploads(statusClosed))
+
+	legacy := "in progress"
+	assert.Equal(t, statusOpen, statusOf(&session{Status: &legacy}))
+}
+
+func TestSessionVersion(t *testing.T) {
+	assert.Equal(t, int64(0), versionOf(nil))
+	assert.Equal(t, int64(0), versionOf(&baseMeta{}))
+	v := int64(3)
+	assert.Equal(t, int64(3), versionOf(&baseMeta{MetaVersion: &v}))
+
+	err := errVersionConflict(4)
+	assert.Equal(t, codeConflict, err.Extensions()[errorCodeKey])
+	assert.Equal(t, int64(4), err.Extensions()["currentVersion"])
+}
+
+func TestSessionRoles(t *testing.T) {
+	assert.True(t, hasRole(roleOwner, roleEditor))
+	assert.True(t, hasRole(roleEditor, roleEditor))
+	assert.True(t, hasRole(roleEditor, roleViewer))
+	assert.False(t, hasRole(roleViewer, roleEditor))
+	assert.False(t, hasRole(roleEditor, roleOwner))
+	assert.False(t, hasRole("", roleViewer))
+}
+
+func TestLinkToken(t *testing.T) {
+	token, id, err := newLinkToken()
+	assert.Nil(t, err)
+	assert.Equal(t, id, linkID(token))
+	assert.NotContains(t, id, token)
+
+	other, _, err := newLinkToken()
+	assert.Nil(t, err)
+	assert.NotEqual(t, token, other)
+}
+
+func TestSaveSessionKeepsServerOwnedState(t *testing.T) {
+	version := int64(2)
+	active := true
+	for _, status := range []string{statusClosed, statusArchived} {
+		// archived sessions are inactive and must stay so
+		isActive := status != statusArchived
+		db := storedSession(t, status, &baseMeta{MetaVersion: &version, MetaIsActive: &isActive})
+		_, err := saveSession(session{ID: aws.String("s1"), Name: "renamed"}, &version, "owner@example.com", "members", "sessions", db, testLogger())
+		assert.Equal(t, codeConflict, err.(*serviceError).code, status)
+		assert.Empty(t, db.puts, status)
+	}
+
+	db := storedSession(t, statusUploading, &baseMeta{MetaVersion: &version, MetaIsActive: &active})
+	saved, err := saveSession(session{ID: aws.String("s1"), Name: "renamed"}, &version, "owner@example.com", "members", "sessions", db, testLogger())
+	assert.Nil(t, err)
+	assert.Len(t, db.puts, 1)
+	assert.Equal(t, statusUploading, *saved.Status)
+	assert.True(t, *saved.Meta.MetaIsActive)
+	assert.Equal(t, int64(3), *saved.Meta.MetaVersion)
+
+	// sessions saved before meta was kept are active
+	legacy := int64(0)
+	saved, err = saveSession(session{ID: aws.String("s1"), Name: "renamed"}, &legacy, "owner@example.com", "members", "sessions", storedSession(t, statusOpen, nil), testLogger())
+	assert.Nil(t, err)
+	assert.True(t, *saved.Meta.MetaIsActive)
+}
+
+func TestArchivedSessionsHidden(t *testing.T) {
+	// getSessions filters out the inactive, archived sessions unless includeArchived is set
+	_, filtered := sessionFilter{}.condition()
+	assert.True(t, filtered)
+	_, filtered = sessionFilter{IncludeArchived: true}.condition()
+	assert.False(t, filtered)
+	_, filtered = sessionFilter{IncludeArchived: true, Status: []string{statusArchived}}.condition()
+	assert.True(t, filtered)
+
+	assert.True(t, canTransition(statusClosed, statusArchived))
+	assert.False(t, acceptsUploads(statusArchived))
+}
+
+// sessionRecords - a mock dynamodb with the session, its files and its members stored
+func sessionRecords(t *testing.T, files, members int) *mockDynamo {
+	db := storedSession(t, statusClosed, nil)
+	for i := 0; i < files; i++ {
+		item, err := dynamodbattribute.MarshalMap(&file{ID: fmt.Sprintf("f%d", i), SessionID: "s1", Size: 10, Status: fileStatusComplete})
+		assert.Nil(t, err)
+		db.items["files"] = append(db.items["files"], item)
+	}
+	for i := 0; i < members; i++ {
+		item, err := dynamodbattribute.MarshalMap(&member{SessionID: "s1", Email: fmt.Sprintf("m%d@example.com", i), Role: roleViewer})
+		assert.Nil(t, err)
+		db.items["members"] = append(db.items["members"], item)
+	}
+	return db
+}
+
+func TestDeleteSessionBatches(t *testing.T) {
+	sess := &session{ID: aws.String("s1"), Email: "owner@example.com"}
+	db := sessionRecords(t, 30, 2)
+	db.unprocessed = 2
+
+	err := deleteSession(sess, "bucket", "files", "members", "sessions", "blobs", "usage", db, &mockS3{}, testLogger())
+	assert.Nil(t, err)
+	// the files in batches of 25 with the unprocessed writes resent, then the members
+	assert.Equal(t, []int{25, 2, 5, 2}, db.batches)
+	assert.Equal(t, []string{"usage", "sessions"}, db.deletes, "the session record is deleted last")
+}
+
+func TestDeleteSessionRetry(t *testing.T) {
+	sess := &session{ID: aws.String("s1"), Email: "owner@example.com"}
+	db := sessionRecords(t, 3, 1)
+	db.batchErr = errors.New("throttled")
+
+	err := deleteSession(sess, "bucket", "files", "members", "sessions", "blobs", "usage", db, &mockS3{}, testLogger())
+	assert.NotNil(t, err)
+	assert.Empty(t, db.deletes, "a failed delete keeps the session so it can be retried")
+
+	db.batchErr = nil
+	err = deleteSession(sess, "bucket", "files", "members", "sessions", "blobs", "usage", db, &mockS3{}, testLogger())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"usage", "sessions"}, db.deletes)
+
+	// only the unprocessed writes are resent
+	db = sessionRecords(t, 0, 0)
+	db.unprocessed = 1
+	assert.Nil(t, batchWrite(map[string][]dynamodb.WriteRequest{"files": make([]dynamodb.WriteRequest, 3)}, db, testLogger()))
+	assert.Equal(t, []int{3, 1}, db.batches)
+}
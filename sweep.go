@@ -0,0 +1,118 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+// pendingUploadGrace - how long a pending upload is kept after its upload url expired; an upload started just
+// before the url expired can still be in flight, and its s3 notification can be delivered late
+const pendingUploadGrace = time.Hour
+
+// expirePendingUploads - delete the records of the uploads that never arrived and give back what they reserved.
+//	* only files whose pending_until date passed more than pendingUploadGrace ago are expired; they are found
+//	through the sparse status-pending_until index of the files table
+//	* each delete is conditional on the file still being PENDING, so an upload completing concurrently is kept
+//	* the reserved quota, the upload link counters and the reference to a shared blob are released, and anything
+//	stored under the key of the upload is deleted
+func expirePendingUploads(now time.Time, store storeNames, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) (int, error) {
+	cutoff := formatKeyDate(now.Add(-pendingUploadGrace))
+	logger.WithFields(LOGGER.Fields{
+		"cutoff": cutoff,
+	}).Info("expirePendingUploads() - expire the pending uploads that never arrived")
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("status").Equal(expression.Value(fileStatusPending)).
+			And(expression.Key("pending_until").LessThan(expression.Value(cutoff)))).
+		Build()
+	if err != nil {
+		return 0, errInternal("unable to list the pending uploads", err)
+	}
+	input := dynamodb.QueryInput{
+		TableName:                 aws.String(store.files),
+		IndexName:                 aws.String(filesByPendingIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	expired := 0
+	for {
+		output, err := dbAPI.QueryRequest(&input).Send()
+		if err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"error": err.Error(),
+			}).Error("expirePendingUploads() - an error occurred while trying to query the pending uploads")
+			return expired, errInternal("unable to list the pending uploads", err)
+		}
+		for _, item := range output.Items {
+			var f = new(file)
+			if err := dynamodbattribute.UnmarshalMap(item, &f); err != nil {
+				continue
+			}
+			ok, err := expireUpload(f, store, dbAPI, s3API, logger)
+			if err != nil {
+				return expired, err
+			}
+			if ok {
+				expired++
+			}
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			return expired, nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// expireUpload - delete the record of a pending upload and release what it reserved; false when the file is no
+// longer pending
+func expireUpload(f *file, store storeNames, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) (bool, error) {
+	logger.WithFields(LOGGER.Fields{
+		"file_id":       f.ID,
+		"session_id":    f.SessionID,
+		"pending_until": aws.StringValue(f.PendingUntil),
+	}).Info("expireUpload() - delete the record of an upload that never arrived")
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("status").Equal(expression.Value(fileStatusPending))).
+		Build()
+	if err != nil {
+		return false, errInternal("unable to expire the upload", err)
+	}
+	_, err = dbAPI.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		TableName:                 aws.String(store.files),
+		Key:                       map[string]dynamodb.AttributeValue{"id": {S: aws.String(f.ID)}},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send()
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			// the upload arrived, or the file was deleted, since the index was read
+			return false, nil
+		}
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("expireUpload() - an error occurred while trying to delete the file record")
+		return false, errInternal("unable to expire the upload", err)
+	}
+	f.Status = fileStatusPending
+	releaseUpload(f, store.usage, dbAPI, logger)
+	if f.Contributor != nil && f.Contributor.LinkID != "" {
+		releaseLinkUpload(&uploadLink{ID: f.Contributor.LinkID}, f.Size, store.links, dbAPI, logger)
+	}
+	if err := deleteFileContent(f, store.bucket, store.blobs, dbAPI, s3API, logger); err != nil {
+		// the record is gone and the reservations are released; the orphaned content is only logged
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Warn("expireUpload() - unable to delete the content of the expired upload")
+	}
+	return true, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/assert"
+)
+
+// pendingUploads - a mock dynamodb whose pending index finds an upload through a link and one into a shared blob
+// that is still referenced by another file
+func pendingUploads(t *testing.T) *mockDynamo {
+	until := aws.String(formatKeyDate(time.Now().Add(-2 * time.Hour)))
+	viaLink := &file{ID: "f1", SessionID: "s1", Key: uploadKey("s1", "f1", "a.txt"), Size: 10, Status: fileStatusPending,
+		ChargedTo: "owner@example.com", PendingUntil: until, Contributor: &contributor{LinkID: "l1"}}
+	shared := &file{ID: "f2", SessionID: "s1", Key: blobKey("h"), Size: 20, Status: fileStatusPending,
+		ChargedTo: "owner@example.com", PendingUntil: until, BlobHash: aws.String("h")}
+	db := &mockDynamo{items: map[string][]map[string]dynamodb.AttributeValue{}}
+	for _, f := range []*file{viaLink, shared} {
+		item, err := dynamodbattribute.MarshalMap(f)
+		assert.Nil(t, err)
+		db.items["files"] = append(db.items["files"], item)
+	}
+	item, err := dynamodbattribute.MarshalMap(&blob{Hash: "h", Key: blobKey("h"), Status: fileStatusPending, RefCount: 1})
+	assert.Nil(t, err)
+	db.item = map[string]map[string]dynamodb.AttributeValue{"blobs": item}
+	return db
+}
+
+func TestExpirePendingUploads(t *testing.T) {
+	db := pendingUploads(t)
+	s3API := &mockS3{}
+	expired, err := expirePendingUploads(time.Now(), linkStore, db, s3API, testLogger())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, expired)
+	assert.Equal(t, []string{"files", "files"}, db.deletes)
+	// the session and user quotas and the link counters of the first, the quotas and the blob of the second
+	assert.Equal(t, []string{"usage", "usage", "links", "usage", "usage", "blobs"}, db.updates)
+	assert.Equal(t, []string{uploadKey("s1", "f1", "a.txt")}, s3API.deleted, "the shared blob is still referenced")
+
+	// uploads that arrived since the index was read are kept, and nothing they reserved is released
+	db = pendingUploads(t)
+	db.deleteErr = map[string]error{"files": awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil)}
+	s3API = &mockS3{}
+	expired, err = expirePendingUploads(time.Now(), linkStore, db, s3API, testLogger())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, expired)
+	assert.Empty(t, db.updates)
+	assert.Empty(t, s3API.deleted)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+const (
+	thumbnailsKeyPrefix = "thumbnails/"
+	// images larger than this are not decoded, so a crafted upload cannot exhaust the memory of the worker
+	maxThumbnailSourceBytes  = 50 << 20
+	maxThumbnailSourcePixels = 40000000
+	thumbnailJPEGQuality     = 85
+)
+
+// thumbnailSizes - the bounding boxes, in pixels, thumbnails are generated for; sorted ascending
+var thumbnailSizes = []int{128, 512}
+
+// thumbnailTypes - the image types thumbnails are generated for, with the type the thumbnails are encoded as.
+//	* png keeps the transparency of png and gif images; gif thumbnails show the first frame
+var thumbnailTypes = map[string]string{
+	"image/jpeg": "image/jpeg",
+	"image/png":  "image/png",
+	"image/gif":  "image/png",
+}
+
+// thumbnailKey - the s3 key of a thumbnail, derived from the key of the content: thumbnails/{key}/{size}.{ext}
+//	* deleting the content deletes everything under thumbnailsPrefix of its key as well
+func thumbnailKey(contentKey string, size int, contentType string) string {
+	ext := ".png"
+	if contentType == "image/jpeg" {
+		ext = ".jpg"
+	}
+	return thumbnailsPrefix(contentKey) + strconv.Itoa(size) + ext
+}
+
+// thumbnailsPrefix - the prefix of every thumbnail of the content under the key
+func thumbnailsPrefix(contentKey string) string {
+	return thumbnailsKeyPrefix + contentKey + "/"
+}
+
+// thumbnailContentType - the image type of the content, preferring the sniffed type over the declared one
+func thumbnailContentType(f *file) string {
+	if f.SniffedType != nil {
+		return *f.SniffedType
+	}
+	return mediaType(f.ContentType)
+}
+
+// fitSize - the dimensions of an image scaled down to fit a square of the size, keeping the aspect ratio.
+//	* images that already fit keep their dimensions; thumbnails are never scaled up
+func fitSize(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		height = height * size / width
+		width = size
+	} else {
+		width = width * size / height
+		height = size
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// resizeImage - scale the image down to the dimensions, averaging the source pixels each target pixel covers
+func resizeImage(src image.Image, width, height int) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// encodeImage - encode the image as the content type: jpeg, or png for anything else
+func encodeImage(w io.Writer, img image.Image, contentType string) error {
+	if contentType == "image/jpeg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	}
+	return png.Encode(w, img)
+}
+
+// decodeImage - decode an image of one of the thumbnail types, refusing images with too many pixels
+func decodeImage(content []byte, contentType string) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, errValidation("the image has too many pixels to generate thumbnails for")
+	}
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Decode(bytes.NewReader(content))
+	case "image/gif":
+		return gif.Decode(bytes.NewReader(content))
+	}
+	return png.Decode(bytes.NewReader(content))
+}
+
+// makeThumbnails - the encoded thumbnails of the image for every thumbnail size, keyed by size.
+//	* sizes the image already fits in share one thumbnail at the original dimensions
+func makeThumbnails(content []byte, contentType string) ([]thumbnail, map[int][]byte, error) {
+	img, err := decodeImage(content, contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	thumbType := thumbnailTypes[contentType]
+	thumbs := []thumbnail{}
+	encoded := map[int][]byte{}
+	for _, size := range thumbnailSizes {
+		width, height := fitSize(img.Bounds().Dx(), img.Bounds().Dy(), size)
+		if n := len(thumbs); n > 0 && thumbs[n-1].Width == width && thumbs[n-1].Height == height {
+			break
+		}
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, resizeImage(img, width, height), thumbType); err != nil {
+			return nil, nil, err
+		}
+		thumbs = append(thumbs, thumbnail{Size: size, Width: width, Height: height, ContentType: thumbType})
+		encoded[size] = buf.Bytes()
+	}
+	return thumbs, encoded, nil
+}
+
+// generateThumbnails - generate and store the thumbnails of an image content.
+//	* content of other types, too large or that cannot be decoded gets no thumbnails; only failures to store them are
+//	returned
+func generateThumbnails(contentKey, contentType string, size int64, bucketName string, s3API s3iface.S3API, logger *LOGGER.Entry) ([]thumbnail, error) {
+	contentType = mediaType(contentType)
+	if _, ok := thumbnailTypes[contentType]; !ok || size > maxThumbnailSourceBytes {
+		return nil, nil
+	}
+	logger.WithFields(LOGGER.Fields{
+		"key":          contentKey,
+		"content_type": contentType,
+	}).Info("generateThumbnails() - generate the thumbnails of the image")
+	output, err := s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(contentKey),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"key":   contentKey,
+			"error": err.Error(),
+		}).Error("generateThumbnails() - an error occurred while trying to read the image")
+		return nil, errInternal("unable to read the image", err)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(output.Body, maxThumbnailSourceBytes))
+	output.Body.Close()
+	if err != nil {
+		return nil, errInternal("unable to read the image", err)
+	}
+	thumbs, encoded, err := makeThumbnails(content, contentType)
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"key":   contentKey,
+			"error": err.Error(),
+		}).Warn("generateThumbnails() - the image cannot be decoded; no thumbnails are generated")
+		return nil, nil
+	}
+	for i := range thumbs {
+		thumbs[i].Key = thumbnailKey(contentKey, thumbs[i].Size, thumbs[i].ContentType)
+		_, err := s3API.PutObjectRequest(&s3.PutObjectInput{
+			Bucket:      aws.String(bucketName),
+			Key:         aws.String(thumbs[i].Key),
+			Body:        bytes.NewReader(encoded[thumbs[i].Size]),
+			ContentType: aws.String(thumbs[i].ContentType),
+		}).Send()
+		if err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"key":   thumbs[i].Key,
+				"error": err.Error(),
+			}).Error("generateThumbnails() - an error occurred while trying to store the thumbnail")
+			return nil, errInternal("unable to store the thumbnail", err)
+		}
+	}
+	return thumbs, nil
+}
+
+// pickThumbnail - the smallest thumbnail at least as large as the size, or the largest one; nil without thumbnails
+func pickThumbnail(thumbs []thumbnail, size int) *thumbnail {
+	if len(thumbs) == 0 {
+		return nil
+	}
+	for i := range thumbs {
+		if thumbs[i].Size >= size {
+			return &thumbs[i]
+		}
+	}
+	return &thumbs[len(thumbs)-1]
+}
+
+// thumbnailURL - presign a GET of the thumbnail of the file closest to the size; nil if the file has no thumbnails.
+//	* thumbnails are derived from the content, so they are only served for files that can be downloaded
+func thumbnailURL(f *file, size int, bucketName string, s3API s3iface.S3API, logger *LOGGER.Entry) (*string, error) {
+	if size <= 0 {
+		return nil, errValidation("the thumbnail size must be greater than 0")
+	}
+	thumb := pickThumbnail(f.Thumbnails, size)
+	if thumb == nil || checkDownloadable(f) != nil {
+		return nil, nil
+	}
+	url, err := s3API.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(thumb.Key),
+	}).Presign(downloadURLExpiry)
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": f.ID,
+			"error":   err.Error(),
+		}).Error("thumbnailURL() - an error occurred while trying to presign the thumbnail")
+		return nil, errInternal("unable to create the thumbnail url", err)
+	}
+	return &url, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFitSize(t *testing.T) {
+	w, h := fitSize(1000, 500, 128)
+	assert.Equal(t, []int{128, 64}, []int{w, h})
+	w, h = fitSize(300, 1200, 512)
+	assert.Equal(t, []int{128, 512}, []int{w, h})
+	w, h = fitSize(100, 50, 128)
+	assert.Equal(t, []int{100, 50}, []int{w, h}, "small images are not scaled up")
+	w, h = fitSize(4000, 1, 128)
+	assert.Equal(t, []int{128, 1}, []int{w, h})
+}
+
+func TestMakeThumbnails(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 1000, 500))
+	for x := 0; x < 1000; x++ {
+		for y := 0; y < 500; y++ {
+			src.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var content bytes.Buffer
+	assert.Nil(t, png.Encode(&content, src))
+	thumbs, encoded, err := makeThumbnails(content.Bytes(), "image/png")
+	assert.Nil(t, err)
+	assert.Equal(t, []thumbnail{
+		{Size: 128, Width: 128, Height: 64, ContentType: "image/png"},
+		{Size: 512, Width: 512, Height: 256, ContentType: "image/png"},
+	}, thumbs)
+	img, err := png.Decode(bytes.NewReader(encoded[128]))
+	assert.Nil(t, err)
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, color.NRGBAModel.Convert(img.At(10, 10)))
+
+	// a small gif gets a single png thumbnail at its own size
+	var small bytes.Buffer
+	assert.Nil(t, gif.Encode(&small, image.NewPaletted(image.Rect(0, 0, 40, 30), []color.Color{color.White}), nil))
+	thumbs, _, err = makeThumbnails(small.Bytes(), "image/gif")
+	assert.Nil(t, err)
+	assert.Equal(t, []thumbnail{{Size: 128, Width: 40, Height: 30, ContentType: "image/png"}}, thumbs)
+
+	_, _, err = makeThumbnails([]byte("not an image"), "image/jpeg")
+	assert.NotNil(t, err)
+}
+
+func TestPickThumbnail(t *testing.T) {
+	assert.Nil(t, pickThumbnail(nil, 128))
+	thumbs := []thumbnail{{Size: 128}, {Size: 512}}
+	assert.Equal(t, 128, pickThumbnail(thumbs, 64).Size)
+	assert.Equal(t, 512, pickThumbnail(thumbs, 200).Size)
+	assert.Equal(t, 512, pickThumbnail(thumbs, 2000).Size)
+
+	assert.Equal(t, "thumbnails/sessions/s1/f1/a.jpg/128.jpg", thumbnailKey(uploadKey("s1", "f1", "a.jpg"), 128, "image/jpeg"))
+	assert.Equal(t, "thumbnails/sessions/s1/f1/a.jpg/", thumbnailsPrefix(uploadKey("s1", "f1", "a.jpg")))
+}
+
+func TestThumbnailURLField(t *testing.T) {
+	// declared once on the file type; the services come from the config of the request
+	field := fileType.Fields()["thumbnailUrl"]
+	assert.NotNil(t, field)
+	url, err := field.Resolve(graphql.ResolveParams{Source: &file{ID: "f1"}, Context: context.Background(), Args: map[string]interface{}{"size": 128}})
+	assert.Nil(t, err)
+	assert.Nil(t, url, "no config outside of a request")
+
+	c := &conf{}
+	assert.Equal(t, config(c), configFromContext(context.WithValue(context.Background(), configKey, c)))
+}
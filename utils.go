@@ -1,14 +1,18 @@
 package main
 
 import (
-	"errors"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/expression"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/mitchellh/mapstructure"
@@ -18,6 +22,18 @@ import (
 
 const bearerTokenKey = "Bearer "
 
+// keyDateLayout - the layout of the dates stored in index sort keys; fixed width, so lexical order is time order
+const keyDateLayout = "2006-01-02T15:04:05.000000000Z"
+
+// envBool - parse the env variable as a bool, falling back to the default if it is unset or invalid
+func envBool(key string, def bool) bool {
+	val, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
 // hashPwd hash the input password using the bcrypt lib
 func hashPwd(pwd string) (*string, error) {
 	password := []byte(pwd) // convert to byte array
@@ -62,21 +78,18 @@ func buildToken(email string, jwtSecret []byte, tokenExpiryMin int) (*string, *i
 //		- non-expired
 //		- contains the authenticate user email
 //	If valid, return the authenticated users email
-func validateToken(authHeader interface{}, jwtSecret []byte, logger *LOGGER.Logger) (*string, error) {
+func validateToken(authHeader interface{}, jwtSecret []byte, logger *LOGGER.Entry) (*string, error) {
 	logger.WithFields(LOGGER.Fields{
 		"auth_header": authHeader,
 	}).Info("validateToken() - validate the incoming authorization header token")
 	// validate an Authorization header token is present in the request
-	if authHeader == nil {
-		return nil, errors.New("no valid Authorization token in request")
-	}
-	header := authHeader.(string)
+	header, _ := authHeader.(string)
 	if header == "" {
-		return nil, errors.New("no valid Authorization token in request")
+		return nil, errUnauthenticated("no valid Authorization token in request")
 	}
 	// validate that it is a Bearer token
 	if !strings.HasPrefix(header, bearerTokenKey) {
-		return nil, errors.New("authorization token is not valid Bearer token")
+		return nil, errUnauthenticated("authorization token is not valid Bearer token")
 	}
 	t := strings.Replace(header, bearerTokenKey, "", -1)
 	// parse the header token
@@ -92,7 +105,7 @@ func validateToken(authHeader interface{}, jwtSecret []byte, logger *LOGGER.Logg
 			"token":           t,
 			"jwt_parse_error": err.Error(),
 		}).Error("validateToken() - an error occurred while trying to parse the JWT")
-		return nil, err
+		return nil, errUnauthenticated("invalid authorization token")
 	}
 	// validate token and get claims
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
@@ -104,16 +117,16 @@ func validateToken(authHeader interface{}, jwtSecret []byte, logger *LOGGER.Logg
 				"claims":          claims,
 				"jwt_parse_error": err.Error(),
 			}).Error("validateToken() - an error occurred while trying to get the JWT claims")
-			return nil, err
+			return nil, errUnauthenticated("invalid authorization token")
 		}
 		email := decodedToken["email"]
 		return &email, nil
 	}
-	return nil, errors.New("invalid authorization token") // token is not valid, return error
+	return nil, errUnauthenticated("invalid authorization token") // token is not valid, return error
 }
 
 // putItem - save an item into the given table in dynamodb
-func putItem(itemMap map[string]dynamodb.AttributeValue, tableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Logger) error {
+func putItem(itemMap map[string]dynamodb.AttributeValue, tableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
 	logger.WithFields(LOGGER.Fields{
 		"table": tableName,
 		"item":  itemMap,
@@ -130,3 +143,90 @@ func putItem(itemMap map[string]dynamodb.AttributeValue, tableName string, dbAPI
 	}
 	return nil
 }
+
+// putNewItem - save an item into the given table in dynamodb only if no item with the same hash key exists
+//	* a dynamodb ConditionalCheckFailedException is returned as is; callers decide what conflict it represents
+func putNewItem(itemMap map[string]dynamodb.AttributeValue, hashKey, tableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	return putItemIf(itemMap, expression.Name(hashKey).AttributeNotExists(), tableName, dbAPI, logger)
+}
+
+// putItemIf - save an item into the given table in dynamodb only if the condition holds for the stored item
+//	* a dynamodb ConditionalCheckFailedException is returned as is; callers decide what conflict it represents
+func putItemIf(itemMap map[string]dynamodb.AttributeValue, cond expression.ConditionBuilder, tableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) error {
+	logger.WithFields(LOGGER.Fields{
+		"table": tableName,
+		"item":  itemMap,
+	}).Debug("putItemIf() - conditionally put the given item into the dynamodb table")
+	expr, err := expression.NewBuilder().
+		WithCondition(cond).
+		Build()
+	if err != nil {
+		return err
+	}
+	if _, err := dbAPI.PutItemRequest(&dynamodb.PutItemInput{
+		Item:                      itemMap,
+		TableName:                 aws.String(tableName),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}).Send(); err != nil {
+		if !isConditionalCheckFailed(err) {
+			logger.WithFields(LOGGER.Fields{
+				"put_item_error": err.Error(),
+				"table":          tableName,
+			}).Error("putItemIf() - an error occurred calling the PutItemRequest to store the given item")
+		}
+		return err
+	}
+	return nil
+}
+
+// decodeInput - decode a graphql input object into a struct using its json tags
+func decodeInput(input interface{}, out interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName: "json",
+		Result:  out,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
+}
+
+// formatKeyDate - format a date the way it is stored in an index sort key
+func formatKeyDate(t time.Time) string {
+	return t.UTC().Format(keyDateLayout)
+}
+
+// encodeKeyCursor - build an opaque pagination cursor from the string key attributes of an item
+func encodeKeyCursor(item map[string]dynamodb.AttributeValue, keys ...string) string {
+	key := make(map[string]string, len(keys))
+	for _, k := range keys {
+		if av, ok := item[k]; ok && av.S != nil {
+			key[k] = *av.S
+		}
+	}
+	raw, _ := json.Marshal(key)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeKeyCursor - parse an opaque pagination cursor back into an ExclusiveStartKey; every key must be present
+func decodeKeyCursor(cursor string, keys ...string) (map[string]dynamodb.AttributeValue, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var key map[string]string
+	if err := json.Unmarshal(raw, &key); err != nil {
+		return nil, err
+	}
+	startKey := make(map[string]dynamodb.AttributeValue, len(keys))
+	for _, k := range keys {
+		val, ok := key[k]
+		if !ok || val == "" {
+			return nil, fmt.Errorf("cursor is missing the %s key", k)
+		}
+		startKey[k] = dynamodb.AttributeValue{S: aws.String(val)}
+	}
+	return startKey, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3iface"
+	"github.com/satori/go.uuid"
+	LOGGER "github.com/sirupsen/logrus"
+)
+
+// defaultMaxFileVersions - the completed versions kept of every file when no limit is configured
+const defaultMaxFileVersions = 10
+
+// parseVersionLimit - read the most completed versions kept of a file; the default when not configured
+func parseVersionLimit(raw string) (int, error) {
+	if raw == "" {
+		return defaultMaxFileVersions, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 {
+		return 0, errValidation("the file version limit must be a number greater than 0")
+	}
+	return limit, nil
+}
+
+// createdAt - when the file record was created; the zero time for records without meta
+func createdAt(f *file) time.Time {
+	if f.Meta == nil || f.Meta.MetaCreatedAt == nil {
+		return time.Time{}
+	}
+	return *f.Meta.MetaCreatedAt
+}
+
+// newerVersion - whether a is a newer version of a file than b.
+//	* uploads requested concurrently can get the same version number; the one created last is the newer
+func newerVersion(a, b *file) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return createdAt(a).After(createdAt(b))
+}
+
+// sameFile - the files of the session with the name, newest version first
+func sameFile(files []*file, name string) []*file {
+	versions := []*file{}
+	for _, f := range files {
+		if f.Name == name {
+			versions = append(versions, f)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return newerVersion(versions[i], versions[j]) })
+	return versions
+}
+
+// nextVersion - the version number of a new upload of a file with the versions
+func nextVersion(versions []*file) int64 {
+	var next int64 = 1
+	for _, v := range versions {
+		if v.Version >= next {
+			next = v.Version + 1
+		}
+	}
+	return next
+}
+
+// currentFiles - the files of a session without the versions replaced by a newer one.
+//	* the current version of a file is its newest COMPLETE version; older versions, and uploads of older versions
+//	still pending or rejected, are left out
+//	* uploads of a newer version stay listed next to the current one, whether they are still pending or were
+//	rejected
+func currentFiles(files []*file) []*file {
+	current := map[string]*file{}
+	for _, f := range files {
+		if f.Status != fileStatusComplete {
+			continue
+		}
+		if c, ok := current[f.Name]; !ok || newerVersion(f, c) {
+			current[f.Name] = f
+		}
+	}
+	listed := []*file{}
+	for _, f := range files {
+		if c, ok := current[f.Name]; !ok || c == f || newerVersion(f, c) {
+			listed = append(listed, f)
+		}
+	}
+	return listed
+}
+
+// findFileVersions - every version of the file: the file records of its session with the same name, newest first
+func findFileVersions(f *file, filesTableName string, dbAPI dynamodbiface.DynamoDBAPI, logger *LOGGER.Entry) ([]*file, error) {
+	logger.WithFields(LOGGER.Fields{
+		"file_id": f.ID,
+	}).Info("findFileVersions() - find every version of the file")
+	files, err := findFiles(f.SessionID, filesTableName, dbAPI, logger)
+	if err != nil {
+		return nil, err
+	}
+	return sameFile(files, f.Name), nil
+}
+
+// pruneVersions - delete the oldest completed versions of a file beyond the version limit.
+//	* called once a version completes; pending and rejected versions are not counted
+//	* versions deleted concurrently are skipped
+func pruneVersions(f *file, maxVersions int, bucketName, filesTableName, blobsTableName, usageTableName string, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) error {
+	versions, err := findFileVersions(f, filesTableName, dbAPI, logger)
+	if err != nil {
+		return err
+	}
+	kept := 0
+	for _, v := range versions {
+		if v.Status != fileStatusComplete {
+			continue
+		}
+		if kept < maxVersions {
+			kept++
+			continue
+		}
+		logger.WithFields(LOGGER.Fields{
+			"file_id": v.ID,
+			"version": v.Version,
+		}).Info("pruneVersions() - delete a version beyond the version limit")
+		if err := deleteFile(v, bucketName, filesTableName, blobsTableName, usageTableName, dbAPI, s3API, logger); err != nil {
+			if serr, ok := err.(*serviceError); ok && serr.code == codeNotFound {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFileVersion - make an older version of a file current again by adding it as the newest version.
+//	* the caller must have authorized the user as an editor of the session, which must still accept uploads
+//	* content shared through a blob of the user restoring is referenced again and the new version is COMPLETE right
+//	away; other content, including a blob of another user, is copied under the key of the new version, which
+//	completes it through the uploads worker like any other upload
+//	* the new version gets the metadata and tags of the restored one
+//	* the restored content counts against the quotas again and must still be allowed by the file type policies
+func restoreFileVersion(sess *session, version *file, email, role string, quotas *quotaConfig, policy *typePolicy, maxVersions int, store storeNames, dbAPI dynamodbiface.DynamoDBAPI, s3API s3iface.S3API, logger *LOGGER.Entry) (*file, error) {
+	logger.WithFields(LOGGER.Fields{
+		"file_id": version.ID,
+		"version": version.Version,
+	}).Info("restoreFileVersion() - add an older version of the file as its newest version")
+	if version.Status != fileStatusComplete {
+		return nil, errConflict("only completely uploaded versions can be restored").withExtension("status", version.Status)
+	}
+	if err := checkDownloadable(version); err != nil {
+		return nil, err
+	}
+	if err := checkFileType(version.Name, version.ContentType, policy, sess); err != nil {
+		return nil, err
+	}
+	if version.SniffedType != nil {
+		if reason := sniffedRejection(version.Name, *version.SniffedType, policy, sess.TypePolicy); reason != "" {
+			return nil, errValidation(reason).withExtension("contentType", *version.SniffedType)
+		}
+	}
+	versions, err := findFileVersions(version, store.files, dbAPI, logger)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := uuid.NewV4()
+	now := time.Now()
+	active := true
+	f := &file{
+		ID:           id.String(),
+		SessionID:    version.SessionID,
+		Email:        email,
+		Name:         version.Name,
+		ContentType:  version.ContentType,
+		Size:         version.Size,
+		Key:          uploadKey(version.SessionID, id.String(), version.Name),
+		Status:       fileStatusPending,
+		Checksum:     version.Checksum,
+		ChargedTo:    email,
+		SniffedType:  version.SniffedType,
+		TypeMismatch: version.TypeMismatch,
+		Scan:         &fileScan{Status: scanStatusPending},
+		Version:      nextVersion(versions),
+		RestoredFrom: aws.String(version.ID),
+		Metadata:     version.Metadata,
+		Tags:         version.Tags,
+		Meta: &baseMeta{
+			MetaCreatedAt: &now,
+			MetaUpdatedAt: &now,
+			MetaIsActive:  &active,
+		},
+	}
+	if err := reserveUpload(f, role, quotas, store.usage, dbAPI, logger); err != nil {
+		return nil, err
+	}
+	// blobs are scoped to the user they are charged to, so only the restoring user's own blob is referenced again
+	if hash := blobHash(version.Checksum); version.BlobHash != nil && hash != "" && blobID(f.ChargedTo, hash) == *version.BlobHash {
+		b, err := acquireBlob(*version.BlobHash, version.Size, store.blobs, dbAPI, logger)
+		if err != nil {
+			releaseUpload(f, store.usage, dbAPI, logger)
+			return nil, err
+		}
+		f.Key = b.Key
+		f.BlobHash = version.BlobHash
+		if b.Status == fileStatusComplete {
+			f.Status = fileStatusComplete
+			f.ETag = b.ETag
+			f.Scan = b.Scan
+			f.Thumbnails = b.Thumbnails
+		}
+	}
+	if f.Status == fileStatusPending {
+		f.PendingUntil = aws.String(formatKeyDate(now.Add(uploadURLExpiry)))
+	}
+	fileMap, err := dynamodbattribute.MarshalMap(f)
+	if err != nil {
+		return nil, errInternal("unable to create the file record", err)
+	}
+	if err := putNewItem(fileMap, "id", store.files, dbAPI, logger); err != nil {
+		if f.BlobHash != nil {
+			if err := releaseBlob(*f.BlobHash, store.bucket, store.blobs, dbAPI, s3API, logger); err != nil {
+				logger.WithFields(LOGGER.Fields{
+					"hash":  *f.BlobHash,
+					"error": err.Error(),
+				}).Warn("restoreFileVersion() - unable to release the blob of the unsaved file")
+			}
+		}
+		f.Status = fileStatusPending
+		releaseUpload(f, store.usage, dbAPI, logger)
+		return nil, errInternal("unable to create the file record", err)
+	}
+	if f.BlobHash != nil {
+		if f.Status == fileStatusComplete {
+			commitUpload(f, store.usage, dbAPI, logger)
+			if err := pruneVersions(f, maxVersions, store.bucket, store.files, store.blobs, store.usage, dbAPI, s3API, logger); err != nil {
+				logger.WithFields(LOGGER.Fields{
+					"file_id": f.ID,
+					"error":   err.Error(),
+				}).Warn("restoreFileVersion() - unable to delete the versions beyond the version limit")
+			}
+		}
+		return f, nil
+	}
+	_, err = s3API.CopyObjectRequest(&s3.CopyObjectInput{
+		Bucket:     aws.String(store.bucket),
+		CopySource: aws.String(copySource(store.bucket, version.Key)),
+		Key:        aws.String(f.Key),
+	}).Send()
+	if err != nil {
+		logger.WithFields(LOGGER.Fields{
+			"file_id": version.ID,
+			"error":   err.Error(),
+		}).Error("restoreFileVersion() - an error occurred while trying to copy the content of the version")
+		if err := deleteFile(f, store.bucket, store.files, store.blobs, store.usage, dbAPI, s3API, logger); err != nil {
+			logger.WithFields(LOGGER.Fields{
+				"file_id": f.ID,
+				"error":   err.Error(),
+			}).Warn("restoreFileVersion() - unable to delete the record of the failed restore")
+		}
+		return nil, errInternal("unable to copy the content of the version", err)
+	}
+	return f, nil
+}
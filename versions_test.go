@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/assert"
+)
+
+// versionedFile - a file record of the name at the version, created at the minute
+func versionedFile(id, name string, version int64, status string, minute int) *file {
+	created := time.Date(2019, 1, 1, 0, minute, 0, 0, time.UTC)
+	return &file{ID: id, Name: name, Version: version, Status: status, Meta: &baseMeta{MetaCreatedAt: &created}}
+}
+
+func TestParseVersionLimit(t *testing.T) {
+	limit, err := parseVersionLimit("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultMaxFileVersions, limit)
+	limit, err = parseVersionLimit("3")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, limit)
+	_, err = parseVersionLimit("0")
+	assert.NotNil(t, err)
+	_, err = parseVersionLimit("many")
+	assert.NotNil(t, err)
+}
+
+func TestFileVersions(t *testing.T) {
+	legacy := versionedFile("f0", "a.txt", 0, fileStatusComplete, 0)
+	v1 := versionedFile("f1", "a.txt", 1, fileStatusComplete, 1)
+	v2 := versionedFile("f2", "a.txt", 2, fileStatusComplete, 2)
+	// requested concurrently with v2; created last, so it is the newer of the two
+	v2b := versionedFile("f2b", "a.txt", 2, fileStatusRejected, 3)
+	v3 := versionedFile("f3", "a.txt", 3, fileStatusPending, 4)
+	other := versionedFile("g1", "b.txt", 1, fileStatusPending, 0)
+	files := []*file{v1, other, v3, legacy, v2b, v2}
+
+	assert.Equal(t, []*file{v3, v2b, v2, v1, legacy}, sameFile(files, "a.txt"))
+	assert.Equal(t, int64(4), nextVersion(sameFile(files, "a.txt")))
+	assert.Equal(t, int64(1), nextVersion(sameFile(files, "c.txt")))
+
+	// the newest complete version, the newer uploads pending or rejected and the file of another name
+	assert.Equal(t, []*file{other, v3, v2b, v2}, currentFiles(files))
+	assert.Equal(t, []*file{v1}, currentFiles([]*file{legacy, v1}), "versioned uploads replace files uploaded before versioning")
+}
+
+func TestRestoreVersionBlobScopedToOwner(t *testing.T) {
+	sha := &fileChecksum{Algorithm: checksumSHA256, Value: "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek="}
+	id := blobID("alice@example.com", blobHash(sha))
+	stored, err := dynamodbattribute.MarshalMap(&blob{Hash: id, Key: blobKey(id), Size: 11, Status: fileStatusComplete, RefCount: 1})
+	assert.Nil(t, err)
+	sess := &session{ID: aws.String("s1"), Email: "alice@example.com", Status: aws.String(statusUploading)}
+	version := &file{ID: "f1", SessionID: "s1", Name: "a.txt", ContentType: "text/plain", Size: 11, Key: blobKey(id),
+		Status: fileStatusComplete, Checksum: sha, BlobHash: aws.String(id), ChargedTo: "alice@example.com",
+		Scan: &fileScan{Status: scanStatusClean}, Version: 1}
+
+	// the uploader references the blob again
+	db := &mockDynamo{item: map[string]map[string]dynamodb.AttributeValue{"blobs": stored}}
+	s3API := &mockS3{}
+	restored, err := restoreFileVersion(sess, version, "alice@example.com", roleOwner, &quotaConfig{}, &typePolicy{}, 10, linkStore, db, s3API, testLogger())
+	assert.Nil(t, err)
+	assert.Equal(t, aws.String(id), restored.BlobHash)
+	assert.Equal(t, fileStatusComplete, restored.Status)
+	assert.Contains(t, db.updates, "blobs")
+	assert.Empty(t, s3API.copied)
+
+	// another user gets a copy charged to them instead of a reference to the uploader's blob
+	db = &mockDynamo{item: map[string]map[string]dynamodb.AttributeValue{"blobs": stored}}
+	s3API = &mockS3{}
+	restored, err = restoreFileVersion(sess, version, "bob@example.com", roleEditor, &quotaConfig{}, &typePolicy{}, 10, linkStore, db, s3API, testLogger())
+	assert.Nil(t, err)
+	assert.Nil(t, restored.BlobHash)
+	assert.Equal(t, fileStatusPending, restored.Status)
+	assert.Equal(t, "bob@example.com", restored.ChargedTo)
+	assert.NotContains(t, db.updates, "blobs")
+	assert.Equal(t, []string{uploadKey("s1", restored.ID, "a.txt")}, s3API.copied)
+}
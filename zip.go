@@ -0,0 +1,186 @@
+package main
+
+import "time"
+
+// zip format constants; see the PKWARE APPNOTE
+const (
+	zipLocalHeaderSig     = 0x04034b50
+	zipDataDescriptorSig  = 0x08074b50
+	zipCentralHeaderSig   = 0x02014b50
+	zipEndSig             = 0x06054b50
+	zip64EndSig           = 0x06064b50
+	zip64LocatorSig       = 0x07064b50
+	zip64ExtraID          = 0x0001
+	zipVersion20          = 20
+	zipVersion45          = 45
+	zipCreatorUnix        = 3
+	zipFlagDataDescriptor = 0x0008
+	zipFlagUTF8           = 0x0800
+	zipMethodStore        = 0
+	zipMax16              = 0xffff
+	zipMax32              = 0xffffffff
+)
+
+// zipEntry - a file in a streamed zip archive.
+//	* entries are written with the store method: the content is copied as is, which keeps the crc the only state carried
+//	while a file is streamed, so writing can stop and resume anywhere inside a file
+//	* sizes and crc follow the content in a data descriptor, so the header can be written before the content is read
+type zipEntry struct {
+	Name     string    `json:"name"`
+	Modified time.Time `json:"modified"`
+	Offset   uint64    `json:"offset"`
+	Size     uint64    `json:"size"`
+	CRC      uint32    `json:"crc"`
+}
+
+// zip64 - whether the entry content is too large for the 32 bit size fields
+func (e *zipEntry) zip64() bool {
+	return e.Size >= zipMax32
+}
+
+func (e *zipEntry) version() uint16 {
+	if e.zip64() || e.Offset >= zipMax32 {
+		return zipVersion45
+	}
+	return zipVersion20
+}
+
+// zipDOSTime - the MS-DOS date and time fields of a zip header
+func zipDOSTime(t time.Time) (uint16, uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	clock := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, clock
+}
+
+// zipBuffer - little endian append helpers
+type zipBuffer []byte
+
+func (b *zipBuffer) u16(v uint16) { *b = append(*b, byte(v), byte(v>>8)) }
+func (b *zipBuffer) u32(v uint32) { b.u16(uint16(v)); b.u16(uint16(v >> 16)) }
+func (b *zipBuffer) u64(v uint64) { b.u32(uint32(v)); b.u32(uint32(v >> 32)) }
+
+// zipLocalHeader - the local file header written before the entry content
+func zipLocalHeader(e *zipEntry) []byte {
+	var extra zipBuffer
+	size := uint32(0)
+	if e.zip64() {
+		// the real sizes follow in the (64 bit) data descriptor
+		extra.u16(zip64ExtraID)
+		extra.u16(16)
+		extra.u64(0)
+		extra.u64(0)
+		size = zipMax32
+	}
+	date, clock := zipDOSTime(e.Modified)
+	b := make(zipBuffer, 0, 30+len(e.Name)+len(extra))
+	b.u32(zipLocalHeaderSig)
+	b.u16(e.version())
+	b.u16(zipFlagDataDescriptor | zipFlagUTF8)
+	b.u16(zipMethodStore)
+	b.u16(clock)
+	b.u16(date)
+	b.u32(0) // crc, in the data descriptor
+	b.u32(size)
+	b.u32(size)
+	b.u16(uint16(len(e.Name)))
+	b.u16(uint16(len(extra)))
+	b = append(b, e.Name...)
+	return append(b, extra...)
+}
+
+// zipDataDescriptor - the crc and sizes written after the entry content
+func zipDataDescriptor(e *zipEntry) []byte {
+	var b zipBuffer
+	b.u32(zipDataDescriptorSig)
+	b.u32(e.CRC)
+	if e.zip64() {
+		b.u64(e.Size)
+		b.u64(e.Size)
+	} else {
+		b.u32(uint32(e.Size))
+		b.u32(uint32(e.Size))
+	}
+	return b
+}
+
+// zipCentralDirectory - the central directory and end of central directory records, written at the given offset after
+// the last entry. The zip64 end records are added when the entry count, sizes or offsets need them.
+func zipCentralDirectory(entries []zipEntry, offset uint64) []byte {
+	var b zipBuffer
+	for i := range entries {
+		e := &entries[i]
+		var extra zipBuffer
+		size, off := uint32(e.Size), uint32(e.Offset)
+		if e.zip64() {
+			extra.u64(e.Size)
+			extra.u64(e.Size)
+			size = zipMax32
+		}
+		if e.Offset >= zipMax32 {
+			extra.u64(e.Offset)
+			off = zipMax32
+		}
+		if len(extra) > 0 {
+			var header zipBuffer
+			header.u16(zip64ExtraID)
+			header.u16(uint16(len(extra)))
+			extra = append(header, extra...)
+		}
+		date, clock := zipDOSTime(e.Modified)
+		b.u32(zipCentralHeaderSig)
+		b.u16(zipCreatorUnix<<8 | zipVersion45)
+		b.u16(e.version())
+		b.u16(zipFlagDataDescriptor | zipFlagUTF8)
+		b.u16(zipMethodStore)
+		b.u16(clock)
+		b.u16(date)
+		b.u32(e.CRC)
+		b.u32(size)
+		b.u32(size)
+		b.u16(uint16(len(e.Name)))
+		b.u16(uint16(len(extra)))
+		b.u16(0)          // comment length
+		b.u16(0)          // disk number
+		b.u16(0)          // internal attributes
+		b.u32(0644 << 16) // external attributes: a regular -rw-r--r-- file
+		b.u32(off)
+		b = append(b, e.Name...)
+		b = append(b, extra...)
+	}
+	dirSize := uint64(len(b))
+	count := uint64(len(entries))
+	if count >= zipMax16 || dirSize >= zipMax32 || offset >= zipMax32 {
+		end64 := offset + dirSize
+		b.u32(zip64EndSig)
+		b.u64(44) // size of the rest of the record
+		b.u16(zipCreatorUnix<<8 | zipVersion45)
+		b.u16(zipVersion45)
+		b.u32(0)
+		b.u32(0)
+		b.u64(count)
+		b.u64(count)
+		b.u64(dirSize)
+		b.u64(offset)
+		b.u32(zip64LocatorSig)
+		b.u32(0)
+		b.u64(end64)
+		b.u32(1)
+		count, dirSize, offset = zipMax16, zipMax32, zipMax32
+		if uint64(len(entries)) < zipMax16 {
+			count = uint64(len(entries))
+		}
+	}
+	b.u32(zipEndSig)
+	b.u16(0)
+	b.u16(0)
+	b.u16(uint16(count))
+	b.u16(uint16(count))
+	b.u32(uint32(dirSize))
+	b.u32(uint32(offset))
+	b.u16(0) // comment length
+	return b
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZipWriter(t *testing.T) {
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"report.pdf", "%PDF-1.4 not really a pdf"},
+		{"empty.txt", ""},
+		{"photos/überblick.jpg", "jpeg bytes"},
+	}
+	modified := time.Date(2019, 5, 1, 10, 30, 20, 0, time.UTC)
+
+	var archive []byte
+	var entries []zipEntry
+	for _, f := range files {
+		e := zipEntry{Name: f.name, Modified: modified, Offset: uint64(len(archive))}
+		archive = append(archive, zipLocalHeader(&e)...)
+		// the content is streamed in pieces; the running crc is the only state carried between them
+		for i := 0; i < len(f.content); i += 4 {
+			end := i + 4
+			if end > len(f.content) {
+				end = len(f.content)
+			}
+			chunk := []byte(f.content[i:end])
+			e.CRC = crc32.Update(e.CRC, crc32.IEEETable, chunk)
+			e.Size += uint64(len(chunk))
+			archive = append(archive, chunk...)
+		}
+		archive = append(archive, zipDataDescriptor(&e)...)
+		entries = append(entries, e)
+	}
+	archive = append(archive, zipCentralDirectory(entries, uint64(len(archive)))...)
+
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	assert.Nil(t, err)
+	assert.Len(t, r.File, len(files))
+	for i, zf := range r.File {
+		assert.Equal(t, files[i].name, zf.Name)
+		assert.Equal(t, modified, zf.Modified.UTC())
+		rc, err := zf.Open()
+		assert.Nil(t, err)
+		content, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err, "crc and sizes must match the content")
+		assert.Equal(t, files[i].content, string(content))
+		rc.Close()
+	}
+}
+
+func TestArchiveNames(t *testing.T) {
+	used := map[string]bool{}
+	assert.Equal(t, "report.pdf", uniqueArchiveName("report.pdf", used))
+	assert.Equal(t, "report (2).pdf", uniqueArchiveName("report.pdf", used))
+	assert.Equal(t, "report (3).pdf", uniqueArchiveName("report.pdf", used))
+	assert.Equal(t, "README", uniqueArchiveName("README", used))
+	assert.Equal(t, "README (2)", uniqueArchiveName("README", used))
+}